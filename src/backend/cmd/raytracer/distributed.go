@@ -0,0 +1,96 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"raytracer/distributed"
+	"raytracer/process"
+	"time"
+)
+
+const shutdownGrace = 2 * time.Second
+
+func coordinatorCommand(args []string) error {
+	flags := flag.NewFlagSet("coordinator", flag.ExitOnError)
+	files := sceneFlags(flags)
+	passPath := flags.String("pass", "", "render pass JSON of the whole frame")
+	listen := flags.String("listen", ":8080", "HTTP listen address")
+	tileSize := flags.Int("tile", 64, "tile size in pixels")
+	splits := flags.Int("splits", 1, "sample ranges per tile")
+	leaseTimeout := flags.Duration("lease-timeout", time.Minute, "time before a lease is issued again")
+	out := flags.String("out", "render.png", "output PNG image")
+	filmPath := flags.String("film", "", "output float film file for merging")
+	flags.Parse(args)
+
+	if files.Context == "" || *passPath == "" {
+		return errors.New("-context and -pass are required")
+	}
+
+	scene, err := readScene(*files)
+	if err != nil {
+		return err
+	}
+	pass, err := readRenderPass(*passPath)
+	if err != nil {
+		return err
+	}
+
+	coordinator, err := distributed.NewCoordinator(&distributed.Job{
+		Scene:        *scene,
+		Pass:         *pass,
+		TileSize:     *tileSize,
+		SampleSplits: *splits,
+		LeaseTimeout: *leaseTimeout,
+		BVHCache:     files.BVHCache,
+	})
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: coordinator}
+	go server.Serve(listener)
+	fmt.Printf("Coordinator listening on %s, %d work units\n", listener.Addr(), coordinator.Status().Units)
+
+	<-coordinator.Done()
+
+	// Keep serving for a while so that polling workers
+	// receive the end of the job before shutting down
+	time.Sleep(shutdownGrace)
+	shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(shutdown)
+
+	result := coordinator.FilmFile()
+	if *filmPath != "" {
+		if err := writeFilmFile(result, *filmPath); err != nil {
+			return err
+		}
+	}
+
+	return writePNG(*out, process.DevelopFilmFile(result))
+}
+
+func workerCommand(args []string) error {
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	coordinator := flags.String("coordinator", "http://localhost:8080", "coordinator URL")
+	hostname, _ := os.Hostname()
+	id := flags.String("id", fmt.Sprintf("%s-%d", hostname, os.Getpid()), "worker id")
+	bvhCache := flags.String("bvh-cache", "", "directory of cached BVH files, skips building for known meshes")
+	flags.Parse(args)
+
+	worker := distributed.NewWorker(*id, *coordinator)
+	worker.BVHCache = *bvhCache
+	return worker.Run(context.Background())
+}
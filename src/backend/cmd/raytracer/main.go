@@ -0,0 +1,49 @@
+//go:build !js
+// +build !js
+
+// Native command line renderer
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "render":
+		err = renderCommand(os.Args[2:])
+	case "merge":
+		err = mergeCommand(os.Args[2:])
+	case "serve":
+		err = serveCommand(os.Args[2:])
+	case "coordinator":
+		err = coordinatorCommand(os.Args[2:])
+	case "worker":
+		err = workerCommand(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: raytracer <command> [flags]")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  render       render a scene to a PNG image, with checkpoints")
+	fmt.Fprintln(os.Stderr, "  merge        merge film files of the same frame")
+	fmt.Fprintln(os.Stderr, "  serve        stream a progressive render over HTTP")
+	fmt.Fprintln(os.Stderr, "  coordinator  serve leases of a frame to workers over HTTP")
+	fmt.Fprintln(os.Stderr, "  worker       render leases of a coordinator")
+}
@@ -0,0 +1,58 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"raytracer/models"
+	"raytracer/process"
+)
+
+func mergeCommand(args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	out := flags.String("out", "merged.film", "output film file")
+	pngPath := flags.String("png", "", "also develop the merged film to a PNG image")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		return errors.New("no film files given")
+	}
+
+	files := make([]*models.FilmFile, 0, flags.NArg())
+	for _, path := range flags.Args() {
+		file, err := readFilmFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		files = append(files, file)
+	}
+
+	merged, err := models.MergeFilms(files)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Merged %d films, %.1f samples per pixel\n", len(files), merged.Film.SamplesPerPixel())
+
+	if err := writeFilmFile(merged, *out); err != nil {
+		return err
+	}
+
+	if *pngPath != "" {
+		return writePNG(*pngPath, process.DevelopFilmFile(merged))
+	}
+
+	return nil
+}
+
+func readFilmFile(path string) (*models.FilmFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return models.ReadFilmFile(file)
+}
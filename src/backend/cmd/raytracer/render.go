@@ -0,0 +1,203 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"raytracer/models"
+	"raytracer/process"
+)
+
+func renderCommand(args []string) error {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	files := sceneFlags(flags)
+	passPath := flags.String("pass", "", "render pass JSON")
+	out := flags.String("out", "render.png", "output PNG image")
+	filmPath := flags.String("film", "", "output float film file for merging")
+	resultPath := flags.String("result", "", "output binary result, - for stdout")
+	resultFormat := flags.String("result-format", string(models.RGBA8), "pixel format of the binary result, rgba8 or float32")
+	checkpointPath := flags.String("checkpoint", "", "checkpoint file")
+	interval := flags.Int("checkpoint-interval", 0, "sample rounds between checkpoints, defaults to the render settings")
+	resume := flags.Bool("resume", false, "continue from the checkpoint file if it exists")
+	flags.Parse(args)
+
+	if files.Context == "" {
+		return errors.New("-context is required")
+	}
+
+	context, err := loadScene(*files)
+	if err != nil {
+		return err
+	}
+
+	var render *process.IncrementalRender
+	if *resume && *checkpointPath != "" {
+		render, err = resumeFromFile(context, *checkpointPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if render != nil {
+			fmt.Printf("Resumed %s after %d rounds\n", *checkpointPath, render.Rounds)
+		}
+	}
+
+	if render == nil {
+		if *passPath == "" {
+			return errors.New("-pass is required")
+		}
+		pass, err := readRenderPass(*passPath)
+		if err != nil {
+			return err
+		}
+		render = startRender(context, pass)
+	}
+
+	if *interval <= 0 {
+		*interval = render.Pass.Settings.CheckpointInterval
+	}
+
+	// An interrupt stops the render after the current row, the
+	// checkpoint and outputs are still written. The signal stays
+	// buffered in the channel once received
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	defer signal.Stop(interrupted)
+	context.Cancelled = func() bool { return len(interrupted) > 0 }
+
+	for render.Step(context) == process.NotStopped {
+		if *checkpointPath != "" && *interval > 0 && render.Rounds%*interval == 0 {
+			if err := writeCheckpointFile(context, render, *checkpointPath); err != nil {
+				return err
+			}
+		}
+	}
+	fmt.Printf("Stopped after %d rounds: %s\n", render.Rounds, render.StopReason)
+
+	if *checkpointPath != "" {
+		if err := writeCheckpointFile(context, render, *checkpointPath); err != nil {
+			return err
+		}
+	}
+
+	if *filmPath != "" {
+		if err := writeFilmFile(render.FilmFile(context), *filmPath); err != nil {
+			return err
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, render.Pass.Width, render.Pass.Height))
+	colors := process.Resolve(render.Pass, render.Film)
+	process.Develop(context, render.Pass, colors, img)
+
+	if *resultPath != "" {
+		result := &models.RenderResult{
+			ImageData:       img,
+			Colors:          colors,
+			StopReason:      string(render.StopReason),
+			SamplesPerPixel: render.Film.SamplesPerPixel(),
+		}
+		if err := writeResult(result, models.PixelFormat(*resultFormat), *resultPath); err != nil {
+			return err
+		}
+	}
+
+	return writePNG(*out, img)
+}
+
+func writeResult(result *models.RenderResult, format models.PixelFormat, path string) error {
+	if path == "-" {
+		return result.WriteBinary(os.Stdout, format, result.ImageData.Bounds())
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	if err := result.WriteBinary(writer, format, result.ImageData.Bounds()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Starts the render of a pass. Renders of the same pass with other seeds
+// take other samples, so that their films can be merged
+func startRender(context *models.RenderContext, pass *models.RenderPass) *process.IncrementalRender {
+	pass.Initialize(context)
+	pass.Camera.Initialize(pass.TotalWidth, pass.TotalHeight)
+	process.SeedSamples(context, pass)
+	return process.NewIncrementalRender(context, pass)
+}
+
+func resumeFromFile(context *models.RenderContext, path string) (*process.IncrementalRender, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	checkpoint, err := models.ReadCheckpoint(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return process.ResumeIncrementalRender(context, checkpoint)
+}
+
+// Writes to a temporary file first so that an interrupted
+// write never replaces a valid checkpoint
+func writeCheckpointFile(context *models.RenderContext, render *process.IncrementalRender, path string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := models.WriteCheckpoint(file, render.Checkpoint(context)); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
+}
+
+func writeFilmFile(film *models.FilmFile, path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := models.WriteFilmFile(file, film); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func writePNG(path string, img image.Image) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,98 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"raytracer/models"
+	"strings"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+const testObj = `v -5 -1 -5
+v 5 -1 -5
+v 5 -1 5
+v -5 -1 5
+g Floor
+usemtl White
+f 1 2 3
+f 1 3 4
+v -1 4 -1
+v 1 4 -1
+v 1 4 1
+v -1 4 1
+g Light
+usemtl Light
+f 5 8 7
+f 5 7 6
+`
+
+const testMtl = `newmtl White
+Kd 0.8 0.8 0.8
+
+newmtl Light
+Kd 1 1 1
+`
+
+const testPass = `{
+	"TotalWidth": 8, "TotalHeight": 4, "RNGSeed": 1,
+	"Camera": {"Transform": [1,0,0,0, 0,1,0,0, 0,0,1,0, 0,0,5,1], "ProjectionPlaneDistance": 1, "FieldOfView": 60, "RaysPerPixel": 2},
+	"Settings": {"BounceLimit": 1, "LightSampleRays": 1, "LightIntensity": 10}
+}`
+
+func writeTestFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRenderSeeds(t *testing.T) {
+	raw, _ := json.Marshal(map[string]interface{}{
+		"UseBVH":         true,
+		"BVHMaxLeafSize": 2,
+		"BVHMaxDepth":    10,
+		"ObjBuffer":      testObj,
+		"MtlBuffer":      testMtl,
+	})
+	context, err := loadScene(sceneFiles{Context: writeTestFile(t, "context.json", string(raw))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if context.Light == nil {
+		t.Fatal("Scene has no area light")
+	}
+
+	// First camera and light samples of a render of the pass
+	samples := func(seed string) (*models.Ray, mgl32.Vec3) {
+		t.Helper()
+		pass, err := readRenderPass(writeTestFile(t, "pass.json", strings.Replace(testPass, `"RNGSeed": 1`, `"RNGSeed": `+seed, 1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		render := startRender(context, pass)
+		point, _ := context.Light.Sample()
+		return render.Pass.Camera.GetCameraRay(0, 0, 3, 2), point
+	}
+
+	ray, light := samples("1")
+	again, lightAgain := samples("1")
+	if again.PixelSample != ray.PixelSample || again.Time != ray.Time || lightAgain != light {
+		t.Errorf("Renders of the same seed took other samples")
+	}
+
+	other, otherLight := samples("2")
+	if other.PixelSample == ray.PixelSample {
+		t.Errorf("Renders of other seeds took the same camera sample %v", ray.PixelSample)
+	}
+	if otherLight == light {
+		t.Errorf("Renders of other seeds took the same light sample %v", light)
+	}
+}
@@ -0,0 +1,107 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"raytracer/distributed"
+	"raytracer/models"
+)
+
+// Files of a scene, as sent to the workers by the frontend
+type sceneFiles struct {
+	Context  string
+	Obj      string
+	Mtl      string
+	Textures string
+	BVHCache string
+}
+
+func sceneFlags(flags *flag.FlagSet) *sceneFiles {
+	files := &sceneFiles{}
+	flags.StringVar(&files.Context, "context", "", "render context JSON")
+	flags.StringVar(&files.Obj, "obj", "", "scene OBJ file")
+	flags.StringVar(&files.Mtl, "mtl", "", "scene MTL file")
+	flags.StringVar(&files.Textures, "textures", ".", "directory of the textures listed in the context")
+	flags.StringVar(&files.BVHCache, "bvh-cache", "", "directory of cached BVH files, skips building for known meshes")
+	return files
+}
+
+// Reads the render context JSON, the OBJ and MTL files and
+// the textures listed in the context
+func readScene(files sceneFiles) (*distributed.SceneData, error) {
+	scene := &distributed.SceneData{Textures: make(map[string][]byte)}
+
+	raw, err := ioutil.ReadFile(files.Context)
+	if err != nil {
+		return nil, err
+	}
+	scene.Context = raw
+
+	context := &models.RenderContext{}
+	if err := json.Unmarshal(raw, context); err != nil {
+		return nil, err
+	}
+	scene.Obj, scene.Mtl, scene.LUT = context.ObjBuffer, context.MtlBuffer, context.LUTBuffer
+
+	if files.Obj != "" {
+		raw, err := ioutil.ReadFile(files.Obj)
+		if err != nil {
+			return nil, err
+		}
+		scene.Obj = string(raw)
+	}
+	if files.Mtl != "" {
+		raw, err := ioutil.ReadFile(files.Mtl)
+		if err != nil {
+			return nil, err
+		}
+		scene.Mtl = string(raw)
+	}
+
+	for _, texture := range context.RawTextures {
+		raw, err := ioutil.ReadFile(filepath.Join(files.Textures, texture.Name))
+		if err != nil {
+			return nil, err
+		}
+		scene.Textures[texture.Name] = raw
+	}
+
+	return scene, nil
+}
+
+// Reads the scene files, initializes the scene and builds
+// or loads the cached BVH
+func loadScene(files sceneFiles) (*models.RenderContext, error) {
+	scene, err := readScene(files)
+	if err != nil {
+		return nil, err
+	}
+	return distributed.LoadScene(scene, files.BVHCache)
+}
+
+func readRenderPass(path string) (*models.RenderPass, error) {
+	pass := &models.RenderPass{}
+	if err := readJSON(path, pass); err != nil {
+		return nil, err
+	}
+	// A pass without a region renders the whole frame
+	if pass.Width <= 0 && pass.Height <= 0 {
+		pass.Width, pass.Height = pass.TotalWidth, pass.TotalHeight
+	}
+	rand.Seed(pass.RNGSeed)
+	return pass, nil
+}
+
+func readJSON(path string, v interface{}) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
@@ -0,0 +1,53 @@
+//go:build !js
+// +build !js
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"raytracer/preview"
+)
+
+func serveCommand(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	files := sceneFlags(flags)
+	passPath := flags.String("pass", "", "render pass JSON of the whole frame")
+	listen := flags.String("listen", "localhost:8090", "HTTP listen address")
+	flags.Parse(args)
+
+	if files.Context == "" || *passPath == "" {
+		return errors.New("-context and -pass are required")
+	}
+
+	scene, err := loadScene(*files)
+	if err != nil {
+		return err
+	}
+	pass, err := readRenderPass(*passPath)
+	if err != nil {
+		return err
+	}
+
+	server := preview.NewServer(scene, *pass)
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Preview at http://%s/\n", listener.Addr())
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- http.Serve(listener, server)
+	}()
+	go func() {
+		errs <- server.Run(context.Background())
+	}()
+
+	return <-errs
+}
@@ -0,0 +1,347 @@
+package distributed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"raytracer/models"
+	"raytracer/utility"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrLeaseDone = errors.New("lease is already done")
+
+// Render job of one frame. The pass covers the whole frame
+type Job struct {
+	Scene SceneData
+	Pass  models.RenderPass
+
+	// Size of the square tiles and the number of sample ranges each tile
+	// is split into. Camera.RaysPerPixel samples are divided between them
+	TileSize     int
+	SampleSplits int
+
+	// Time a worker has to return a lease before it is issued again
+	LeaseTimeout time.Duration
+
+	// Directory of cached BVH files for loading the scene, optional
+	BVHCache string
+}
+
+const (
+	defaultTileSize     = 64
+	defaultLeaseTimeout = time.Minute
+)
+
+type unitState int
+
+const (
+	unitPending unitState = iota
+	unitLeased
+	unitDone
+)
+
+// Tile and sample range of the frame
+type workUnit struct {
+	pass models.RenderPass
+
+	state    unitState
+	leaseID  int
+	deadline time.Time
+}
+
+// Owns a job and hands out leases of its work units to workers over HTTP.
+// Rendered tiles are merged into the film of the frame
+type Coordinator struct {
+	mu sync.Mutex
+
+	job       *Job
+	scene     []byte
+	sceneHash string
+
+	units    []*workUnit
+	leases   map[int]*workUnit
+	nextID   int
+	reissued int
+
+	film        *models.Film
+	contentHash string
+	lut         *models.LUT3D
+	done        chan struct{}
+
+	// Current time, replaced in tests
+	now func() time.Time
+}
+
+func NewCoordinator(job *Job) (*Coordinator, error) {
+	if job.TileSize <= 0 {
+		job.TileSize = defaultTileSize
+	}
+	if job.SampleSplits <= 0 {
+		job.SampleSplits = 1
+	}
+	if job.LeaseTimeout <= 0 {
+		job.LeaseTimeout = defaultLeaseTimeout
+	}
+
+	pass := &job.Pass
+	if pass.TotalWidth <= 0 || pass.TotalHeight <= 0 {
+		return nil, errors.New("job has no frame size")
+	}
+	pass.XOffset, pass.YOffset = 0, 0
+	pass.Width, pass.Height = pass.TotalWidth, pass.TotalHeight
+	if pass.Camera.RaysPerPixel < job.SampleSplits {
+		job.SampleSplits = pass.Camera.RaysPerPixel
+	}
+
+	scene, err := json.Marshal(&job.Scene)
+	if err != nil {
+		return nil, err
+	}
+	sceneHash, err := job.Scene.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	// Every worker must render the geometry and BVH of the scene
+	context, err := LoadScene(&job.Scene, job.BVHCache)
+	if err != nil {
+		return nil, err
+	}
+
+	coordinator := &Coordinator{
+		job:         job,
+		scene:       scene,
+		sceneHash:   sceneHash,
+		leases:      make(map[int]*workUnit),
+		film:        models.NewFilm(pass.TotalWidth, pass.TotalHeight, models.NewFilter(pass.Settings.Filter, pass.Settings.FilterRadius)),
+		contentHash: context.ContentHash(),
+		lut:         context.LUT,
+		done:        make(chan struct{}),
+		now:         time.Now,
+	}
+	coordinator.splitUnits()
+
+	return coordinator, nil
+}
+
+func (coordinator *Coordinator) splitUnits() {
+	job := coordinator.job
+	samples := job.Pass.Camera.RaysPerPixel
+
+	for y := 0; y < job.Pass.TotalHeight; y += job.TileSize {
+		for x := 0; x < job.Pass.TotalWidth; x += job.TileSize {
+			for split := 0; split < job.SampleSplits; split++ {
+				// Spread the remainder over the first ranges
+				count := samples / job.SampleSplits
+				if split < samples%job.SampleSplits {
+					count++
+				}
+
+				pass := job.Pass
+				pass.XOffset = x
+				pass.YOffset = y
+				pass.Width = utility.MinInt(job.TileSize, job.Pass.TotalWidth-x)
+				pass.Height = utility.MinInt(job.TileSize, job.Pass.TotalHeight-y)
+				pass.Camera.RaysPerPixel = count
+				pass.TaskID = len(coordinator.units)
+				pass.RNGSeed = job.Pass.RNGSeed + int64(len(coordinator.units))
+
+				coordinator.units = append(coordinator.units, &workUnit{pass: pass})
+			}
+		}
+	}
+
+	if len(coordinator.units) == 0 {
+		close(coordinator.done)
+	}
+}
+
+// Returns a lease of a pending unit, or of a unit whose lease timed out.
+// Returns nil when all units are done or leased
+func (coordinator *Coordinator) Lease(workerID string) *Lease {
+	coordinator.mu.Lock()
+	defer coordinator.mu.Unlock()
+
+	now := coordinator.now()
+	for _, unit := range coordinator.units {
+		if unit.state == unitDone || (unit.state == unitLeased && now.Before(unit.deadline)) {
+			continue
+		}
+		if unit.state == unitLeased {
+			coordinator.reissued++
+		}
+
+		coordinator.nextID++
+		unit.state = unitLeased
+		unit.leaseID = coordinator.nextID
+		unit.deadline = now.Add(coordinator.job.LeaseTimeout)
+		coordinator.leases[unit.leaseID] = unit
+
+		return &Lease{
+			ID:        unit.leaseID,
+			SceneHash: coordinator.sceneHash,
+			Pass:      unit.pass,
+			Deadline:  unit.deadline,
+		}
+	}
+
+	return nil
+}
+
+// Merges the film rendered for a lease into the frame. Results of leases
+// that timed out are still accepted if the unit has not been done since
+func (coordinator *Coordinator) Complete(leaseID int, result *models.FilmFile) error {
+	coordinator.mu.Lock()
+	defer coordinator.mu.Unlock()
+
+	unit, found := coordinator.leases[leaseID]
+	if !found {
+		return fmt.Errorf("unknown lease %d", leaseID)
+	}
+	if unit.state == unitDone {
+		return fmt.Errorf("lease %d: %w", leaseID, ErrLeaseDone)
+	}
+
+	if result.ContentHash != coordinator.contentHash {
+		return fmt.Errorf("lease %d: %w", leaseID, models.ErrFilmMismatch)
+	}
+
+	pass := &unit.pass
+	if result.Film == nil || result.Film.Width != pass.Width || result.Film.Height != pass.Height {
+		return fmt.Errorf("lease %d: film does not match the tile", leaseID)
+	}
+	if err := coordinator.film.MergeRegion(result.Film, pass.XOffset, pass.YOffset); err != nil {
+		return fmt.Errorf("lease %d: %w", leaseID, err)
+	}
+
+	unit.state = unitDone
+	if coordinator.status().Done == len(coordinator.units) {
+		close(coordinator.done)
+	}
+
+	return nil
+}
+
+func (coordinator *Coordinator) Status() Status {
+	coordinator.mu.Lock()
+	defer coordinator.mu.Unlock()
+	return coordinator.status()
+}
+
+func (coordinator *Coordinator) status() Status {
+	status := Status{Units: len(coordinator.units), Reissued: coordinator.reissued}
+	now := coordinator.now()
+	for _, unit := range coordinator.units {
+		switch {
+		case unit.state == unitDone:
+			status.Done++
+		case unit.state == unitLeased && now.Before(unit.deadline):
+			status.Leased++
+		default:
+			status.Pending++
+		}
+	}
+	return status
+}
+
+// Closed when every unit is done
+func (coordinator *Coordinator) Done() <-chan struct{} {
+	return coordinator.done
+}
+
+// Returns the film of the frame assembled so far
+func (coordinator *Coordinator) FilmFile() *models.FilmFile {
+	coordinator.mu.Lock()
+	defer coordinator.mu.Unlock()
+
+	return &models.FilmFile{
+		ContentHash: coordinator.contentHash,
+		Pass:        coordinator.job.Pass,
+		LUT:         coordinator.lut,
+		Film:        coordinator.film,
+	}
+}
+
+func (coordinator *Coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == LeasePath && r.Method == http.MethodPost:
+		coordinator.serveLease(w, r)
+	case strings.HasPrefix(r.URL.Path, ScenePath) && r.Method == http.MethodGet:
+		coordinator.serveScene(w, r)
+	case strings.HasPrefix(r.URL.Path, ResultPath) && r.Method == http.MethodPost:
+		coordinator.serveResult(w, r)
+	case r.URL.Path == StatusPath && r.Method == http.MethodGet:
+		writeJSON(w, coordinator.Status())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Responds with a lease, 204 when there is no work right now
+// and 410 when the job is done
+func (coordinator *Coordinator) serveLease(w http.ResponseWriter, r *http.Request) {
+	request := LeaseRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case <-coordinator.done:
+		w.WriteHeader(http.StatusGone)
+		return
+	default:
+	}
+
+	lease := coordinator.Lease(request.WorkerID)
+	if lease == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, lease)
+}
+
+func (coordinator *Coordinator) serveScene(w http.ResponseWriter, r *http.Request) {
+	if strings.TrimPrefix(r.URL.Path, ScenePath) != coordinator.sceneHash {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(coordinator.scene)
+}
+
+func (coordinator *Coordinator) serveResult(w http.ResponseWriter, r *http.Request) {
+	leaseID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, ResultPath))
+	if err != nil {
+		http.Error(w, "invalid lease id", http.StatusBadRequest)
+		return
+	}
+
+	result, err := models.ReadFilmFile(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := coordinator.Complete(leaseID, result); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrLeaseDone) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,209 @@
+package distributed
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http/httptest"
+	"raytracer/models"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+const testObj = `o Floor
+v -5 -1 -5
+v 5 -1 -5
+v 5 -1 5
+v -5 -1 5
+g Floor
+usemtl White
+f 1 2 3
+f 1 3 4
+o Light
+v -1 4 -1
+v 1 4 -1
+v 1 4 1
+v -1 4 1
+g Light
+usemtl Light
+f 5 8 7
+f 5 7 6
+`
+
+const testMtl = `newmtl White
+Kd 0.8 0.8 0.8
+Ka 1 1 1
+Ks 0 0 0
+Ni 1
+d 1
+illum 2
+
+newmtl Light
+Kd 1 1 1
+Ka 1 1 1
+Ks 0 0 0
+Ni 1
+d 1
+illum 2
+`
+
+func testJob() *Job {
+	pass := models.RenderPass{
+		TotalWidth:  20,
+		TotalHeight: 12,
+		RNGSeed:     7,
+		Camera: models.Camera{
+			Transform:               mgl32.Translate3D(0, 0, 5),
+			ProjectionPlaneDistance: 1,
+			FieldOfView:             60,
+			RaysPerPixel:            4,
+		},
+		Settings: models.RenderSettings{BounceLimit: 1, LightSampleRays: 1, LightIntensity: 10},
+	}
+	return &Job{
+		Scene:        SceneData{Obj: testObj, Mtl: testMtl},
+		Pass:         pass,
+		TileSize:     8,
+		SampleSplits: 2,
+	}
+}
+
+func TestLoopbackWorkers(t *testing.T) {
+	coordinator, err := NewCoordinator(testJob())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(coordinator)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		worker := NewWorker(string(rune('a'+i)), server.URL)
+		worker.PollInterval = 10 * time.Millisecond
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- worker.Run(ctx)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-coordinator.Done():
+	default:
+		t.Fatalf("Job should be done, status %+v", coordinator.Status())
+	}
+
+	film := coordinator.FilmFile().Film
+	for i, n := range film.Samples {
+		if n != 4 {
+			t.Fatalf("Pixel %d should have the samples of every range, got %d", i, n)
+		}
+	}
+}
+
+func TestLeaseTimeout(t *testing.T) {
+	job := testJob()
+	job.TileSize = 32
+	job.SampleSplits = 1
+	coordinator, err := NewCoordinator(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	coordinator.now = func() time.Time { return now }
+
+	first := coordinator.Lease("a")
+	if first == nil || coordinator.Lease("b") != nil {
+		t.Fatal("The single unit should be leased once")
+	}
+
+	// Timed out lease is issued to another worker
+	now = now.Add(job.LeaseTimeout + time.Second)
+	second := coordinator.Lease("b")
+	if second == nil || second.ID == first.ID {
+		t.Fatal("Timed out lease should be issued again")
+	}
+	if coordinator.Status().Reissued != 1 {
+		t.Errorf("Reissued count should be 1, got %d", coordinator.Status().Reissued)
+	}
+
+	// A result of another scene does not decide what the others must match
+	film := models.NewFilm(job.Pass.TotalWidth, job.Pass.TotalHeight, models.NewFilter(models.BoxFilter, 0))
+	if err := coordinator.Complete(first.ID, &models.FilmFile{ContentHash: "other", Film: film}); !errors.Is(err, models.ErrFilmMismatch) {
+		t.Errorf("Result of another scene should be refused, got %v", err)
+	}
+	hash := coordinator.contentHash
+	if err := coordinator.Complete(second.ID, &models.FilmFile{ContentHash: hash, Film: film}); err != nil {
+		t.Fatal(err)
+	}
+	if err := coordinator.Complete(first.ID, &models.FilmFile{ContentHash: hash, Film: film}); !errors.Is(err, ErrLeaseDone) {
+		t.Errorf("Late result of a completed unit should be refused, got %v", err)
+	}
+
+	select {
+	case <-coordinator.Done():
+	default:
+		t.Error("Job should be done")
+	}
+}
+
+func TestLeaseRandomNumbers(t *testing.T) {
+	job := testJob()
+	job.TileSize = 32
+	// Below the floor, so that the first hits depend on the samples
+	job.Pass.Camera.Transform = mgl32.Translate3D(0, -3, 5)
+	coordinator, err := NewCoordinator(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(coordinator)
+	defer server.Close()
+
+	// Sample ranges of the same tile
+	first := coordinator.Lease("a")
+	second := coordinator.Lease("a")
+	if first == nil || second == nil || first.Pass.XOffset != second.Pass.XOffset {
+		t.Fatal("Expected two leases of the tile")
+	}
+
+	// Renders do not reseed the global source
+	rand.Seed(42)
+	expected := rand.New(rand.NewSource(42)).Int63()
+	worker := NewWorker("a", server.URL)
+	render := func(lease *Lease) *models.Film {
+		t.Helper()
+		result, err := worker.Render(context.Background(), lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result.Film
+	}
+	film := render(first)
+	if rand.Int63() != expected {
+		t.Errorf("Render used the global random numbers")
+	}
+
+	// A lease takes the same samples when rendered again, other
+	// sample ranges take different ones
+	if again := render(first); !reflect.DeepEqual(again, film) {
+		t.Errorf("Rendering the lease again took other samples")
+	}
+	if other := render(second); reflect.DeepEqual(other.Depth, film.Depth) {
+		t.Errorf("Sample ranges of the tile took the same samples")
+	}
+}
@@ -0,0 +1,42 @@
+package distributed
+
+import (
+	"raytracer/models"
+	"time"
+)
+
+// HTTP endpoints of the coordinator. Control messages are JSON,
+// rendered films are posted as film files
+const (
+	LeasePath  = "/lease"
+	ScenePath  = "/scene/"
+	ResultPath = "/result/"
+	StatusPath = "/status"
+)
+
+// Request for work sent by a worker
+type LeaseRequest struct {
+	WorkerID string
+}
+
+// Lease of a work unit: a tile of the frame rendered with a range of
+// samples. The pass holds the tile region, the number of samples as
+// Camera.RaysPerPixel and a seed distinct from the other sample ranges
+type Lease struct {
+	ID        int
+	SceneHash string
+	Pass      models.RenderPass
+
+	Deadline time.Time
+}
+
+// Progress of the job
+type Status struct {
+	Units   int
+	Pending int
+	Leased  int
+	Done    int
+
+	// Leases that timed out and were issued again
+	Reissued int
+}
@@ -0,0 +1,116 @@
+package distributed
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"raytracer/models"
+)
+
+// Input files of a scene, as sent to the workers by the frontend
+type SceneData struct {
+	// Render context JSON without the buffers
+	Context  json.RawMessage
+	Obj      string
+	Mtl      string
+	LUT      string
+	Textures map[string][]byte
+}
+
+// Hash of the scene inputs, used by the workers to cache
+// the initialized scene and BVH
+func (scene *SceneData) Hash() (string, error) {
+	raw, err := json.Marshal(scene)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Initializes the render context of the scene and builds the BVH. With a
+// cache directory the BVH is loaded from a file named by the mesh hash
+// when one exists, otherwise the built BVH is stored there
+func LoadScene(scene *SceneData, bvhCache string) (*models.RenderContext, error) {
+	context := &models.RenderContext{}
+	if len(scene.Context) > 0 {
+		if err := json.Unmarshal(scene.Context, context); err != nil {
+			return nil, err
+		}
+	}
+	context.ObjBuffer = scene.Obj
+	context.MtlBuffer = scene.Mtl
+	context.LUTBuffer = scene.LUT
+
+	rawTextureData := make([]*[]byte, 0, len(context.RawTextures))
+	for _, texture := range context.RawTextures {
+		raw, found := scene.Textures[texture.Name]
+		if !found {
+			return nil, fmt.Errorf("missing texture %s", texture.Name)
+		}
+		rawTextureData = append(rawTextureData, &raw)
+	}
+
+	if err := context.Initialize(rawTextureData); err != nil {
+		return nil, err
+	}
+
+	if bvhCache == "" {
+		context.BuildBVH()
+		return context, nil
+	}
+
+	meshHash := context.MeshHash()
+	path := filepath.Join(bvhCache, hex.EncodeToString(meshHash[:])+".bvh")
+	if err := loadCachedBVH(context, path); err == nil {
+		return context, nil
+	}
+	if err := writeCachedBVH(context.BuildBVH(), path); err != nil {
+		return nil, err
+	}
+
+	return context, nil
+}
+
+func loadCachedBVH(context *models.RenderContext, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	bvh, err := models.ReadBVHFile(file, info.Size())
+	if err != nil {
+		return err
+	}
+	return context.LoadBVH(bvh)
+}
+
+// Writes to a temporary file first so that concurrent renders
+// never read a partially written BVH
+func writeCachedBVH(bvh *models.BVH, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if err := models.WriteBVHFile(file, bvh); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
@@ -0,0 +1,193 @@
+package distributed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"raytracer/models"
+	"raytracer/process"
+	"strconv"
+	"time"
+)
+
+const defaultPollInterval = 500 * time.Millisecond
+
+// Renders leases of a coordinator. Initialized scenes with their BVH
+// are cached by the scene hash, so consecutive leases of a job and
+// repeated jobs of the same scene load the scene only once
+type Worker struct {
+	ID          string
+	Coordinator string
+	Client      *http.Client
+
+	// Wait between lease requests while the coordinator has no work
+	PollInterval time.Duration
+	// Directory of cached BVH files, optional
+	BVHCache string
+
+	scenes map[string]*models.RenderContext
+}
+
+func NewWorker(id string, coordinator string) *Worker {
+	return &Worker{
+		ID:           id,
+		Coordinator:  coordinator,
+		Client:       http.DefaultClient,
+		PollInterval: defaultPollInterval,
+		scenes:       make(map[string]*models.RenderContext),
+	}
+}
+
+// Renders leases until the job is done or the context is cancelled
+func (worker *Worker) Run(ctx context.Context) error {
+	for {
+		lease, done, err := worker.requestLease(ctx)
+		if err != nil || done {
+			return err
+		}
+
+		if lease == nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(worker.PollInterval):
+			}
+			continue
+		}
+
+		result, err := worker.Render(ctx, lease)
+		if err != nil {
+			return err
+		}
+		if err := worker.postResult(ctx, lease, result); err != nil {
+			return err
+		}
+	}
+}
+
+// Renders the tile and sample range of a lease
+func (worker *Worker) Render(ctx context.Context, lease *Lease) (*models.FilmFile, error) {
+	scene, err := worker.scene(ctx, lease.SceneHash)
+	if err != nil {
+		return nil, err
+	}
+	// Statistics are per lease
+	scene.Rays = 0
+
+	pass := lease.Pass
+	pass.SetRandom(rand.New(rand.NewSource(pass.RNGSeed)))
+	pass.Initialize(scene)
+	pass.Camera.Initialize(pass.TotalWidth, pass.TotalHeight)
+
+	// The seed of the lease is distinct from the other sample ranges of the
+	// tile, so the scrambled sample sequences do not repeat their samples
+	process.SeedSamples(scene, &pass)
+
+	scene.Cancelled = func() bool { return ctx.Err() != nil }
+	film := models.NewFilm(pass.Width, pass.Height, models.NewFilter(pass.Settings.Filter, pass.Settings.FilterRadius))
+	if process.RenderFilm(scene, &pass, film, func(float32) {}) == process.StopCancelled {
+		return nil, ctx.Err()
+	}
+
+	return &models.FilmFile{
+		ContentHash: scene.ContentHash(),
+		Pass:        pass,
+		LUT:         scene.LUT,
+		Film:        film,
+	}, nil
+}
+
+// Returns the cached scene or loads it from the coordinator
+func (worker *Worker) scene(ctx context.Context, hash string) (*models.RenderContext, error) {
+	if scene, found := worker.scenes[hash]; found {
+		return scene, nil
+	}
+
+	response, err := worker.do(ctx, http.MethodGet, ScenePath+hash, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, responseError(response)
+	}
+
+	data := &SceneData{}
+	if err := json.NewDecoder(response.Body).Decode(data); err != nil {
+		return nil, err
+	}
+	scene, err := LoadScene(data, worker.BVHCache)
+	if err != nil {
+		return nil, err
+	}
+
+	worker.scenes[hash] = scene
+	return scene, nil
+}
+
+// Returns a lease, nil if there is no work right now,
+// or done when the job is finished
+func (worker *Worker) requestLease(ctx context.Context) (*Lease, bool, error) {
+	body, err := json.Marshal(LeaseRequest{WorkerID: worker.ID})
+	if err != nil {
+		return nil, false, err
+	}
+
+	response, err := worker.do(ctx, http.MethodPost, LeasePath, body)
+	if err != nil {
+		return nil, false, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		lease := &Lease{}
+		err := json.NewDecoder(response.Body).Decode(lease)
+		return lease, false, err
+	case http.StatusNoContent:
+		return nil, false, nil
+	case http.StatusGone:
+		return nil, true, nil
+	default:
+		return nil, false, responseError(response)
+	}
+}
+
+func (worker *Worker) postResult(ctx context.Context, lease *Lease, result *models.FilmFile) error {
+	var buffer bytes.Buffer
+	if err := models.WriteFilmFile(&buffer, result); err != nil {
+		return err
+	}
+
+	response, err := worker.do(ctx, http.MethodPost, ResultPath+strconv.Itoa(lease.ID), buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	// The unit was completed by another worker after the lease timed out
+	if response.StatusCode == http.StatusConflict {
+		return nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return responseError(response)
+	}
+	return nil
+}
+
+func (worker *Worker) do(ctx context.Context, method string, path string, body []byte) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, worker.Coordinator+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return worker.Client.Do(request)
+}
+
+func responseError(response *http.Response) error {
+	message, _ := ioutil.ReadAll(response.Body)
+	return fmt.Errorf("coordinator responded %s: %s", response.Status, bytes.TrimSpace(message))
+}
@@ -86,8 +86,8 @@ func TestRayAABBDistance(t *testing.T) {
 func BenchmarkRayAABB(b *testing.B) {
 	aabb := NewAABBParametric(mgl32.Vec3{0, 0, 0}, 1.0, 1.0, 1.0)
 	// Create a random ray
-	origin := utility.RandomInUnitSphere().Normalize()
-	direction := utility.RandomInUnitSphere().Normalize()
+	origin := utility.RandomInUnitSphere(nil).Normalize()
+	direction := utility.RandomInUnitSphere(nil).Normalize()
 	ray := NewRay(origin, direction, 0, 0, 0)
 	b.ResetTimer()
 
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"math"
+	"raytracer/utility"
+
 	"github.com/go-gl/mathgl/mgl32"
 	"gonum.org/v1/gonum/mat"
 	"gonum.org/v1/gonum/stat/distmv"
@@ -19,6 +22,54 @@ type AreaLight struct {
 	maxSamples int
 }
 
+// Returns the transform, size and normal of the area light covering the
+// triangles of the "Light" material, in world space at the given time of
+// the frame interval. Found is false if the scene has no light triangles
+func (context *RenderContext) lightGeometry(time float32) (transform mgl32.Mat4, size mgl32.Vec2, normal mgl32.Vec3, found bool) {
+	min := mgl32.Vec3{math.MaxFloat32, math.MaxFloat32, math.MaxFloat32}
+	max := mgl32.Vec3{-math.MaxFloat32, -math.MaxFloat32, -math.MaxFloat32}
+	var up mgl32.Vec3
+	var shortestSide mgl32.Vec3
+	var middleSide mgl32.Vec3
+
+	context.movingLight = false
+	for _, triangle := range context.Triangles {
+		if triangle.Material.Name != "Light" {
+			continue
+		}
+		found = true
+		if triangle.Motion != nil {
+			context.movingLight = true
+			triangle = triangle.worldAt(time)
+		}
+
+		normal = triangle.Normal
+		// Choose the edge to cross normal with to find up
+		// as the edge that is shortest. Up will then
+		// point from the middle of the arealight towards
+		// the long axis
+		shortestSide = triangle.GetShortestEdge()
+		middleSide = triangle.GetMiddleEdge()
+		up = shortestSide.Cross(triangle.Normal).Normalize()
+		for _, vertex := range triangle.Vertices {
+			min = utility.Vec3Min(min, vertex)
+			max = utility.Vec3Max(max, vertex)
+		}
+	}
+	if !found {
+		return transform, size, normal, false
+	}
+
+	center := min.Add(max).Mul(0.5)
+
+	//transform := mgl32.LookAtV(normal, center, up).Inv()
+	transform = mgl32.Translate3D(center.X(), center.Y(), center.Z())
+	transform = transform.Mul4(mgl32.Mat3FromCols(normal.Cross(up), up, normal).Mat4())
+
+	size = mgl32.Vec2{shortestSide.Len() / 2.0, middleSide.Len() / 2.0}
+	return transform, size, normal, true
+}
+
 func NewAreaLight(transform mgl32.Mat4, size mgl32.Vec2, emission mgl32.Vec3, normal mgl32.Vec3) *AreaLight {
 	light := &AreaLight{
 		Transform:  transform,
@@ -54,3 +105,20 @@ func (light *AreaLight) Sample() (mgl32.Vec3, float32) {
 
 	return worldSample, pdf
 }
+
+// Position in the light sample sequence, stored in checkpoints
+func (light *AreaLight) SampleIndex() int {
+	return light.index
+}
+
+func (light *AreaLight) SetSampleIndex(index int) {
+	light.index = index % light.maxSamples
+}
+
+// Restarts the light samples from a sequence scrambled by the seed
+func (light *AreaLight) SetSampleSeed(seed int64) {
+	light.sampler.Src = newSampleSource(seed)
+	light.batch.Zero()
+	light.sampler.Sample(light.batch)
+	light.index = 0
+}
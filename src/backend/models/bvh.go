@@ -1,6 +1,8 @@
 package models
 
 import (
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"math"
 	"raytracer/utility"
@@ -11,12 +13,35 @@ import (
 // Bounding volume hierarchy for accelerated
 // ray hit detection
 type BVH struct {
-	Root *BVHNode
+	// Depth-first linearized nodes
+	Nodes []LinearBVHNode
+	// Wide nodes collapsed from the binary nodes, traversed instead
+	// of them if either is set. Not stored in BVH files
+	Wide4 []WideBVHNode4
+	Wide8 []WideBVHNode8
+
+	// Scene triangle index of each triangle in the BVH order, scene
+	// triangles split by the spatial builder appear more than once.
+	// The mesh hash of the scene the BVH was built for
+	Permutation []int32
+	MeshHash    [sha256.Size]byte
+
+	// Objects of a two-level BVH, the leaves of the nodes hold objects
+	// instead of triangles. Meshes holds the BVHs of the instanced
+	// meshes in the order of the context meshes
+	Objects []*BVHObject
+	Meshes  []*BVH
+
+	// SAH cost when the BVH was built, refits rebuild the BVH when
+	// its cost grows too far above it
+	BuildCost float32
+
+	width int
 }
 
+// Node of the BVH while it is being built
 type BVHNode struct {
 	Depth      int
-	Index      int
 	LeftChild  *BVHNode
 	RightChild *BVHNode
 	Bounds     *AABB
@@ -24,126 +49,175 @@ type BVHNode struct {
 	// Leaf nodes will contain references to all triangles within the node
 	StartIndex int
 	EndIndex   int
+	// References of the spatial builder leaves until they are laid out
+	references []bvhReference
 
 	SplitPlane mgl32.Vec4
 }
 
+var ErrBVHMismatch = errors.New("BVH does not match the scene triangles")
+
+// Builds the BVH of the scene and sets it as the BVH of the context.
+// The triangles of the context are reordered to the BVH order, or
+// replaced by the references of the spatial builder
 func BuildBVH(context *RenderContext) *BVH {
-	bvh := &BVH{}
-	index := 0
-	root := buildBVHNode(context, context.Triangles, 0, len(context.Triangles)-1, 0, &index)
-	fmt.Printf("BVH has %d nodes\n", index)
-	bvh.Root = root
+	context.Triangles = context.sceneTriangles()
+	for i, mesh := range context.Meshes {
+		mesh.Triangles = context.sceneMeshTriangles(i)
+	}
+	context.BVH = nil
+	context.moved = nil
+	context.instancesMoved = false
+	context.BVHNodeTriangles, context.BVHProgressReported = 0, 0
+	meshHash := context.MeshHash()
+
+	var bvh *BVH
+	if len(context.Instances) > 0 || (context.BVHTwoLevel && len(context.Groups) > 0) {
+		bvh, context.Triangles = buildTwoLevelBVH(context, context.Triangles)
+	} else {
+		bvh, context.Triangles = buildBVH(context, context.Triangles)
+	}
+	bvh.MeshHash = meshHash
+	bvh.BuildCost = bvh.SAHCost()
+	fmt.Printf("BVH has %d nodes\n", bvh.nodeCount())
+	if len(context.Instances) > 0 {
+		fmt.Printf("%d instances render %d triangles of %d meshes\n", len(context.Instances), context.InstancedTriangles(), len(context.Meshes))
+	}
+	bvh.Widen(context.BVHWidth)
+
+	context.BVH = bvh
 	return bvh
 }
 
-func (bvh *BVH) Load(triangles []*Triangle) {
-	bvh.Root.load(triangles)
+// Builds a single-level BVH over the triangles, which may be reordered.
+// Returns the BVH and its triangles in the BVH order
+func buildBVH(context *RenderContext, triangles []*Triangle) (*BVH, []*Triangle) {
+	bvh := &BVH{}
+	build := newBVHBuild(context, triangles)
+
+	var root *BVHNode
+	if context.BVHBuilder == SpatialBVHBuilder {
+		root, bvh.Permutation = build.spatialTree()
+		ordered := make([]*Triangle, len(bvh.Permutation))
+		for i, index := range bvh.Permutation {
+			ordered[i] = triangles[index]
+		}
+		triangles = ordered
+	} else {
+		positions := make(map[*Triangle]int32, len(triangles))
+		for i, triangle := range triangles {
+			positions[triangle] = int32(i)
+		}
+
+		root = build.node(0, len(triangles)-1, 0)
+
+		bvh.Permutation = make([]int32, len(triangles))
+		for i, triangle := range triangles {
+			bvh.Permutation[i] = positions[triangle]
+		}
+	}
+	root.flatten(bvh)
+
+	return bvh, triangles
 }
 
-func (node *BVHNode) load(triangles []*Triangle) {
-	// Sorts the triangles according to the loaded BVH
-	// Only for non-leaf nodes - there is no need to sort leaf nodes
-	if node.LeftChild != nil {
-		splitPlaneVec3 := node.SplitPlane.Vec3()
-		TriangleSorter(splitPlaneVec3, triangles, node.StartIndex, node.EndIndex)
+// Checks that the nodes cover the given number of triangles, with the
+// children of every node splitting the triangle range of the node
+func (bvh *BVH) Validate(triangleCount int) error {
+	if bvh.Objects != nil {
+		return bvh.validateObjects(triangleCount)
+	}
+	if len(bvh.Nodes) == 0 {
+		return fmt.Errorf("BVH has no nodes: %w", ErrBVHMismatch)
+	}
+	next, err := validateLinearNode(bvh.Nodes, 0, len(bvh.Nodes), 0)
+	if err != nil {
+		return err
+	}
+	if next != triangleCount {
+		return fmt.Errorf("BVH covers %d of %d triangles: %w", next, triangleCount, ErrBVHMismatch)
+	}
+	return nil
+}
 
-		node.LeftChild.load(triangles)
-		node.RightChild.load(triangles)
+// Checks the subtree of the node at index, which spans the nodes up to end
+// and starts at the triangle next. Returns the triangle after the subtree
+func validateLinearNode(nodes []LinearBVHNode, index int, end int, next int) (int, error) {
+	node := &nodes[index]
+	if node.IsLeaf() {
+		if index+1 != end || int(node.Offset) != next {
+			return 0, fmt.Errorf("BVH leaf %d is out of order: %w", index, ErrBVHMismatch)
+		}
+		return next + node.Count(), nil
 	}
+
+	second := int(node.Offset)
+	if second <= index+1 || second >= end {
+		return 0, fmt.Errorf("BVH node %d has invalid children: %w", index, ErrBVHMismatch)
+	}
+	next, err := validateLinearNode(nodes, index+1, second, next)
+	if err != nil {
+		return 0, err
+	}
+	return validateLinearNode(nodes, second, end, next)
 }
 
-func buildBVHNode(context *RenderContext, triangles []*Triangle, startIndex int, endIndex int, depth int, index *int) *BVHNode {
-	// Takes the given slice of triangles, sorts them along the major axis
-	// and splits into children until leaf nodes contain the wanted number of triangles
+func (build *bvhBuild) node(startIndex int, endIndex int, depth int) *BVHNode {
+	// Takes the given range of triangles, partitions them with the surface area
+	// heuristic and splits into children until splitting no longer pays off
 	node := &BVHNode{
 		Depth:      depth,
-		Index:      *index,
 		StartIndex: startIndex,
 		EndIndex:   endIndex,
 	}
 
-	// Increment node index
-	*index = *index + 1
-
 	// Calculate bounds for the node
-	min, max := GetTriangleBounds(triangles[startIndex : endIndex+1])
-	node.Bounds = NewAABBMinMax(min, max)
-
-	triCount := endIndex - startIndex + 1
-
-	// Split if there are too many child triangles
-	if context.UseBVH && triCount > context.BVHMaxLeafSize && depth < context.BVHMaxDepth {
-		splitPlane := GetSplitPlaneSAH(triangles, node)
-		splitPlaneVec3 := splitPlane.Vec3()
-
-		node.SplitPlane = splitPlane
-
-		TriangleSorter(splitPlaneVec3, triangles, startIndex, endIndex)
-
-		splitIndex := startIndex
-		splitSideSoFar := splitPlaneVec3.Dot(triangles[startIndex].Center()) > splitPlane.W()
-		for i := startIndex + 1; i < endIndex; i++ { // Exclude ends
-			if splitPlaneVec3.Dot(triangles[i].Center()) > splitPlane.W() != splitSideSoFar {
-				splitIndex = i
-				break
-			}
-		}
+	bounds, centers := build.bounds(startIndex, endIndex)
+	node.Bounds = NewAABBMinMax(bounds.Min, bounds.Max)
 
-		// Fix possible errors in splitindex calc
-		if splitIndex == startIndex || splitIndex == endIndex {
-			splitIndex = startIndex + (endIndex-startIndex)/2
-			//println("Split index is at the edge, moving to center")
-		}
+	splitIndex := -1
+	if build.context.UseBVH && depth < build.context.BVHMaxDepth {
+		splitIndex = build.split(node, centers)
+	}
 
-		node.LeftChild = buildBVHNode(context, triangles, startIndex, splitIndex-1, depth+1, index)
-		node.RightChild = buildBVHNode(context, triangles, splitIndex, endIndex, depth+1, index)
+	if splitIndex != -1 {
+		build.children(node, splitIndex)
 	} else {
-		// Add tricount to tracking
-		context.BVHNodeTriangles += uint64(triCount)
-
-		interval := uint64(len(context.Triangles) / 10.0)
-		if context.BVHNodeTriangles > context.BVHProgressReported+interval {
-			context.BVHProgressReported = context.BVHNodeTriangles
-			progress := float32(context.BVHNodeTriangles) / float32(len(context.Triangles))
-			utility.ProgressUpdate(progress, "RenderContext.BuildBVH", -1, 0)
-		}
+		build.leafDone(endIndex - startIndex + 1)
 	}
 
 	return node
 }
 
-// Returns the leaf node or nil if ray did not hit the volume
-func (node *BVHNode) WalkNode(triangles []*Triangle, ray *Ray, tmin *float32, umin *float32, vmin *float32, tri **Triangle) {
-
-	if node.LeftChild == nil {
-		for _, triangle := range triangles[node.StartIndex : node.EndIndex+1] {
-			if triangle.Normal.Dot(ray.Direction) > 0 {
-				continue
-			}
-			t, u, v := triangle.RayIntersect(ray)
-			if t > 0 && t < *tmin {
-				*tmin = t
-				*umin = u
-				*vmin = v
-				*tri = triangle
-			}
-		}
-	} else {
-		leftHit, leftTMin, leftTMax := node.LeftChild.Bounds.RayIntersect(ray)
-		if leftHit && leftTMin < *tmin && leftTMax > 0 {
-			node.LeftChild.WalkNode(triangles, ray, tmin, umin, vmin, tri)
+// Sorts the node triangles along the split plane of the node and
+// returns the index of the first triangle on the far side of the plane
+func sortSplit(triangles []*Triangle, node *BVHNode) int {
+	splitPlane := node.SplitPlane
+	splitPlaneVec3 := splitPlane.Vec3()
+	startIndex, endIndex := node.StartIndex, node.EndIndex
+
+	TriangleSorter(splitPlaneVec3, triangles, startIndex, endIndex)
+
+	splitIndex := startIndex
+	splitSideSoFar := splitPlaneVec3.Dot(triangles[startIndex].Center()) > splitPlane.W()
+	for i := startIndex + 1; i <= endIndex; i++ {
+		if splitPlaneVec3.Dot(triangles[i].Center()) > splitPlane.W() != splitSideSoFar {
+			splitIndex = i
+			break
 		}
+	}
 
-		rightHit, rightTMin, rightTMax := node.RightChild.Bounds.RayIntersect(ray)
-		if rightHit && rightTMin < *tmin && rightTMax > 0 {
-			node.RightChild.WalkNode(triangles, ray, tmin, umin, vmin, tri)
-		}
+	// Fix possible errors in splitindex calc
+	if splitIndex == startIndex {
+		splitIndex = startIndex + (endIndex-startIndex+1)/2
 	}
 
+	return splitIndex
 }
 
-func GetSplitPlaneSAH(triangles []*Triangle, node *BVHNode) mgl32.Vec4 {
+// Exact surface area heuristic sweep, the "high quality" builder. Returns
+// the split plane and its cost relative to intersecting a triangle
+func GetSplitPlaneSAH(triangles []*Triangle, node *BVHNode) (mgl32.Vec4, float32) {
 	// Surface area heuristic - find a split plane that minimizes the
 	// surface area of the splitted AABBs
 
@@ -183,13 +257,13 @@ func GetSplitPlaneSAH(triangles []*Triangle, node *BVHNode) mgl32.Vec4 {
 			rightAABBSizes[i-node.StartIndex] = rightAABB.Area()
 		}
 
-		// Go throught every possible split along the axis to find the most optimal
-		// Exclude both ends - no point in splitting 0-all
-		for i := node.StartIndex + 1; i < node.EndIndex; i++ {
+		// Go throught every possible split along the axis to find the most optimal,
+		// triangles up to i go to the left
+		for i := node.StartIndex; i < node.EndIndex; i++ {
 			leftArea := leftAABBSizes[i-node.StartIndex]
 			rightArea := rightAABBSizes[i-node.StartIndex+1]
 
-			cost := leftArea*float32(i-node.StartIndex) + rightArea*float32(node.EndIndex-i+1)
+			cost := leftArea*float32(i-node.StartIndex+1) + rightArea*float32(node.EndIndex-i)
 			if cost < float32(lowestCost) {
 				lowestCost = cost
 				var w float32
@@ -208,5 +282,5 @@ func GetSplitPlaneSAH(triangles []*Triangle, node *BVHNode) mgl32.Vec4 {
 		}
 	}
 
-	return splitPlane
+	return splitPlane, splitCost(lowestCost, node.Bounds.Area())
 }
@@ -0,0 +1,646 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/udhos/gwob"
+)
+
+// Small triangles scattered over clusters, like the objects of a scene
+func randomTriangles(count int) []*Triangle {
+	rng := rand.New(rand.NewSource(1))
+	vertex := func(center mgl32.Vec3, size float32) mgl32.Vec3 {
+		return center.Add(mgl32.Vec3{rng.Float32() - 0.5, rng.Float32() - 0.5, rng.Float32() - 0.5}.Mul(size))
+	}
+
+	clusters := make([]mgl32.Vec3, 8)
+	for i := range clusters {
+		clusters[i] = vertex(mgl32.Vec3{}, 100)
+	}
+
+	triangles := make([]*Triangle, count)
+	for i := range triangles {
+		center := vertex(clusters[i%len(clusters)], 20)
+		triangles[i] = NewTriangle(vertex(center, 3), vertex(center, 3), vertex(center, 3), &gwob.Material{}, i)
+	}
+	return triangles
+}
+
+func bvhContext(triangles []*Triangle, builder BVHBuilder) *RenderContext {
+	return &RenderContext{
+		Triangles:      append([]*Triangle{}, triangles...),
+		UseBVH:         true,
+		BVHMaxLeafSize: 4,
+		BVHMaxDepth:    32,
+		BVHBuilder:     builder,
+	}
+}
+
+// Checks that the triangles of every leaf are within its bounds
+func checkLeafBounds(t *testing.T, bvh *BVH, triangles []*Triangle) {
+	t.Helper()
+	for i, node := range bvh.Nodes {
+		if !node.IsLeaf() {
+			continue
+		}
+		for _, triangle := range triangles[node.Offset : int(node.Offset)+node.Count()] {
+			min, max := triangle.Min(), triangle.Max()
+			for axis := 0; axis < 3; axis++ {
+				if min[axis] < node.Bounds[0][axis] || max[axis] > node.Bounds[1][axis] {
+					t.Fatalf("Triangle %d is outside the bounds of leaf %d", triangle.Index, i)
+				}
+			}
+		}
+	}
+}
+
+func TestBVHBuilders(t *testing.T) {
+	triangles := randomTriangles(2000)
+	costs := map[BVHBuilder]float32{}
+
+	for _, builder := range []BVHBuilder{BinnedBVHBuilder, ExactBVHBuilder} {
+		context := bvhContext(triangles, builder)
+		bvh := BuildBVH(context)
+		if err := bvh.Validate(len(triangles)); err != nil {
+			t.Fatalf("Builder %d: %v", builder, err)
+		}
+		checkLeafBounds(t, bvh, context.Triangles)
+		costs[builder] = bvh.SAHCost()
+	}
+
+	if costs[BinnedBVHBuilder] > costs[ExactBVHBuilder]*1.2 {
+		t.Errorf("Binned BVH cost %v is far above the exact cost %v", costs[BinnedBVHBuilder], costs[ExactBVHBuilder])
+	}
+}
+
+func TestBVHFile(t *testing.T) {
+	triangles := randomTriangles(2000)
+	built := bvhContext(triangles, BinnedBVHBuilder)
+	BuildBVH(built)
+
+	var buffer bytes.Buffer
+	if err := WriteBVHFile(&buffer, built.BVH); err != nil {
+		t.Fatal(err)
+	}
+	raw := buffer.Bytes()
+
+	// Workers load the BVH into triangles in the scene order
+	bvh, err := ReadBVHFile(bytes.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := bvhContext(triangles, BinnedBVHBuilder)
+	if err := loaded.LoadBVH(bvh); err != nil {
+		t.Fatal(err)
+	}
+	checkLeafBounds(t, loaded.BVH, loaded.Triangles)
+	if loaded.ContentHash() != built.ContentHash() {
+		t.Errorf("Loaded BVH content hash differs from the built one")
+	}
+
+	// Loading again starts from the scene order
+	if err := loaded.LoadBVH(bvh); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := bvhContext(triangles, BinnedBVHBuilder)
+	settings.BVHMaxLeafSize = 8
+	if err := settings.LoadBVH(bvh); !errors.Is(err, ErrBVHMismatch) {
+		t.Errorf("BVH of other build settings should not load, got %v", err)
+	}
+
+	mesh := bvhContext(triangles[1:], BinnedBVHBuilder)
+	if err := mesh.LoadBVH(bvh); !errors.Is(err, ErrBVHMismatch) {
+		t.Errorf("BVH of another mesh should not load, got %v", err)
+	}
+
+	// Corrupted nodes fail validation
+	bvh.Nodes[0].Offset = 1
+	if err := bvhContext(triangles, BinnedBVHBuilder).LoadBVH(bvh); !errors.Is(err, ErrBVHMismatch) {
+		t.Errorf("Corrupted BVH should not load, got %v", err)
+	}
+
+	if _, err := ReadBVHFile(bytes.NewReader(raw[:len(raw)-1]), int64(len(raw)-1)); err == nil {
+		t.Errorf("Truncated BVH file should not be read")
+	}
+
+	// Counts beyond the size of the file are refused before allocating
+	huge := append([]byte{}, raw...)
+	binary.LittleEndian.PutUint32(huge[40:], 1<<30)
+	binary.LittleEndian.PutUint32(huge[44:], 1<<30)
+	if _, err := ReadBVHFile(bytes.NewReader(huge), int64(len(huge))); !errors.Is(err, ErrBVHMismatch) {
+		t.Errorf("BVH file with counts beyond its size should not be read, got %v", err)
+	}
+
+	raw[4] = 99
+	if _, err := ReadBVHFile(bytes.NewReader(raw), int64(len(raw))); err == nil {
+		t.Errorf("BVH file of another version should not be read")
+	}
+}
+
+// Long thin diagonal triangles across the clusters, like the walls
+// and floors of architectural scenes
+func sliverTriangles(count int) []*Triangle {
+	rng := rand.New(rand.NewSource(3))
+	point := func() mgl32.Vec3 {
+		return mgl32.Vec3{rng.Float32() - 0.5, rng.Float32() - 0.5, rng.Float32() - 0.5}.Mul(150)
+	}
+
+	triangles := make([]*Triangle, count)
+	for i := range triangles {
+		a, b := point(), point()
+		c := a.Add(mgl32.Vec3{rng.Float32(), rng.Float32(), rng.Float32()})
+		triangles[i] = NewTriangle(a, b, c, &gwob.Material{}, i)
+	}
+	return triangles
+}
+
+func TestSpatialBVH(t *testing.T) {
+	triangles := append(randomTriangles(2000), sliverTriangles(200)...)
+
+	binned := bvhContext(triangles, BinnedBVHBuilder)
+	BuildBVH(binned)
+	context := bvhContext(triangles, SpatialBVHBuilder)
+	bvh := BuildBVH(context)
+
+	if err := bvh.Validate(len(context.Triangles)); err != nil {
+		t.Fatal(err)
+	}
+	if len(context.Triangles) <= len(triangles) {
+		t.Errorf("Spatial splits did not duplicate any of the %d triangles", len(triangles))
+	}
+	if cost, binnedCost := bvh.SAHCost(), binned.BVH.SAHCost(); cost >= binnedCost {
+		t.Errorf("Spatial BVH cost %v is not below the binned cost %v", cost, binnedCost)
+	}
+	checkIntersect(t, context, triangles, randomRays(triangles, 500))
+
+	// A set split alpha is used even if zero, a large one prevents
+	// spatial splits
+	splits := func(alpha float32) int {
+		split := bvhContext(triangles, SpatialBVHBuilder)
+		split.BVHSplitAlpha = &alpha
+		BuildBVH(split)
+		return len(split.Triangles) - len(triangles)
+	}
+	if zero, never := splits(0), splits(1); zero < len(context.Triangles)-len(triangles) || never != 0 {
+		t.Errorf("Split alpha 0 duplicated %d triangles, 1 duplicated %d", zero, never)
+	}
+	alpha := float32(DefaultBVHSplitAlpha)
+	other := bvhContext(triangles, SpatialBVHBuilder)
+	other.BVHSplitAlpha = &alpha
+	if other.MeshHash() != context.MeshHash() {
+		t.Errorf("Default split alpha changed the mesh hash")
+	}
+
+	// The references are stored in BVH files and loaded with duplicates
+	var buffer bytes.Buffer
+	if err := WriteBVHFile(&buffer, bvh); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadBVHFile(&buffer, int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := bvhContext(triangles, SpatialBVHBuilder)
+	if err := loaded.LoadBVH(read); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ContentHash() != context.ContentHash() {
+		t.Errorf("Loaded spatial BVH content hash differs from the built one")
+	}
+	if loaded.MeshHash() != bvh.MeshHash {
+		t.Errorf("Mesh hash of the loaded spatial BVH scene changed")
+	}
+
+	// Duplicates are only valid for the spatial builder
+	if err := bvhContext(triangles, BinnedBVHBuilder).LoadBVH(read); !errors.Is(err, ErrBVHMismatch) {
+		t.Errorf("Spatial BVH should not load for the binned builder, got %v", err)
+	}
+}
+
+func TestBVHCoincidentCenters(t *testing.T) {
+	triangles := make([]*Triangle, 10)
+	for i := range triangles {
+		triangles[i] = NewTriangle(mgl32.Vec3{-1, 0, 0}, mgl32.Vec3{1, 0, 0}, mgl32.Vec3{0, 1, 0}, &gwob.Material{}, i)
+	}
+
+	context := bvhContext(triangles, BinnedBVHBuilder)
+	if err := BuildBVH(context).Validate(len(triangles)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Every thread count builds the same BVH. The root of the binned build is
+// large enough to be binned in parallel
+func TestBVHParallelBuild(t *testing.T) {
+	sizes := map[BVHBuilder]int{
+		BinnedBVHBuilder:  bvhParallelBinSize * 2,
+		ExactBVHBuilder:   bvhParallelSubtreeSize * 4,
+		SpatialBVHBuilder: bvhParallelSubtreeSize * 2,
+	}
+
+	for builder, size := range sizes {
+		triangles := randomTriangles(size)
+		var expected *BVH
+		for _, threads := range []int{1, 3, 8} {
+			context := bvhContext(triangles, builder)
+			context.BVHThreads = threads
+			bvh := BuildBVH(context)
+			if err := bvh.Validate(len(context.Triangles)); err != nil {
+				t.Fatalf("Builder %d with %d threads: %v", builder, threads, err)
+			}
+
+			if expected == nil {
+				expected = bvh
+			} else if !reflect.DeepEqual(bvh, expected) {
+				t.Errorf("Builder %d with %d threads built another BVH", builder, threads)
+			}
+		}
+	}
+}
+
+func benchmarkBuildBVH(b *testing.B, builder BVHBuilder, threads int) {
+	triangles := randomTriangles(50000)
+	var bvh *BVH
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		context := bvhContext(triangles, builder)
+		context.BVHThreads = threads
+		bvh = BuildBVH(context)
+	}
+	b.ReportMetric(float64(bvh.SAHCost()), "sah")
+}
+
+func BenchmarkBuildBVHBinned(b *testing.B) {
+	benchmarkBuildBVH(b, BinnedBVHBuilder, 1)
+}
+
+func BenchmarkBuildBVHParallel(b *testing.B) {
+	benchmarkBuildBVH(b, BinnedBVHBuilder, 0)
+}
+
+func BenchmarkBuildBVHExact(b *testing.B) {
+	benchmarkBuildBVH(b, ExactBVHBuilder, 1)
+}
+
+// Rays from random origins, every other one aimed at a triangle
+func randomRays(triangles []*Triangle, count int) []*Ray {
+	rng := rand.New(rand.NewSource(2))
+	rays := make([]*Ray, count)
+	for i := range rays {
+		origin := mgl32.Vec3{rng.Float32() - 0.5, rng.Float32() - 0.5, rng.Float32() - 0.5}.Mul(150)
+		direction := mgl32.Vec3{rng.Float32() - 0.5, rng.Float32() - 0.5, rng.Float32() - 0.5}
+		if i%2 == 0 {
+			direction = triangles[rng.Intn(len(triangles))].Center().Sub(origin)
+		}
+		rays[i] = NewRay(origin, direction.Normalize(), 0, 0, 0)
+	}
+	return rays
+}
+
+func TestLinearBVHNodeSize(t *testing.T) {
+	if size := unsafe.Sizeof(LinearBVHNode{}); size != 32 {
+		t.Errorf("Linear BVH node takes %d bytes", size)
+	}
+	if size := unsafe.Sizeof(WideBVHNode4{}); size != 132 {
+		t.Errorf("4-wide BVH node takes %d bytes", size)
+	}
+}
+
+// Checks the closest hits of the BVH against intersecting every
+// triangle facing the ray
+func checkIntersect(t *testing.T, context *RenderContext, triangles []*Triangle, rays []*Ray) {
+	t.Helper()
+	for i, ray := range rays {
+		var tmin, umin, vmin float32 = math.MaxFloat32, 0, 0
+		var tri *Triangle
+		context.BVH.Intersect(context.Triangles, ray, &tmin, &umin, &vmin, &tri)
+
+		var expected *Triangle
+		var expectedT float32 = math.MaxFloat32
+		for _, triangle := range triangles {
+			if triangle.Normal.Dot(ray.Direction) > 0 {
+				continue
+			}
+			if t, _, _ := triangle.RayIntersect(ray); t > 0 && t < expectedT {
+				expected, expectedT = triangle, t
+			}
+		}
+
+		if tri != expected || tmin != expectedT {
+			t.Fatalf("Ray %d hit %v at %v, expected %v at %v", i, tri, tmin, expected, expectedT)
+		}
+	}
+}
+
+func TestBVHIntersect(t *testing.T) {
+	triangles := randomTriangles(2000)
+	context := bvhContext(triangles, BinnedBVHBuilder)
+	BuildBVH(context)
+
+	checkIntersect(t, context, triangles, randomRays(triangles, 500))
+}
+
+// The wide BVH finds the same hits as the binary BVH it was collapsed from
+func TestWideBVH(t *testing.T) {
+	triangles := randomTriangles(5000)
+	for _, triangle := range triangles[:1000] {
+		triangle.IsLight = true
+	}
+	context := bvhContext(triangles, BinnedBVHBuilder)
+	bvh := BuildBVH(context)
+	rays := randomRays(triangles, 1000)
+
+	for _, width := range []int{4, MaxBVHWidth} {
+		binary := &BVH{Nodes: bvh.Nodes}
+		bvh.Widen(width)
+
+		// Nodes of the type of the width only
+		if (len(bvh.Wide4) > 0) != (width == 4) || (len(bvh.Wide8) > 0) != (width == MaxBVHWidth) {
+			t.Fatalf("Width %d BVH has %d 4-wide and %d 8-wide nodes", width, len(bvh.Wide4), len(bvh.Wide8))
+		}
+
+		leafTriangles := 0
+		for i := 0; i < len(bvh.Wide4)+len(bvh.Wide8); i++ {
+			node := bvh.wideNode(int32(i))
+			children := int(*node.children)
+			if children < 2 || children > width {
+				t.Fatalf("Width %d node %d has %d children", width, i, children)
+			}
+			for _, count := range node.count[:children] {
+				leafTriangles += int(count)
+			}
+		}
+		if leafTriangles != len(triangles) {
+			t.Fatalf("Width %d leaves hold %d of %d triangles", width, leafTriangles, len(triangles))
+		}
+
+		for i, ray := range rays {
+			var tmin, umin, vmin float32 = math.MaxFloat32, 0, 0
+			var tri *Triangle
+			bvh.Intersect(context.Triangles, ray, &tmin, &umin, &vmin, &tri)
+
+			var expectedT, expectedU, expectedV float32 = math.MaxFloat32, 0, 0
+			var expected *Triangle
+			binary.Intersect(context.Triangles, ray, &expectedT, &expectedU, &expectedV, &expected)
+
+			if tri != expected || tmin != expectedT || umin != expectedU || vmin != expectedV {
+				t.Fatalf("Width %d ray %d hit %v at %v, expected %v at %v", width, i, tri, tmin, expected, expectedT)
+			}
+
+			tmax := float32(50 + i%100)
+			for _, ignoreEmitters := range []bool{false, true} {
+				occluded := bvh.Occluded(context.Triangles, ray, tmax, ignoreEmitters)
+				if expected := binary.Occluded(context.Triangles, ray, tmax, ignoreEmitters); occluded != expected {
+					t.Fatalf("Width %d ray %d occluded %v, expected %v", width, i, occluded, expected)
+				}
+			}
+		}
+	}
+}
+
+func benchmarkBVHIntersect(b *testing.B, width int) {
+	context := bvhContext(randomTriangles(50000), BinnedBVHBuilder)
+	context.BVHWidth = width
+	BuildBVH(context)
+	rays := randomRays(context.Triangles, 1024)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var tmin, umin, vmin float32 = math.MaxFloat32, 0, 0
+		var tri *Triangle
+		context.BVH.Intersect(context.Triangles, rays[i%len(rays)], &tmin, &umin, &vmin, &tri)
+	}
+}
+
+func BenchmarkBVHIntersect(b *testing.B) {
+	benchmarkBVHIntersect(b, 2)
+}
+
+func BenchmarkBVHIntersectWide4(b *testing.B) {
+	benchmarkBVHIntersect(b, 4)
+}
+
+func BenchmarkBVHIntersectWide8(b *testing.B) {
+	benchmarkBVHIntersect(b, MaxBVHWidth)
+}
+
+// Triangles of randomTriangles grown three times around their centers,
+// so that they block the shadow rays between them
+func occluderTriangles(count int) []*Triangle {
+	triangles := randomTriangles(count)
+	for i, triangle := range triangles {
+		center := triangle.Center()
+		grown := func(vertex mgl32.Vec3) mgl32.Vec3 {
+			return center.Add(vertex.Sub(center).Mul(3))
+		}
+		triangles[i] = NewTriangle(grown(triangle.Vertices[0]), grown(triangle.Vertices[1]), grown(triangle.Vertices[2]), triangle.Material, i)
+	}
+	return triangles
+}
+
+func TestBVHOccluded(t *testing.T) {
+	triangles := occluderTriangles(2000)
+	for _, triangle := range triangles[:500] {
+		triangle.IsLight = true
+	}
+	context := bvhContext(triangles, BinnedBVHBuilder)
+	BuildBVH(context)
+
+	hits := 0
+	for i, ray := range randomRays(triangles, 500) {
+		tmax := float32(50 + i%100)
+		for _, ignoreEmitters := range []bool{false, true} {
+			expected := false
+			for _, triangle := range triangles {
+				if (ignoreEmitters && triangle.IsLight) || triangle.Normal.Dot(ray.Direction) > 0 {
+					continue
+				}
+				if t, _, _ := triangle.RayIntersect(ray); t > 0 && t < tmax {
+					expected = true
+					break
+				}
+			}
+
+			if occluded := context.BVH.Occluded(context.Triangles, ray, tmax, ignoreEmitters); occluded != expected {
+				t.Fatalf("Ray %d occluded %v, expected %v", i, occluded, expected)
+			}
+			if expected {
+				hits++
+			}
+		}
+	}
+	if hits == 0 {
+		t.Errorf("No ray was occluded")
+	}
+}
+
+func BenchmarkBVHOccluded(b *testing.B) {
+	context := bvhContext(occluderTriangles(50000), BinnedBVHBuilder)
+	BuildBVH(context)
+	rays := randomRays(context.Triangles, 1024)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		context.BVH.Occluded(context.Triangles, rays[i%len(rays)], math.MaxFloat32, true)
+	}
+}
+
+// Vertices of the group triangles moved by offset
+func movedVertices(triangles []*Triangle, offset mgl32.Vec3) []mgl32.Vec3 {
+	vertices := make([]mgl32.Vec3, 0, 3*len(triangles))
+	for _, triangle := range triangles {
+		for _, vertex := range triangle.Vertices {
+			vertices = append(vertices, vertex.Add(offset))
+		}
+	}
+	return vertices
+}
+
+func groupContext(triangles []*Triangle, groups int, twoLevel bool) *RenderContext {
+	context := bvhContext(triangles, BinnedBVHBuilder)
+	context.BVHTwoLevel = twoLevel
+	size := len(triangles) / groups
+	for i := 0; i < groups; i++ {
+		context.Groups = append(context.Groups, TriangleGroup{Name: string(rune('a' + i)), Start: i * size, Count: size})
+	}
+	return context
+}
+
+func TestBVHRefit(t *testing.T) {
+	triangles := randomTriangles(2000)
+	context := groupContext(triangles, 4, false)
+	BuildBVH(context)
+	nodes := len(context.BVH.Nodes)
+
+	if err := context.UpdateGroup("b", movedVertices(triangles[500:1000], mgl32.Vec3{0.5, 0, 0})); err != nil {
+		t.Fatal(err)
+	}
+	if context.RefitBVH() {
+		t.Errorf("Small move rebuilt the BVH")
+	}
+	if len(context.BVH.Nodes) != nodes {
+		t.Errorf("Refit changed the nodes from %d to %d", nodes, len(context.BVH.Nodes))
+	}
+	checkLeafBounds(t, context.BVH, context.Triangles)
+	checkIntersect(t, context, triangles, randomRays(triangles, 500))
+
+	// Moving a group far away grows the refit nodes over empty space
+	if err := context.UpdateGroup("c", movedVertices(triangles[1000:1500], mgl32.Vec3{1000, 0, 0})); err != nil {
+		t.Fatal(err)
+	}
+	if !context.RefitBVH() {
+		t.Errorf("Large move did not rebuild the BVH")
+	}
+	if err := context.BVH.Validate(len(triangles)); err != nil {
+		t.Fatal(err)
+	}
+	checkIntersect(t, context, triangles, randomRays(triangles, 500))
+
+	if err := context.UpdateGroup("z", nil); err == nil {
+		t.Errorf("Unknown group should not update")
+	}
+	if err := context.UpdateGroup("a", nil); err == nil {
+		t.Errorf("Group should not update to the wrong vertex count")
+	}
+}
+
+// Moving the light group moves the area light, rebuilding the BVH
+// counts the build progress from the start
+func TestUpdateLightGroup(t *testing.T) {
+	light := &gwob.Material{Name: "Light"}
+	triangles := append([]*Triangle{
+		NewTriangle(mgl32.Vec3{-1, 4, -1}, mgl32.Vec3{1, 4, 1}, mgl32.Vec3{1, 4, -1}, light, 0),
+		NewTriangle(mgl32.Vec3{-1, 4, -1}, mgl32.Vec3{-1, 4, 1}, mgl32.Vec3{1, 4, 1}, light, 1),
+	}, randomTriangles(200)...)
+	for i, triangle := range triangles {
+		triangle.Index = i
+	}
+	context := bvhContext(triangles, BinnedBVHBuilder)
+	context.Groups = []TriangleGroup{{Name: "Light", Start: 0, Count: 2}, {Name: "Scene", Start: 2, Count: 200}}
+	BuildBVH(context)
+	nodeTriangles := context.BVHNodeTriangles
+	transform, size, normal, _ := context.lightGeometry(0)
+	context.Light = NewAreaLight(transform, size, mgl32.Vec3{}, normal)
+
+	vertices, err := context.GroupVertices("Light")
+	if err != nil || len(vertices) != 6 || vertices[1] != (mgl32.Vec3{1, 4, 1}) {
+		t.Fatalf("Light group vertices %v: %v", vertices, err)
+	}
+	if err := context.UpdateGroup("Light", movedVertices(triangles[:2], mgl32.Vec3{10, 0, 0})); err != nil {
+		t.Fatal(err)
+	}
+	context.RefitBVH()
+	if position := context.Light.Transform.Col(3).Vec3(); position.Sub(mgl32.Vec3{10, 4, 0}).Len() > 0.001 {
+		t.Errorf("Moved light is at %v", position)
+	}
+
+	BuildBVH(context)
+	if context.BVHNodeTriangles != nodeTriangles {
+		t.Errorf("Rebuilt BVH counted %d node triangles, the first build %d", context.BVHNodeTriangles, nodeTriangles)
+	}
+}
+
+func TestTwoLevelBVH(t *testing.T) {
+	triangles := randomTriangles(2000)
+	context := groupContext(triangles, 4, true)
+	bvh := BuildBVH(context)
+
+	if len(bvh.Objects) != 4 {
+		t.Fatalf("Two-level BVH has %d objects", len(bvh.Objects))
+	}
+	if err := bvh.Validate(len(triangles)); err != nil {
+		t.Fatal(err)
+	}
+	rays := randomRays(triangles, 500)
+	checkIntersect(t, context, triangles, rays)
+
+	var buffer bytes.Buffer
+	if err := WriteBVHFile(&buffer, bvh); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadBVHFile(&buffer, int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := groupContext(triangles, 4, true)
+	loaded.BVHWidth = 4
+	if err := loaded.LoadBVH(read); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ContentHash() != context.ContentHash() {
+		t.Errorf("Loaded two-level BVH content hash differs from the built one")
+	}
+	checkIntersect(t, loaded, triangles, rays)
+
+	// Only the object of the moved group is refit
+	nodes := map[*BVHObject][]LinearBVHNode{}
+	for _, object := range loaded.BVH.Objects {
+		nodes[object] = append([]LinearBVHNode{}, object.BVH.Nodes...)
+	}
+	if err := loaded.UpdateGroup("b", movedVertices(triangles[500:1000], mgl32.Vec3{0, 0.5, 0})); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.RefitBVH() {
+		t.Errorf("Small move rebuilt the two-level BVH")
+	}
+	for _, object := range loaded.BVH.Objects {
+		moved := loaded.BVH.Permutation[object.Start] >= 500 && loaded.BVH.Permutation[object.Start] < 1000
+		if unchanged := reflect.DeepEqual(object.BVH.Nodes, nodes[object]); moved == unchanged {
+			t.Errorf("Refit of the object at %d: moved %v, unchanged %v", object.Start, moved, unchanged)
+		}
+	}
+	if err := loaded.BVH.Validate(len(triangles)); err != nil {
+		t.Fatal(err)
+	}
+	checkIntersect(t, loaded, triangles, rays)
+}
@@ -0,0 +1,241 @@
+package models
+
+import (
+	"math"
+	"raytracer/utility"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+type BVHBuilder int
+
+const (
+	// Sweeps the boundaries of centroid bins, O(n log n)
+	BinnedBVHBuilder BVHBuilder = iota
+	// Sweeps every triangle along every axis, slower to build but finds
+	// the best split plane of each node
+	ExactBVHBuilder
+	// Binned builder that also splits the space of a node, so that
+	// triangles crossing the split plane are referenced by both children.
+	// Reduces the overlap of nodes around long thin triangles
+	SpatialBVHBuilder
+)
+
+// Surface area heuristic costs of traversing a node and
+// intersecting a triangle
+const (
+	BVHTraversalCost    = 0.125
+	BVHIntersectionCost = 1.0
+)
+
+// Bins per axis of the binned builder when not set in the context
+const DefaultBVHBins = 16
+
+// Expected cost of a split with the given sum of child areas weighted
+// by their triangle counts, relative to the area of the node
+func splitCost(weightedArea float32, area float32) float32 {
+	if area <= 0 {
+		return BVHTraversalCost
+	}
+	return BVHTraversalCost + BVHIntersectionCost*weightedArea/area
+}
+
+// Chooses and applies the split of the node triangles, returning the index
+// of the first triangle of the right child or -1 if the node stays a leaf.
+// Nodes above the maximum leaf size split unless intersecting every
+// triangle of the node is cheaper than any split
+func (build *bvhBuild) split(node *BVHNode, centers MinimalAABB) int {
+	context, triangles := build.context, build.triangles
+	triCount := node.EndIndex - node.StartIndex + 1
+	if triCount <= build.leafSize {
+		return -1
+	}
+	leafCost := BVHIntersectionCost * float32(triCount)
+
+	if context.BVHBuilder == ExactBVHBuilder {
+		splitPlane, cost := GetSplitPlaneSAH(triangles, node)
+		if cost >= leafCost {
+			return -1
+		}
+		node.SplitPlane = splitPlane
+		return sortSplit(triangles, node)
+	}
+
+	split, ok := build.splitBinned(node, centers, build.bins)
+	if !ok {
+		// The centers coincide, only the triangle order can split them
+		node.SplitPlane = mgl32.Vec4{1, 0, 0, triangles[node.StartIndex].Center().X()}
+		return sortSplit(triangles, node)
+	}
+	if split.Cost >= leafCost {
+		return -1
+	}
+	node.SplitPlane = split.plane()
+	return split.partition(triangles, node)
+}
+
+// Split plane at a bin boundary along an axis of the centroid bounds
+type binnedSplit struct {
+	Axis  int
+	Bin   int
+	Bins  int
+	Min   float32
+	Scale float32
+	Cost  float32
+}
+
+func (split *binnedSplit) bin(center mgl32.Vec3) int {
+	b := int((center[split.Axis] - split.Min) * split.Scale)
+	return utility.MinInt(utility.MaxInt(b, 0), split.Bins-1)
+}
+
+func (split *binnedSplit) plane() mgl32.Vec4 {
+	plane := mgl32.Vec4{}
+	plane[split.Axis] = 1
+	plane[3] = split.Min + float32(split.Bin)/split.Scale
+	return plane
+}
+
+// Moves the triangles of the bins below the split to the start of the node.
+// The binning is monotonic in the centers, so the left child gets the same
+// triangles as sorting along the axis would
+func (split *binnedSplit) partition(triangles []*Triangle, node *BVHNode) int {
+	i, j := node.StartIndex, node.EndIndex
+	for i <= j {
+		if split.bin(triangles[i].Center()) < split.Bin {
+			i++
+		} else {
+			triangles[i], triangles[j] = triangles[j], triangles[i]
+			j--
+		}
+	}
+	return i
+}
+
+// Binned surface area heuristic. The centers of the node triangles are
+// binned along each axis of their bounds and the bin boundaries are swept
+// for the cheapest split. Large nodes are binned in chunks on every thread
+// and the bins of the chunks merged. Returns false if the centers coincide
+func (build *bvhBuild) splitBinned(node *BVHNode, centers MinimalAABB, bins int) (binnedSplit, bool) {
+	triCount := node.EndIndex - node.StartIndex + 1
+
+	splits := binnedSplits(centers, bins)
+
+	chunks := make([]*bvhBins, build.chunks(triCount))
+	parallelChunks(node.StartIndex, node.EndIndex, len(chunks), func(c int, start int, end int) {
+		chunks[c] = newBVHBins(bins)
+		for _, triangle := range build.triangles[start : end+1] {
+			chunks[c].add(&splits, triangle.Min(), triangle.Max(), triangle.Center())
+		}
+	})
+	for _, chunk := range chunks[1:] {
+		chunks[0].merge(chunk)
+	}
+	counts, bounds := chunks[0].counts, chunks[0].bounds
+
+	best := binnedSplit{Cost: math.MaxFloat32}
+	found := false
+	area := node.Bounds.Area()
+
+	for axis := range splits {
+		if splits[axis].Scale == 0 {
+			continue
+		}
+		bin, cost, _, _ := sweepBins(counts[axis], counts[axis], bounds[axis], area)
+		if bin != -1 && cost < best.Cost {
+			best = splits[axis]
+			best.Bin = bin
+			best.Cost = cost
+			found = true
+		}
+	}
+
+	return best, found
+}
+
+// Splits at the bin boundaries of each axis of the center bounds.
+// Axes along which the centers coincide have no scale
+func binnedSplits(centers MinimalAABB, bins int) [3]binnedSplit {
+	splits := [3]binnedSplit{}
+	for axis := range splits {
+		splits[axis] = binnedSplit{Axis: axis, Bins: bins, Min: centers.Min[axis]}
+		if extent := centers.Max[axis] - centers.Min[axis]; extent > 0 {
+			splits[axis].Scale = float32(bins) / extent
+		}
+	}
+	return splits
+}
+
+// Sweeps the bin boundaries of an axis for the cheapest split. Entries and
+// exits count the triangles starting and ending in each bin, which differ
+// when triangles span several bins. Returns the first bin right of the
+// split and the bounds of both sides, or -1 if every split leaves a side
+// empty
+func sweepBins(entries []int, exits []int, bounds []MinimalAABB, area float32) (int, float32, MinimalAABB, MinimalAABB) {
+	bins := len(bounds)
+
+	// Bounds of the bins at and above each boundary
+	rights := make([]MinimalAABB, bins)
+	right := emptyAABB()
+	rightCount := 0
+	for b := bins - 1; b >= 0; b-- {
+		right = unionAABB(right, bounds[b])
+		rights[b] = right
+		rightCount += exits[b]
+	}
+
+	best, bestCost := -1, float32(math.MaxFloat32)
+	var bestLeft, bestRight MinimalAABB
+	left := emptyAABB()
+	leftCount := 0
+	for b := 1; b < bins; b++ {
+		left = unionAABB(left, bounds[b-1])
+		leftCount += entries[b-1]
+		rightCount -= exits[b-1]
+		if leftCount == 0 || rightCount == 0 {
+			continue
+		}
+
+		cost := splitCost(left.Area()*float32(leftCount)+rights[b].Area()*float32(rightCount), area)
+		if cost < bestCost {
+			best, bestCost = b, cost
+			bestLeft, bestRight = left, rights[b]
+		}
+	}
+	return best, bestCost, bestLeft, bestRight
+}
+
+func emptyAABB() MinimalAABB {
+	return MinimalAABB{
+		Min: mgl32.Vec3{math.MaxFloat32, math.MaxFloat32, math.MaxFloat32},
+		Max: mgl32.Vec3{-math.MaxFloat32, -math.MaxFloat32, -math.MaxFloat32},
+	}
+}
+
+// Expected cost of intersecting a ray with the BVH under the surface area
+// heuristic, relative to intersecting a triangle. Lower is better
+func (bvh *BVH) SAHCost() float32 {
+	if bvh.Objects != nil {
+		return bvh.objectsSAHCost()
+	}
+	area := linearNodeArea(&bvh.Nodes[0])
+	if area <= 0 {
+		return 0
+	}
+
+	var cost float32
+	for i := range bvh.Nodes {
+		node := &bvh.Nodes[i]
+		if node.IsLeaf() {
+			cost += linearNodeArea(node) * BVHIntersectionCost * float32(node.Count())
+		} else {
+			cost += linearNodeArea(node) * BVHTraversalCost
+		}
+	}
+	return cost / area
+}
+
+func linearNodeArea(node *LinearBVHNode) float32 {
+	aabb := MinimalAABB{Min: node.Bounds[0], Max: node.Bounds[1]}
+	return aabb.Area()
+}
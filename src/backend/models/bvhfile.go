@@ -0,0 +1,162 @@
+package models
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// BVH file header. The version is increased whenever
+// the node layout changes
+const (
+	bvhFileMagic   = "RTBV"
+	BVHFileVersion = 3
+)
+
+// Writes the BVH as the header, the mesh hash, the node, triangle and
+// object counts, the nodes and the triangle permutation, followed by
+// the objects of a two-level BVH and the BVHs of the instanced meshes.
+// Objects of instances have no nodes, they share the nodes of the mesh
+func WriteBVHFile(w io.Writer, bvh *BVH) error {
+	writer := bufio.NewWriter(w)
+	if err := writeHeader(writer, bvhFileMagic, BVHFileVersion); err != nil {
+		return err
+	}
+
+	values := []interface{}{
+		bvh.MeshHash,
+		uint32(len(bvh.Nodes)),
+		uint32(len(bvh.Permutation)),
+		uint32(len(bvh.Objects)),
+		bvh.Nodes,
+		bvh.Permutation,
+	}
+	for _, object := range bvh.Objects {
+		values = append(values, object.Start, object.Count, object.Instance)
+		if object.Instance < 0 {
+			values = append(values, uint32(len(object.BVH.Nodes)), object.BVH.Nodes)
+		} else {
+			values = append(values, uint32(0))
+		}
+	}
+	values = append(values, uint32(len(bvh.Meshes)))
+	for _, mesh := range bvh.Meshes {
+		values = append(values, uint32(len(mesh.Nodes)), uint32(len(mesh.Permutation)), mesh.Nodes, mesh.Permutation)
+	}
+
+	for _, v := range values {
+		if err := binary.Write(writer, binary.LittleEndian, v); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// Reads the values of a BVH file and counts the bytes left in it,
+// which bound the counts of the file before anything is allocated
+type bvhFileReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (file *bvhFileReader) read(values ...interface{}) error {
+	for _, v := range values {
+		if err := binary.Read(file.reader, binary.LittleEndian, v); err != nil {
+			return err
+		}
+		file.remaining -= int64(binary.Size(v))
+	}
+	return nil
+}
+
+// Returns true if the rest of the file can hold the nodes and triangles
+func (file *bvhFileReader) holds(nodes, triangles uint32) bool {
+	return int64(nodes)*int64(binary.Size(LinearBVHNode{}))+int64(triangles)*4 <= file.remaining
+}
+
+// Reads a BVH file of the given size in bytes
+func ReadBVHFile(r io.Reader, size int64) (*BVH, error) {
+	reader := bufio.NewReader(r)
+	if err := readHeader(reader, bvhFileMagic, BVHFileVersion); err != nil {
+		return nil, err
+	}
+
+	bvh := &BVH{}
+	file := &bvhFileReader{reader: reader, remaining: size - int64(len(bvhFileMagic)+4)}
+	var nodeCount, triangleCount, objectCount uint32
+	if err := file.read(&bvh.MeshHash, &nodeCount, &triangleCount, &objectCount); err != nil {
+		return nil, err
+	}
+
+	// Every leaf has a triangle or an object except for the root of
+	// an empty scene
+	leaves := triangleCount
+	if objectCount > 0 {
+		leaves = objectCount
+	}
+	if nodeCount == 0 || uint64(nodeCount) > 2*uint64(leaves)+1 || !file.holds(nodeCount, triangleCount) {
+		return nil, fmt.Errorf("BVH file has %d nodes for %d triangles: %w", nodeCount, leaves, ErrBVHMismatch)
+	}
+
+	bvh.Nodes = make([]LinearBVHNode, nodeCount)
+	bvh.Permutation = make([]int32, triangleCount)
+	if err := file.read(bvh.Nodes, bvh.Permutation); err != nil {
+		return nil, err
+	}
+
+	for i := uint32(0); i < objectCount; i++ {
+		object := &BVHObject{BVH: &BVH{}}
+		var objectNodes uint32
+		if err := file.read(&object.Start, &object.Count, &object.Instance, &objectNodes); err != nil {
+			return nil, err
+		}
+		if object.Instance >= 0 {
+			// Linked to the BVH of the mesh when loaded
+			if objectNodes != 0 {
+				return nil, fmt.Errorf("BVH file instance object %d has nodes: %w", i, ErrBVHMismatch)
+			}
+			object.BVH = nil
+			bvh.Objects = append(bvh.Objects, object)
+			continue
+		}
+		if object.Count < 0 || uint32(object.Count) > triangleCount || objectNodes == 0 ||
+			uint64(objectNodes) > 2*uint64(object.Count)+1 || !file.holds(objectNodes, 0) {
+			return nil, fmt.Errorf("BVH file object %d has %d nodes for %d triangles: %w", i, objectNodes, object.Count, ErrBVHMismatch)
+		}
+
+		object.BVH.Nodes = make([]LinearBVHNode, objectNodes)
+		if err := file.read(object.BVH.Nodes); err != nil {
+			return nil, err
+		}
+		bvh.Objects = append(bvh.Objects, object)
+	}
+
+	var meshCount uint32
+	if err := file.read(&meshCount); err != nil {
+		return nil, err
+	}
+	if meshCount > objectCount {
+		return nil, fmt.Errorf("BVH file has %d meshes for %d objects: %w", meshCount, objectCount, ErrBVHMismatch)
+	}
+	for i := uint32(0); i < meshCount; i++ {
+		var meshNodes, meshTriangles uint32
+		if err := file.read(&meshNodes, &meshTriangles); err != nil {
+			return nil, err
+		}
+		if meshNodes == 0 || uint64(meshNodes) > 2*uint64(meshTriangles)+1 || !file.holds(meshNodes, meshTriangles) {
+			return nil, fmt.Errorf("BVH file mesh %d has %d nodes for %d triangles: %w", i, meshNodes, meshTriangles, ErrBVHMismatch)
+		}
+
+		mesh := &BVH{
+			Nodes:       make([]LinearBVHNode, meshNodes),
+			Permutation: make([]int32, meshTriangles),
+		}
+		if err := file.read(mesh.Nodes, mesh.Permutation); err != nil {
+			return nil, err
+		}
+		bvh.Meshes = append(bvh.Meshes, mesh)
+	}
+
+	return bvh, nil
+}
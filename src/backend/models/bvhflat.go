@@ -0,0 +1,219 @@
+package models
+
+import (
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Node of the depth-first linearized BVH used for traversal, 32 bytes.
+// The first child of an interior node follows it in the array and
+// Offset is the index of the second child. Leaves store the range of
+// their triangles, starting at Offset
+type LinearBVHNode struct {
+	Bounds [2]mgl32.Vec3
+	Offset int32
+	// Split axis of interior nodes or bvhLeaf in the lowest two bits,
+	// triangle count of leaves in the upper bits
+	Info uint32
+}
+
+const bvhLeaf = 3
+
+func (node *LinearBVHNode) IsLeaf() bool {
+	return node.Info&3 == bvhLeaf
+}
+
+func (node *LinearBVHNode) Count() int {
+	return int(node.Info >> 2)
+}
+
+func (node *LinearBVHNode) Axis() int {
+	return int(node.Info & 3)
+}
+
+// Traversal stack entries before the stack moves to the heap
+const bvhStackSize = 64
+
+// Appends the subtree of the node to the linearized nodes
+func (node *BVHNode) flatten(bvh *BVH) {
+	index := len(bvh.Nodes)
+	bvh.Nodes = append(bvh.Nodes, LinearBVHNode{Bounds: node.Bounds.Bounds})
+
+	if node.LeftChild == nil {
+		bvh.Nodes[index].Offset = int32(node.StartIndex)
+		bvh.Nodes[index].Info = uint32(node.EndIndex-node.StartIndex+1)<<2 | bvhLeaf
+		return
+	}
+
+	axis := 0
+	for i := 1; i < 3; i++ {
+		if node.SplitPlane[i] > node.SplitPlane[axis] {
+			axis = i
+		}
+	}
+	bvh.Nodes[index].Info = uint32(axis)
+
+	node.LeftChild.flatten(bvh)
+	bvh.Nodes[index].Offset = int32(len(bvh.Nodes))
+	node.RightChild.flatten(bvh)
+}
+
+// Slab test against the node bounds, true if the ray enters
+// the node before tmax and leaves it in front of the origin
+func (node *LinearBVHNode) intersects(ray *Ray, tmax float32) bool {
+	t0 := (node.Bounds[ray.Sign[0]][0] - ray.Origin[0]) * ray.InvDirection[0]
+	t1 := (node.Bounds[1-ray.Sign[0]][0] - ray.Origin[0]) * ray.InvDirection[0]
+	ty0 := (node.Bounds[ray.Sign[1]][1] - ray.Origin[1]) * ray.InvDirection[1]
+	ty1 := (node.Bounds[1-ray.Sign[1]][1] - ray.Origin[1]) * ray.InvDirection[1]
+
+	if t0 > ty1 || ty0 > t1 {
+		return false
+	}
+	if ty0 > t0 {
+		t0 = ty0
+	}
+	if ty1 < t1 {
+		t1 = ty1
+	}
+
+	tz0 := (node.Bounds[ray.Sign[2]][2] - ray.Origin[2]) * ray.InvDirection[2]
+	tz1 := (node.Bounds[1-ray.Sign[2]][2] - ray.Origin[2]) * ray.InvDirection[2]
+
+	if t0 > tz1 || tz0 > t1 {
+		return false
+	}
+	if tz0 > t0 {
+		t0 = tz0
+	}
+	if tz1 < t1 {
+		t1 = tz1
+	}
+
+	return t0 < tmax && t1 > 0
+}
+
+// Finds the closest triangle hit by the ray nearer than tmin. The nodes
+// are visited with an explicit stack, nearer child first along the
+// split axis so that the far child is often culled by the closer hit
+func (bvh *BVH) Intersect(triangles []*Triangle, ray *Ray, tmin *float32, umin *float32, vmin *float32, tri **Triangle) {
+	if bvh.Objects != nil {
+		var instance *Instance
+		bvh.intersectObjects(triangles, ray, tmin, umin, vmin, tri, &instance)
+		return
+	}
+	if bvh.isWide() {
+		bvh.intersectWide(triangles, ray, tmin, umin, vmin, tri)
+		return
+	}
+
+	var buffer [bvhStackSize]int32
+	stack := buffer[:0]
+
+	current := int32(0)
+	for {
+		node := &bvh.Nodes[current]
+		if node.intersects(ray, *tmin) {
+			if node.IsLeaf() {
+				intersectLeaf(triangles[node.Offset:int(node.Offset)+node.Count()], ray, tmin, umin, vmin, tri)
+			} else if ray.Sign[node.Axis()] == 1 {
+				// Moving towards the lower side, the second child is nearer
+				stack = append(stack, current+1)
+				current = node.Offset
+				continue
+			} else {
+				stack = append(stack, node.Offset)
+				current = current + 1
+				continue
+			}
+		}
+
+		if len(stack) == 0 {
+			return
+		}
+		current = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+	}
+}
+
+// Finds the closest hit like Intersect. A hit writes the instance of the
+// hit mesh triangle to instance, or nil for the scene triangles
+func (bvh *BVH) IntersectInstance(triangles []*Triangle, ray *Ray, tmin *float32, umin *float32, vmin *float32, tri **Triangle, instance **Instance) {
+	if bvh.Objects != nil {
+		bvh.intersectObjects(triangles, ray, tmin, umin, vmin, tri, instance)
+		return
+	}
+	bvh.Intersect(triangles, ray, tmin, umin, vmin, tri)
+}
+
+// Any-hit query, true if the ray hits a triangle nearer than tmax.
+// Returns on the first hit found, emitters are skipped if ignoreEmitters
+// is set so that light sources do not shadow themselves
+func (bvh *BVH) Occluded(triangles []*Triangle, ray *Ray, tmax float32, ignoreEmitters bool) bool {
+	if bvh.Objects != nil {
+		return bvh.occludedObjects(triangles, ray, tmax, ignoreEmitters)
+	}
+	if bvh.isWide() {
+		return bvh.occludedWide(triangles, ray, tmax, ignoreEmitters)
+	}
+
+	var buffer [bvhStackSize]int32
+	stack := buffer[:0]
+
+	current := int32(0)
+	for {
+		node := &bvh.Nodes[current]
+		if node.intersects(ray, tmax) {
+			// Nearer child first, it is more likely to hold a blocker
+			if !node.IsLeaf() && ray.Sign[node.Axis()] == 1 {
+				stack = append(stack, current+1)
+				current = node.Offset
+				continue
+			} else if !node.IsLeaf() {
+				stack = append(stack, node.Offset)
+				current = current + 1
+				continue
+			}
+			if occludedLeaf(triangles[node.Offset:int(node.Offset)+node.Count()], ray, tmax, ignoreEmitters) {
+				return true
+			}
+		}
+
+		if len(stack) == 0 {
+			return false
+		}
+		current = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+	}
+}
+
+// Closest hit among the triangles of a leaf, static triangles
+// facing away from the ray are culled
+func intersectLeaf(triangles []*Triangle, ray *Ray, tmin *float32, umin *float32, vmin *float32, tri **Triangle) {
+	for _, triangle := range triangles {
+		if triangle.Motion == nil && triangle.Normal.Dot(ray.Direction) > 0 {
+			continue
+		}
+		t, u, v := triangle.RayIntersect(ray)
+		if t > 0 && t < *tmin {
+			*tmin = t
+			*umin = u
+			*vmin = v
+			*tri = triangle
+		}
+	}
+}
+
+// True if a triangle of a leaf is hit nearer than tmax
+func occludedLeaf(triangles []*Triangle, ray *Ray, tmax float32, ignoreEmitters bool) bool {
+	for _, triangle := range triangles {
+		if ignoreEmitters && triangle.IsLight {
+			continue
+		}
+		if triangle.Motion == nil && triangle.Normal.Dot(ray.Direction) > 0 {
+			continue
+		}
+		if t, _, _ := triangle.RayIntersect(ray); t > 0 && t < tmax {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,299 @@
+package models
+
+import "fmt"
+
+// Object of a two-level BVH with its own bottom-level BVH over the
+// triangles [Start, Start+Count) of the BVH order, or an instance of
+// a mesh sharing the BVH of the mesh
+type BVHObject struct {
+	Start int32
+	Count int32
+	// Index of the instance in the context, -1 for objects of the
+	// scene triangles
+	Instance int32
+	BVH      *BVH
+
+	instance *Instance
+}
+
+func (object *BVHObject) triangles(triangles []*Triangle) []*Triangle {
+	if object.instance != nil {
+		return object.instance.Mesh.Triangles
+	}
+	return triangles[object.Start : object.Start+object.Count]
+}
+
+// World bounds of the object
+func (object *BVHObject) bounds() MinimalAABB {
+	root := &object.BVH.Nodes[0]
+	bounds := MinimalAABB{Min: root.Bounds[0], Max: root.Bounds[1]}
+	if object.instance != nil {
+		return object.instance.bounds(bounds)
+	}
+	return bounds
+}
+
+// Builds a BVH per OBJ group, or one over all scene triangles if the BVH
+// is not two-level, a BVH per instanced mesh and a top-level BVH over the
+// groups and instances. The triangles of a group stay together in the
+// BVH order, so that moving a group only refits its BVH and rebuilds the
+// small top level
+func buildTwoLevelBVH(context *RenderContext, triangles []*Triangle) (*BVH, []*Triangle) {
+	bvh := &BVH{}
+	ordered := make([]*Triangle, 0, len(triangles))
+
+	groups := context.Groups
+	if !context.BVHTwoLevel || len(groups) == 0 {
+		groups = []TriangleGroup{{Count: len(triangles)}}
+	}
+	for _, group := range groups {
+		if group.Count == 0 {
+			continue
+		}
+		object, objectTriangles := buildBVH(context, triangles[group.Start:group.Start+group.Count])
+		for _, index := range object.Permutation {
+			bvh.Permutation = append(bvh.Permutation, int32(group.Start)+index)
+		}
+
+		// The permutation of the object is only needed while building
+		object.Permutation = nil
+		object.BuildCost = object.SAHCost()
+		bvh.Objects = append(bvh.Objects, &BVHObject{
+			Start:    int32(len(ordered)),
+			Count:    int32(len(objectTriangles)),
+			Instance: -1,
+			BVH:      object,
+		})
+		ordered = append(ordered, objectTriangles...)
+	}
+
+	// The meshes keep their permutation to be loaded in the mesh order
+	for _, mesh := range context.Meshes {
+		meshBVH, meshTriangles := buildBVH(context, mesh.Triangles)
+		meshBVH.BuildCost = meshBVH.SAHCost()
+		mesh.Triangles = meshTriangles
+		bvh.Meshes = append(bvh.Meshes, meshBVH)
+	}
+	for i, instance := range context.Instances {
+		bvh.Objects = append(bvh.Objects, &BVHObject{
+			Instance: int32(i),
+			BVH:      bvh.Meshes[context.meshIndex(instance.Mesh)],
+			instance: instance,
+		})
+	}
+
+	bvh.buildTopLevel(context)
+	return bvh, ordered
+}
+
+// Builds the top-level nodes over the bounds of the objects, which are
+// reordered to the leaves of the nodes
+func (bvh *BVH) buildTopLevel(context *RenderContext) {
+	refs := make([]bvhReference, len(bvh.Objects))
+	for i, object := range bvh.Objects {
+		refs[i] = bvhReference{Triangle: int32(i), Bounds: object.bounds()}
+	}
+
+	build := newBVHBuild(context, nil)
+	build.leafSize = 1
+	build.spatial = false
+	root, indices := build.referenceTree(refs)
+
+	objects := make([]*BVHObject, len(indices))
+	for i, index := range indices {
+		objects[i] = bvh.Objects[index]
+	}
+	bvh.Objects = objects
+	bvh.Nodes = bvh.Nodes[:0]
+	root.flatten(bvh)
+}
+
+// Links the instance objects of a loaded BVH to the instances of the
+// context and the BVHs of their meshes
+func (bvh *BVH) linkInstances(context *RenderContext) error {
+	if len(bvh.Meshes) != len(context.Meshes) {
+		return fmt.Errorf("BVH has %d of %d meshes: %w", len(bvh.Meshes), len(context.Meshes), ErrBVHMismatch)
+	}
+
+	instances := 0
+	for _, object := range bvh.Objects {
+		if object.Instance < 0 {
+			continue
+		}
+		if int(object.Instance) >= len(context.Instances) {
+			return fmt.Errorf("BVH instance %d is invalid: %w", object.Instance, ErrBVHMismatch)
+		}
+		object.instance = context.Instances[object.Instance]
+		object.BVH = bvh.Meshes[context.meshIndex(object.instance.Mesh)]
+		instances++
+	}
+	if instances != len(context.Instances) {
+		return fmt.Errorf("BVH has %d of %d instances: %w", instances, len(context.Instances), ErrBVHMismatch)
+	}
+	return nil
+}
+
+// Visits the objects whose top-level leaves the ray enters before tmax,
+// nearer children first. The visit may lower tmax and stops the
+// traversal by returning true
+func (bvh *BVH) traverseObjects(ray *Ray, tmax *float32, visit func(object *BVHObject) bool) {
+	var buffer [bvhStackSize]int32
+	stack := buffer[:0]
+
+	current := int32(0)
+	for {
+		node := &bvh.Nodes[current]
+		if node.intersects(ray, *tmax) {
+			if node.IsLeaf() {
+				for _, object := range bvh.Objects[node.Offset : int(node.Offset)+node.Count()] {
+					if visit(object) {
+						return
+					}
+				}
+			} else if ray.Sign[node.Axis()] == 1 {
+				stack = append(stack, current+1)
+				current = node.Offset
+				continue
+			} else {
+				stack = append(stack, node.Offset)
+				current = current + 1
+				continue
+			}
+		}
+
+		if len(stack) == 0 {
+			return
+		}
+		current = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+	}
+}
+
+// Closest hit among the objects. Instances are intersected by the ray in
+// object space, the instance of the closest hit is written to instance
+func (bvh *BVH) intersectObjects(triangles []*Triangle, ray *Ray, tmin *float32, umin *float32, vmin *float32, tri **Triangle, instance **Instance) {
+	bvh.traverseObjects(ray, tmin, func(object *BVHObject) bool {
+		objectRay := ray
+		if object.instance != nil {
+			objectRay = object.instance.objectRay(ray)
+		}
+
+		// Instances of a mesh share the triangles, a nearer hit may
+		// be on the same triangle
+		closest := *tmin
+		object.BVH.Intersect(object.triangles(triangles), objectRay, tmin, umin, vmin, tri)
+		if *tmin < closest {
+			*instance = object.instance
+		}
+		return false
+	})
+}
+
+func (bvh *BVH) occludedObjects(triangles []*Triangle, ray *Ray, tmax float32, ignoreEmitters bool) bool {
+	occluded := false
+	bvh.traverseObjects(ray, &tmax, func(object *BVHObject) bool {
+		objectRay := ray
+		if object.instance != nil {
+			objectRay = object.instance.objectRay(ray)
+		}
+		occluded = object.BVH.Occluded(object.triangles(triangles), objectRay, tmax, ignoreEmitters)
+		return occluded
+	})
+	return occluded
+}
+
+// Checks the top-level nodes, the meshes and the objects, which have
+// to cover the triangles without overlapping
+func (bvh *BVH) validateObjects(triangleCount int) error {
+	if len(bvh.Nodes) == 0 {
+		return fmt.Errorf("BVH has no nodes: %w", ErrBVHMismatch)
+	}
+	next, err := validateLinearNode(bvh.Nodes, 0, len(bvh.Nodes), 0)
+	if err != nil {
+		return err
+	}
+	if next != len(bvh.Objects) {
+		return fmt.Errorf("BVH covers %d of %d objects: %w", next, len(bvh.Objects), ErrBVHMismatch)
+	}
+
+	for i, mesh := range bvh.Meshes {
+		if err := mesh.Validate(len(mesh.Permutation)); err != nil {
+			return fmt.Errorf("BVH mesh %d: %w", i, err)
+		}
+	}
+
+	covered := make([]bool, triangleCount)
+	total := 0
+	for i, object := range bvh.Objects {
+		if object.BVH == nil || object.BVH.Objects != nil {
+			return fmt.Errorf("BVH object %d has no bottom-level BVH: %w", i, ErrBVHMismatch)
+		}
+		if object.Instance >= 0 {
+			if object.instance == nil {
+				return fmt.Errorf("BVH object %d has no instance: %w", i, ErrBVHMismatch)
+			}
+			continue
+		}
+		if object.Start < 0 || object.Count <= 0 || int(object.Start)+int(object.Count) > triangleCount {
+			return fmt.Errorf("BVH object %d is outside the triangles: %w", i, ErrBVHMismatch)
+		}
+		for j := object.Start; j < object.Start+object.Count; j++ {
+			if covered[j] {
+				return fmt.Errorf("BVH objects overlap at triangle %d: %w", j, ErrBVHMismatch)
+			}
+			covered[j] = true
+		}
+		total += int(object.Count)
+
+		if err := object.BVH.Validate(int(object.Count)); err != nil {
+			return fmt.Errorf("BVH object %d: %w", i, err)
+		}
+	}
+	if total != triangleCount {
+		return fmt.Errorf("BVH objects cover %d of %d triangles: %w", total, triangleCount, ErrBVHMismatch)
+	}
+	return nil
+}
+
+// SAH cost of the top level, the objects are weighted by their own cost
+func (bvh *BVH) objectsSAHCost() float32 {
+	area := linearNodeArea(&bvh.Nodes[0])
+	if area <= 0 {
+		return 0
+	}
+
+	// Instances share the cost of their mesh
+	costs := make(map[*BVH]float32, len(bvh.Objects))
+	var cost float32
+	for i := range bvh.Nodes {
+		node := &bvh.Nodes[i]
+		cost += linearNodeArea(node) * BVHTraversalCost
+		if !node.IsLeaf() {
+			continue
+		}
+		for _, object := range bvh.Objects[node.Offset : int(node.Offset)+node.Count()] {
+			objectCost, found := costs[object.BVH]
+			if !found {
+				objectCost = object.BVH.SAHCost()
+				costs[object.BVH] = objectCost
+			}
+			bounds := object.bounds()
+			cost += bounds.Area() * objectCost
+		}
+	}
+	return cost / area
+}
+
+// Number of nodes of the BVH, its objects and meshes
+func (bvh *BVH) nodeCount() int {
+	count := len(bvh.Nodes)
+	for _, object := range bvh.Objects {
+		if object.Instance < 0 {
+			count += len(object.BVH.Nodes)
+		}
+	}
+	for _, mesh := range bvh.Meshes {
+		count += len(mesh.Nodes)
+	}
+	return count
+}
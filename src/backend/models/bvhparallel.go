@@ -0,0 +1,220 @@
+package models
+
+import (
+	"raytracer/utility"
+	"runtime"
+	"sync"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Nodes with at least this many triangles compute their bounds and bins
+// on every thread of the build
+const bvhParallelBinSize = 1 << 15
+
+// Subtrees with at least this many triangles may be built on another
+// goroutine while the caller builds the sibling
+const bvhParallelSubtreeSize = 1 << 12
+
+// State shared by the goroutines building a BVH. The children of a node
+// work on disjoint ranges of the triangles and the split decisions do not
+// depend on the thread count, so every thread count builds the same BVH
+type bvhBuild struct {
+	context   *RenderContext
+	triangles []*Triangle
+	threads   int
+	bins      int
+	leafSize  int
+
+	// Spatial splits clip the triangles, the top level of a two-level
+	// BVH splits objects only. Overlap area of the object split children
+	// above which spatial splits are tried
+	spatial    bool
+	minOverlap float32
+
+	// Slots of the goroutines building subtrees besides the caller
+	workers chan struct{}
+
+	// Guards the progress statistics of the context
+	progress sync.Mutex
+}
+
+func newBVHBuild(context *RenderContext, triangles []*Triangle) *bvhBuild {
+	threads := context.BVHThreads
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	bins := context.BVHBins
+	if bins <= 0 {
+		bins = DefaultBVHBins
+	}
+	return &bvhBuild{
+		context:   context,
+		triangles: triangles,
+		threads:   threads,
+		bins:      bins,
+		leafSize:  utility.MaxInt(context.BVHMaxLeafSize, 1),
+		spatial:   context.BVHBuilder == SpatialBVHBuilder,
+		workers:   make(chan struct{}, threads-1),
+	}
+}
+
+// Reserves a goroutine slot, false if every thread is busy
+func (build *bvhBuild) acquire() bool {
+	select {
+	case build.workers <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (build *bvhBuild) release() {
+	<-build.workers
+}
+
+// Number of chunks a node range is processed in
+func (build *bvhBuild) chunks(triCount int) int {
+	if triCount < bvhParallelBinSize {
+		return 1
+	}
+	return build.threads
+}
+
+// Builds the children of a split node
+func (build *bvhBuild) children(node *BVHNode, splitIndex int) {
+	build.fork(node.EndIndex-node.StartIndex+1, func() {
+		node.LeftChild = build.node(node.StartIndex, splitIndex-1, node.Depth+1)
+	}, func() {
+		node.RightChild = build.node(splitIndex, node.EndIndex, node.Depth+1)
+	})
+}
+
+// Runs the builds of two subtrees, the left one on another goroutine
+// if the node is large and a thread is free
+func (build *bvhBuild) fork(triCount int, left func(), right func()) {
+	if triCount < bvhParallelSubtreeSize || !build.acquire() {
+		left()
+		right()
+		return
+	}
+
+	var wait sync.WaitGroup
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		defer build.release()
+		left()
+	}()
+	right()
+	wait.Wait()
+}
+
+// Counts the triangles of a finished leaf towards the build progress
+func (build *bvhBuild) leafDone(triCount int) {
+	build.progress.Lock()
+	defer build.progress.Unlock()
+
+	context := build.context
+	context.BVHNodeTriangles += uint64(triCount)
+
+	// The scene triangles, groups of a two-level BVH are built one by one
+	interval := uint64(len(context.Triangles) / 10.0)
+	if context.BVHNodeTriangles > context.BVHProgressReported+interval {
+		context.BVHProgressReported = context.BVHNodeTriangles
+		// Duplicated references of spatial splits count more than once
+		progress := float32(context.BVHNodeTriangles) / float32(len(context.Triangles))
+		if progress > 1 {
+			progress = 1
+		}
+		utility.ProgressUpdate(progress, "RenderContext.BuildBVH", -1, 0)
+	}
+}
+
+// Runs fn over the given number of consecutive chunks of the triangles in
+// [start, end], each on its own goroutine, and waits for them. A single
+// chunk runs on the caller
+func parallelChunks(start int, end int, chunks int, fn func(chunk int, start int, end int)) {
+	if chunks <= 1 {
+		fn(0, start, end)
+		return
+	}
+
+	count := end - start + 1
+	var wait sync.WaitGroup
+	wait.Add(chunks)
+	for c := 0; c < chunks; c++ {
+		go func(c int) {
+			defer wait.Done()
+			fn(c, start+count*c/chunks, start+count*(c+1)/chunks-1)
+		}(c)
+	}
+	wait.Wait()
+}
+
+// Bounds of the triangles in [start, end] and of their centers
+func (build *bvhBuild) bounds(start int, end int) (MinimalAABB, MinimalAABB) {
+	chunks := build.chunks(end - start + 1)
+	bounds := make([]MinimalAABB, chunks)
+	centers := make([]MinimalAABB, chunks)
+
+	parallelChunks(start, end, chunks, func(c int, start int, end int) {
+		bounds[c], centers[c] = emptyAABB(), emptyAABB()
+		if end < start {
+			return
+		}
+		bounds[c].Min, bounds[c].Max = GetTriangleBounds(build.triangles[start : end+1])
+		for _, triangle := range build.triangles[start : end+1] {
+			center := triangle.Center()
+			centers[c].Min = utility.Vec3Min(centers[c].Min, center)
+			centers[c].Max = utility.Vec3Max(centers[c].Max, center)
+		}
+	})
+
+	// Minimum and maximum are exact, the chunking does not change the result
+	for c := 1; c < chunks; c++ {
+		bounds[0] = unionAABB(bounds[0], bounds[c])
+		centers[0] = unionAABB(centers[0], centers[c])
+	}
+	return bounds[0], centers[0]
+}
+
+func unionAABB(a MinimalAABB, b MinimalAABB) MinimalAABB {
+	return MinimalAABB{Min: utility.Vec3Min(a.Min, b.Min), Max: utility.Vec3Max(a.Max, b.Max)}
+}
+
+// Triangle counts and bounds of the centroid bins along every axis
+type bvhBins struct {
+	counts [3][]int
+	bounds [3][]MinimalAABB
+}
+
+func newBVHBins(bins int) *bvhBins {
+	b := &bvhBins{}
+	for axis := 0; axis < 3; axis++ {
+		b.counts[axis] = make([]int, bins)
+		b.bounds[axis] = make([]MinimalAABB, bins)
+		for i := range b.bounds[axis] {
+			b.bounds[axis][i] = emptyAABB()
+		}
+	}
+	return b
+}
+
+func (b *bvhBins) add(splits *[3]binnedSplit, min mgl32.Vec3, max mgl32.Vec3, center mgl32.Vec3) {
+	for axis := range splits {
+		i := splits[axis].bin(center)
+		b.counts[axis][i]++
+		b.bounds[axis][i].Min = utility.Vec3Min(b.bounds[axis][i].Min, min)
+		b.bounds[axis][i].Max = utility.Vec3Max(b.bounds[axis][i].Max, max)
+	}
+}
+
+func (b *bvhBins) merge(other *bvhBins) {
+	for axis := 0; axis < 3; axis++ {
+		for i := range b.counts[axis] {
+			b.counts[axis][i] += other.counts[axis][i]
+			b.bounds[axis][i] = unionAABB(b.bounds[axis][i], other.bounds[axis][i])
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Relative growth of the SAH cost by refits above which RefitBVH
+// rebuilds the BVH, when not set in the context
+const DefaultBVHRebuildThreshold = 0.5
+
+// Triangles of an OBJ group, in the scene order
+type TriangleGroup struct {
+	Name  string
+	Start int
+	Count int
+}
+
+func (context *RenderContext) group(name string) (*TriangleGroup, error) {
+	for i := range context.Groups {
+		if context.Groups[i].Name == name {
+			return &context.Groups[i], nil
+		}
+	}
+	return nil, fmt.Errorf("scene has no group %q", name)
+}
+
+// Returns the current vertices of an OBJ group in the order of UpdateGroup
+func (context *RenderContext) GroupVertices(name string) ([]mgl32.Vec3, error) {
+	group, err := context.group(name)
+	if err != nil {
+		return nil, err
+	}
+	scene := context.sceneTriangles()
+	vertices := make([]mgl32.Vec3, 0, 3*group.Count)
+	for _, triangle := range scene[group.Start : group.Start+group.Count] {
+		vertices = append(vertices, triangle.Vertices[:]...)
+	}
+	return vertices, nil
+}
+
+// Moves the triangles of an OBJ group to the given vertices, three per
+// triangle in the order of the group. Vertices of moving groups are in
+// object space. The BVH is updated by RefitBVH, the area light follows
+// moved light triangles
+func (context *RenderContext) UpdateGroup(name string, vertices []mgl32.Vec3) error {
+	group, err := context.group(name)
+	if err != nil {
+		return err
+	}
+	if len(vertices) != 3*group.Count {
+		return fmt.Errorf("group %q has %d vertices, got %d", name, 3*group.Count, len(vertices))
+	}
+
+	scene := context.sceneTriangles()
+	if context.moved == nil {
+		context.moved = make([]bool, len(scene))
+	}
+
+	// The triangles are updated in place, the BVH and its references
+	// point to the same triangles
+	lit := false
+	for i := 0; i < group.Count; i++ {
+		triangle := scene[group.Start+i]
+		lit = lit || triangle.Material.Name == "Light"
+		updated := NewTriangle(vertices[3*i], vertices[3*i+1], vertices[3*i+2], triangle.Material, triangle.Index)
+		updated.TextureCoords = triangle.TextureCoords
+		motion := triangle.Motion
+		*triangle = *updated
+		triangle.SetMotion(motion)
+
+		context.moved[group.Start+i] = true
+	}
+
+	if lit && context.Light != nil {
+		transform, size, normal, _ := context.lightGeometry(0)
+		context.Light.Transform, context.Light.Size, context.Light.Normal = transform, size, normal
+	}
+	return nil
+}
+
+// Moves an instance to the given transform. The top level of the BVH is
+// rebuilt by RefitBVH, the BVH of the mesh stays the same
+func (context *RenderContext) UpdateInstance(index int, transform mgl32.Mat4) error {
+	if index < 0 || index >= len(context.Instances) {
+		return fmt.Errorf("scene has no instance %d", index)
+	}
+	if err := context.Instances[index].SetTransform(transform); err != nil {
+		return err
+	}
+	context.instancesMoved = true
+	return nil
+}
+
+// Refits the bounds of the BVH to the moved triangles in linear time. If
+// the refit SAH cost grew past the rebuild threshold over the cost of the
+// built BVH, the BVH is rebuilt instead. Returns true if it was rebuilt
+func (context *RenderContext) RefitBVH() bool {
+	bvh := context.BVH
+	if bvh == nil || (context.moved == nil && !context.instancesMoved) {
+		return false
+	}
+
+	moved := func(i int) bool {
+		return context.moved != nil && context.moved[bvh.Permutation[i]]
+	}
+	if bvh.Objects != nil {
+		refitted := context.instancesMoved
+		for _, object := range bvh.Objects {
+			if object.Instance >= 0 {
+				continue
+			}
+			start := int(object.Start)
+			if object.BVH.refit(object.triangles(context.Triangles), func(i int) bool { return moved(start + i) }) {
+				object.BVH.Widen(object.BVH.width)
+				refitted = true
+			}
+		}
+		if refitted {
+			bvh.buildTopLevel(context)
+		}
+	} else {
+		bvh.refit(context.Triangles, moved)
+		bvh.Widen(bvh.width)
+	}
+	context.moved = nil
+	context.instancesMoved = false
+
+	threshold := context.BVHRebuildThreshold
+	if threshold <= 0 {
+		threshold = DefaultBVHRebuildThreshold
+	}
+	if bvh.SAHCost() > bvh.BuildCost*(1+threshold) {
+		BuildBVH(context)
+		return true
+	}
+	return false
+}
+
+// Recomputes the bounds of the leaves holding moved triangles and then
+// of every interior node. The children follow their parent in the node
+// array, so a reverse pass visits them first. Returns false if no leaf
+// holds a moved triangle
+func (bvh *BVH) refit(triangles []*Triangle, moved func(i int) bool) bool {
+	refitted := false
+	for i := len(bvh.Nodes) - 1; i >= 0; i-- {
+		node := &bvh.Nodes[i]
+		if node.IsLeaf() {
+			start, end := int(node.Offset), int(node.Offset)+node.Count()
+			for j := start; j < end; j++ {
+				if moved(j) {
+					min, max := GetTriangleBounds(triangles[start:end])
+					node.Bounds = [2]mgl32.Vec3{min, max}
+					refitted = true
+					break
+				}
+			}
+			continue
+		}
+
+		first, second := &bvh.Nodes[i+1], &bvh.Nodes[node.Offset]
+		bounds := unionAABB(
+			MinimalAABB{Min: first.Bounds[0], Max: first.Bounds[1]},
+			MinimalAABB{Min: second.Bounds[0], Max: second.Bounds[1]},
+		)
+		node.Bounds = [2]mgl32.Vec3{bounds.Min, bounds.Max}
+	}
+	return refitted
+}
@@ -0,0 +1,330 @@
+package models
+
+import (
+	"math"
+	"raytracer/utility"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Overlap of the object split children relative to the area of the root
+// above which the spatial builder tries spatial splits, when not set in
+// the context. Zero tries them in every node with overlapping children,
+// 1 practically never
+const DefaultBVHSplitAlpha = 1e-5
+
+// Returns the split alpha of the context or the default
+func (context *RenderContext) splitAlpha() float32 {
+	if context.BVHSplitAlpha == nil {
+		return DefaultBVHSplitAlpha
+	}
+	return *context.BVHSplitAlpha
+}
+
+// Reference to a triangle in a node of the spatial builder, or to an
+// object in the top level of a two-level BVH. The bounds are clipped to
+// the part of the triangle within the node
+type bvhReference struct {
+	Triangle int32
+	Bounds   MinimalAABB
+}
+
+func (ref *bvhReference) center() mgl32.Vec3 {
+	return ref.Bounds.Min.Add(ref.Bounds.Max).Mul(0.5)
+}
+
+// Object split of the references at a centroid bin boundary
+type objectSplit struct {
+	binnedSplit
+	Left  MinimalAABB
+	Right MinimalAABB
+}
+
+// Spatial split at a plane along an axis of the node bounds
+type spatialSplit struct {
+	Axis     int
+	Position float32
+	Cost     float32
+}
+
+func (split *spatialSplit) plane() mgl32.Vec4 {
+	plane := mgl32.Vec4{}
+	plane[split.Axis] = 1
+	plane[3] = split.Position
+	return plane
+}
+
+// Builds the nodes of the spatial builder over references to the
+// triangles. Returns the root and the triangle index of every reference,
+// the leaves index this list instead of the triangles
+func (build *bvhBuild) spatialTree() (*BVHNode, []int32) {
+	refs := make([]bvhReference, len(build.triangles))
+	for i, triangle := range build.triangles {
+		refs[i] = bvhReference{Triangle: int32(i), Bounds: MinimalAABB{Min: triangle.Min(), Max: triangle.Max()}}
+	}
+	return build.referenceTree(refs)
+}
+
+// Builds the nodes over the references, see spatialTree
+func (build *bvhBuild) referenceTree(refs []bvhReference) (*BVHNode, []int32) {
+	bounds := referenceBounds(refs)
+	build.minOverlap = build.context.splitAlpha() * bounds.Area()
+
+	root := build.spatialNode(refs, bounds, 0)
+	indices := make([]int32, 0, len(refs))
+	root.assignReferences(&indices)
+	return root, indices
+}
+
+func (build *bvhBuild) spatialNode(refs []bvhReference, bounds MinimalAABB, depth int) *BVHNode {
+	node := &BVHNode{
+		Depth:  depth,
+		Bounds: NewAABBFromMinimal(bounds),
+	}
+
+	left, right := build.splitReferences(node, refs, bounds)
+	if left == nil {
+		node.references = refs
+		build.leafDone(len(refs))
+		return node
+	}
+
+	build.fork(len(refs), func() {
+		node.LeftChild = build.spatialNode(left, referenceBounds(left), depth+1)
+	}, func() {
+		node.RightChild = build.spatialNode(right, referenceBounds(right), depth+1)
+	})
+	return node
+}
+
+// Chooses the cheaper of the best object split and, if the children of
+// the object split overlap, the best spatial split. Returns the references
+// of the children or nil if the node stays a leaf
+func (build *bvhBuild) splitReferences(node *BVHNode, refs []bvhReference, bounds MinimalAABB) ([]bvhReference, []bvhReference) {
+	context := build.context
+	if !context.UseBVH || node.Depth >= context.BVHMaxDepth || len(refs) <= build.leafSize {
+		return nil, nil
+	}
+	leafCost := BVHIntersectionCost * float32(len(refs))
+	area := bounds.Area()
+
+	object, objectFound := build.findObjectSplit(refs, area)
+	if build.spatial && (!objectFound || overlapArea(object.Left, object.Right) > build.minOverlap) {
+		spatial, found := build.findSpatialSplit(refs, bounds, area)
+		if found && spatial.Cost < leafCost && (!objectFound || spatial.Cost < object.Cost) {
+			left, right := spatial.apply(build.triangles, refs)
+			if len(left) > 0 && len(right) > 0 {
+				node.SplitPlane = spatial.plane()
+				return left, right
+			}
+		}
+	}
+
+	if !objectFound {
+		// The centers coincide, only the reference order can split them
+		half := len(refs) / 2
+		node.SplitPlane = mgl32.Vec4{1, 0, 0, refs[half].center().X()}
+		return refs[:half], refs[half:]
+	}
+	if object.Cost >= leafCost {
+		return nil, nil
+	}
+
+	node.SplitPlane = object.plane()
+	i, j := 0, len(refs)-1
+	for i <= j {
+		if object.bin(refs[i].center()) < object.Bin {
+			i++
+		} else {
+			refs[i], refs[j] = refs[j], refs[i]
+			j--
+		}
+	}
+	return refs[:i], refs[i:]
+}
+
+// Binned surface area heuristic over the reference centers
+func (build *bvhBuild) findObjectSplit(refs []bvhReference, area float32) (objectSplit, bool) {
+	centers := emptyAABB()
+	for i := range refs {
+		center := refs[i].center()
+		centers = unionAABB(centers, MinimalAABB{Min: center, Max: center})
+	}
+
+	splits := binnedSplits(centers, build.bins)
+	bins := newBVHBins(build.bins)
+	for i := range refs {
+		bins.add(&splits, refs[i].Bounds.Min, refs[i].Bounds.Max, refs[i].center())
+	}
+
+	best := objectSplit{binnedSplit: binnedSplit{Cost: math.MaxFloat32}}
+	found := false
+	for axis := range splits {
+		if splits[axis].Scale == 0 {
+			continue
+		}
+		bin, cost, left, right := sweepBins(bins.counts[axis], bins.counts[axis], bins.bounds[axis], area)
+		if bin != -1 && cost < best.Cost {
+			best = objectSplit{binnedSplit: splits[axis], Left: left, Right: right}
+			best.Bin = bin
+			best.Cost = cost
+			found = true
+		}
+	}
+	return best, found
+}
+
+// Bins the clipped references along each axis of the node bounds. A
+// reference enters the bin of its minimum, exits the bin of its maximum
+// and its parts within every bin in between grow the bounds of the bin
+func (build *bvhBuild) findSpatialSplit(refs []bvhReference, bounds MinimalAABB, area float32) (spatialSplit, bool) {
+	best := spatialSplit{Cost: math.MaxFloat32}
+	found := false
+
+	bins := build.bins
+	entries := make([]int, bins)
+	exits := make([]int, bins)
+	binBounds := make([]MinimalAABB, bins)
+
+	for axis := 0; axis < 3; axis++ {
+		extent := bounds.Max[axis] - bounds.Min[axis]
+		if extent <= 0 {
+			continue
+		}
+		width := extent / float32(bins)
+		bin := func(x float32) int {
+			return utility.MinInt(utility.MaxInt(int((x-bounds.Min[axis])/width), 0), bins-1)
+		}
+
+		for b := range binBounds {
+			entries[b], exits[b] = 0, 0
+			binBounds[b] = emptyAABB()
+		}
+		for i := range refs {
+			ref := &refs[i]
+			first, last := bin(ref.Bounds.Min[axis]), bin(ref.Bounds.Max[axis])
+			entries[first]++
+			exits[last]++
+			for b := first; b <= last; b++ {
+				lo := bounds.Min[axis] + float32(b)*width
+				clipped := clipReference(build.triangles, ref, axis, lo, lo+width)
+				binBounds[b] = unionAABB(binBounds[b], clipped)
+			}
+		}
+
+		b, cost, _, _ := sweepBins(entries, exits, binBounds, area)
+		if b != -1 && cost < best.Cost {
+			best = spatialSplit{Axis: axis, Position: bounds.Min[axis] + float32(b)*width, Cost: cost}
+			found = true
+		}
+	}
+	return best, found
+}
+
+// Distributes the references to the sides of the plane. References
+// crossing the plane are clipped and go to both sides
+func (split *spatialSplit) apply(triangles []*Triangle, refs []bvhReference) ([]bvhReference, []bvhReference) {
+	var left, right []bvhReference
+	for _, ref := range refs {
+		switch {
+		case ref.Bounds.Max[split.Axis] <= split.Position:
+			left = append(left, ref)
+		case ref.Bounds.Min[split.Axis] >= split.Position:
+			right = append(right, ref)
+		default:
+			leftRef := bvhReference{Triangle: ref.Triangle}
+			leftRef.Bounds = clipReference(triangles, &ref, split.Axis, ref.Bounds.Min[split.Axis], split.Position)
+			rightRef := bvhReference{Triangle: ref.Triangle}
+			rightRef.Bounds = clipReference(triangles, &ref, split.Axis, split.Position, ref.Bounds.Max[split.Axis])
+
+			// Triangles touching the plane have nothing on one side
+			if isEmptyAABB(leftRef.Bounds) {
+				right = append(right, ref)
+			} else if isEmptyAABB(rightRef.Bounds) {
+				left = append(left, ref)
+			} else {
+				left = append(left, leftRef)
+				right = append(right, rightRef)
+			}
+		}
+	}
+	return left, right
+}
+
+// Bounds of the part of the referenced triangle between lo and hi along
+// the axis, within the bounds of the reference. Moving triangles are
+// clipped by their bounds
+func clipReference(triangles []*Triangle, ref *bvhReference, axis int, lo float32, hi float32) MinimalAABB {
+	clipped := emptyAABB()
+	include := func(point mgl32.Vec3) {
+		clipped.Min = utility.Vec3Min(clipped.Min, point)
+		clipped.Max = utility.Vec3Max(clipped.Max, point)
+	}
+
+	triangle := triangles[ref.Triangle]
+	if triangle.Motion != nil {
+		clipped = ref.Bounds
+	} else {
+		// Vertices within the slab and the edge crossings of its planes
+		for i := 0; i < 3; i++ {
+			a, b := triangle.Vertices[i], triangle.Vertices[(i+1)%3]
+			if a[axis] >= lo && a[axis] <= hi {
+				include(a)
+			}
+			for _, plane := range [2]float32{lo, hi} {
+				if (a[axis] < plane && b[axis] > plane) || (a[axis] > plane && b[axis] < plane) {
+					point := a.Add(b.Sub(a).Mul((plane - a[axis]) / (b[axis] - a[axis])))
+					point[axis] = plane
+					include(point)
+				}
+			}
+		}
+	}
+
+	clipped.Min = utility.Vec3Max(clipped.Min, ref.Bounds.Min)
+	clipped.Max = utility.Vec3Min(clipped.Max, ref.Bounds.Max)
+	if clipped.Min[axis] < lo {
+		clipped.Min[axis] = lo
+	}
+	if clipped.Max[axis] > hi {
+		clipped.Max[axis] = hi
+	}
+	return clipped
+}
+
+func referenceBounds(refs []bvhReference) MinimalAABB {
+	bounds := emptyAABB()
+	for i := range refs {
+		bounds = unionAABB(bounds, refs[i].Bounds)
+	}
+	return bounds
+}
+
+func isEmptyAABB(aabb MinimalAABB) bool {
+	return aabb.Min[0] > aabb.Max[0] || aabb.Min[1] > aabb.Max[1] || aabb.Min[2] > aabb.Max[2]
+}
+
+// Surface area of the intersection of the boxes
+func overlapArea(a MinimalAABB, b MinimalAABB) float32 {
+	overlap := MinimalAABB{Min: utility.Vec3Max(a.Min, b.Min), Max: utility.Vec3Min(a.Max, b.Max)}
+	if isEmptyAABB(overlap) {
+		return 0
+	}
+	return overlap.Area()
+}
+
+// Lays out the references of the leaves in depth-first order and
+// sets the triangle ranges of the leaves to their references
+func (node *BVHNode) assignReferences(indices *[]int32) {
+	if node.LeftChild == nil {
+		node.StartIndex = len(*indices)
+		for _, ref := range node.references {
+			*indices = append(*indices, ref.Triangle)
+		}
+		node.EndIndex = len(*indices) - 1
+		node.references = nil
+		return
+	}
+	node.LeftChild.assignReferences(indices)
+	node.RightChild.assignReferences(indices)
+}
@@ -0,0 +1,301 @@
+package models
+
+// Maximum children of a wide BVH node
+const MaxBVHWidth = 8
+
+// Nodes of a wide BVH with the bounds of their children stored by axis,
+// so that a ray is tested against all of them in one loop. A BVH uses
+// the node type of its width, 4-wide nodes take half the memory
+type WideBVHNode4 struct {
+	MinX, MinY, MinZ [4]float32
+	MaxX, MaxY, MaxZ [4]float32
+
+	// Wide node index of interior children, first triangle of leaves
+	Child [4]int32
+	// Triangle count of leaf children, 0 for interior children
+	Count [4]int32
+
+	Children int32
+}
+
+type WideBVHNode8 struct {
+	MinX, MinY, MinZ [MaxBVHWidth]float32
+	MaxX, MaxY, MaxZ [MaxBVHWidth]float32
+
+	Child [MaxBVHWidth]int32
+	Count [MaxBVHWidth]int32
+
+	Children int32
+}
+
+// Fields of a wide node of either type, for building them
+type wideBVHLanes struct {
+	minX, minY, minZ []float32
+	maxX, maxY, maxZ []float32
+	child, count     []int32
+	children         *int32
+}
+
+func (node *WideBVHNode4) lanes() wideBVHLanes {
+	return wideBVHLanes{
+		node.MinX[:], node.MinY[:], node.MinZ[:],
+		node.MaxX[:], node.MaxY[:], node.MaxZ[:],
+		node.Child[:], node.Count[:], &node.Children,
+	}
+}
+
+func (node *WideBVHNode8) lanes() wideBVHLanes {
+	return wideBVHLanes{
+		node.MinX[:], node.MinY[:], node.MinZ[:],
+		node.MaxX[:], node.MaxY[:], node.MaxZ[:],
+		node.Child[:], node.Count[:], &node.Children,
+	}
+}
+
+// Returns the wide node at index, of the type of the BVH width
+func (bvh *BVH) wideNode(index int32) wideBVHLanes {
+	if bvh.Wide4 != nil {
+		return bvh.Wide4[index].lanes()
+	}
+	return bvh.Wide8[index].lanes()
+}
+
+// Returns true if the BVH is traversed through wide nodes
+func (bvh *BVH) isWide() bool {
+	return bvh.Wide4 != nil || bvh.Wide8 != nil
+}
+
+// Appends an empty node of the type of the width, returns its index
+func (bvh *BVH) appendWide(width int) int32 {
+	if width <= 4 {
+		bvh.Wide4 = append(bvh.Wide4, WideBVHNode4{})
+		return int32(len(bvh.Wide4) - 1)
+	}
+	bvh.Wide8 = append(bvh.Wide8, WideBVHNode8{})
+	return int32(len(bvh.Wide8) - 1)
+}
+
+// Child of a wide node hit by a ray, ordered by the entry distance
+type wideBVHHit struct {
+	Child int32
+	Count int32
+	T     float32
+}
+
+// Traversal stack entries of a wide BVH before the stack moves to the heap
+const wideBVHStackSize = 256
+
+// Collapses the binary nodes into a wide BVH of up to width children per
+// node, which the traversal uses instead of the binary nodes. Widths of
+// 2 or less keep the binary BVH. The objects and meshes of a two-level
+// BVH are widened, the top level stays binary
+func (bvh *BVH) Widen(width int) {
+	bvh.Wide4, bvh.Wide8 = nil, nil
+	bvh.width = width
+	for _, object := range bvh.Objects {
+		if object.Instance < 0 {
+			object.BVH.Widen(width)
+		}
+	}
+	for _, mesh := range bvh.Meshes {
+		mesh.Widen(width)
+	}
+	if width <= 2 || bvh.Objects != nil {
+		return
+	}
+	if width > MaxBVHWidth {
+		width = MaxBVHWidth
+	}
+	bvh.collapse(0, width)
+}
+
+// Appends the wide node of the binary subtree at index. The interior
+// node with the largest surface area is opened until the wide node has
+// width children or only leaves remain
+func (bvh *BVH) collapse(index int32, width int) int32 {
+	wideIndex := bvh.appendWide(width)
+
+	children := make([]int32, 1, width)
+	children[0] = index
+	for len(children) < width {
+		open := -1
+		var openArea float32 = -1
+		for i, child := range children {
+			node := &bvh.Nodes[child]
+			if area := linearNodeArea(node); !node.IsLeaf() && area > openArea {
+				open, openArea = i, area
+			}
+		}
+		if open == -1 {
+			break
+		}
+		node := &bvh.Nodes[children[open]]
+		children[open]++
+		children = append(children, node.Offset)
+	}
+
+	for i, child := range children {
+		node := &bvh.Nodes[child]
+		childIndex, count := node.Offset, int32(node.Count())
+		if !node.IsLeaf() {
+			// The wide nodes may move while the child is collapsed,
+			// the node is looked up again after
+			childIndex, count = bvh.collapse(child, width), 0
+		}
+
+		wide := bvh.wideNode(wideIndex)
+		wide.minX[i], wide.minY[i], wide.minZ[i] = node.Bounds[0][0], node.Bounds[0][1], node.Bounds[0][2]
+		wide.maxX[i], wide.maxY[i], wide.maxZ[i] = node.Bounds[1][0], node.Bounds[1][1], node.Bounds[1][2]
+		wide.child[i], wide.count[i] = childIndex, count
+	}
+	*bvh.wideNode(wideIndex).children = int32(len(children))
+
+	return wideIndex
+}
+
+// Slab test of every child against the ray. The children entered before
+// tmax and left in front of the origin are written to hits nearest first,
+// returns their number
+func (node *WideBVHNode4) intersect(ray *Ray, tmax float32, hits *[MaxBVHWidth]wideBVHHit) int {
+	nearX, farX := &node.MinX, &node.MaxX
+	if ray.Sign[0] == 1 {
+		nearX, farX = farX, nearX
+	}
+	nearY, farY := &node.MinY, &node.MaxY
+	if ray.Sign[1] == 1 {
+		nearY, farY = farY, nearY
+	}
+	nearZ, farZ := &node.MinZ, &node.MaxZ
+	if ray.Sign[2] == 1 {
+		nearZ, farZ = farZ, nearZ
+	}
+
+	count := 0
+	for i := 0; i < int(node.Children); i++ {
+		t0 := (nearX[i] - ray.Origin[0]) * ray.InvDirection[0]
+		t1 := (farX[i] - ray.Origin[0]) * ray.InvDirection[0]
+		if ty0 := (nearY[i] - ray.Origin[1]) * ray.InvDirection[1]; ty0 > t0 {
+			t0 = ty0
+		}
+		if ty1 := (farY[i] - ray.Origin[1]) * ray.InvDirection[1]; ty1 < t1 {
+			t1 = ty1
+		}
+		if tz0 := (nearZ[i] - ray.Origin[2]) * ray.InvDirection[2]; tz0 > t0 {
+			t0 = tz0
+		}
+		if tz1 := (farZ[i] - ray.Origin[2]) * ray.InvDirection[2]; tz1 < t1 {
+			t1 = tz1
+		}
+		if t0 <= t1 && t0 < tmax && t1 > 0 {
+			count = insertWideHit(hits, count, wideBVHHit{Child: node.Child[i], Count: node.Count[i], T: t0})
+		}
+	}
+	return count
+}
+
+// The 8-wide node is tested like the 4-wide one
+func (node *WideBVHNode8) intersect(ray *Ray, tmax float32, hits *[MaxBVHWidth]wideBVHHit) int {
+	nearX, farX := &node.MinX, &node.MaxX
+	if ray.Sign[0] == 1 {
+		nearX, farX = farX, nearX
+	}
+	nearY, farY := &node.MinY, &node.MaxY
+	if ray.Sign[1] == 1 {
+		nearY, farY = farY, nearY
+	}
+	nearZ, farZ := &node.MinZ, &node.MaxZ
+	if ray.Sign[2] == 1 {
+		nearZ, farZ = farZ, nearZ
+	}
+
+	count := 0
+	for i := 0; i < int(node.Children); i++ {
+		t0 := (nearX[i] - ray.Origin[0]) * ray.InvDirection[0]
+		t1 := (farX[i] - ray.Origin[0]) * ray.InvDirection[0]
+		if ty0 := (nearY[i] - ray.Origin[1]) * ray.InvDirection[1]; ty0 > t0 {
+			t0 = ty0
+		}
+		if ty1 := (farY[i] - ray.Origin[1]) * ray.InvDirection[1]; ty1 < t1 {
+			t1 = ty1
+		}
+		if tz0 := (nearZ[i] - ray.Origin[2]) * ray.InvDirection[2]; tz0 > t0 {
+			t0 = tz0
+		}
+		if tz1 := (farZ[i] - ray.Origin[2]) * ray.InvDirection[2]; tz1 < t1 {
+			t1 = tz1
+		}
+		if t0 <= t1 && t0 < tmax && t1 > 0 {
+			count = insertWideHit(hits, count, wideBVHHit{Child: node.Child[i], Count: node.Count[i], T: t0})
+		}
+	}
+	return count
+}
+
+// Inserts the hit into the count hits sorted by distance, returns the
+// new count. Insertion sort, there are only a few hits
+func insertWideHit(hits *[MaxBVHWidth]wideBVHHit, count int, hit wideBVHHit) int {
+	j := count
+	for ; j > 0 && hits[j-1].T > hit.T; j-- {
+		hits[j] = hits[j-1]
+	}
+	hits[j] = hit
+	return count + 1
+}
+
+// Slab test of the children of the wide node at index
+func (bvh *BVH) intersectWideNode(index int32, ray *Ray, tmax float32, hits *[MaxBVHWidth]wideBVHHit) int {
+	if bvh.Wide4 != nil {
+		return bvh.Wide4[index].intersect(ray, tmax, hits)
+	}
+	return bvh.Wide8[index].intersect(ray, tmax, hits)
+}
+
+// Closest hit traversal of the wide BVH. The hit children are pushed
+// farthest first and popped children entered beyond the closest hit
+// found so far are skipped
+func (bvh *BVH) intersectWide(triangles []*Triangle, ray *Ray, tmin *float32, umin *float32, vmin *float32, tri **Triangle) {
+	var buffer [wideBVHStackSize]wideBVHHit
+	stack := append(buffer[:0], wideBVHHit{})
+	var hits [MaxBVHWidth]wideBVHHit
+
+	for len(stack) > 0 {
+		entry := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if entry.T >= *tmin {
+			continue
+		}
+		if entry.Count > 0 {
+			intersectLeaf(triangles[entry.Child:entry.Child+entry.Count], ray, tmin, umin, vmin, tri)
+			continue
+		}
+
+		count := bvh.intersectWideNode(entry.Child, ray, *tmin, &hits)
+		for i := count - 1; i >= 0; i-- {
+			stack = append(stack, hits[i])
+		}
+	}
+}
+
+// Any-hit traversal of the wide BVH, nearer children first
+func (bvh *BVH) occludedWide(triangles []*Triangle, ray *Ray, tmax float32, ignoreEmitters bool) bool {
+	var buffer [wideBVHStackSize]wideBVHHit
+	stack := append(buffer[:0], wideBVHHit{})
+	var hits [MaxBVHWidth]wideBVHHit
+
+	for len(stack) > 0 {
+		entry := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if entry.Count > 0 {
+			if occludedLeaf(triangles[entry.Child:entry.Child+entry.Count], ray, tmax, ignoreEmitters) {
+				return true
+			}
+			continue
+		}
+
+		count := bvh.intersectWideNode(entry.Child, ray, tmax, &hits)
+		for i := count - 1; i >= 0; i-- {
+			stack = append(stack, hits[i])
+		}
+	}
+	return false
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"math"
+	"math/rand"
 
 	"github.com/go-gl/mathgl/mgl32"
 	"gonum.org/v1/gonum/mat"
@@ -16,8 +17,39 @@ const (
 	Ortographic
 )
 
+type StereoMode int
+
+const (
+	Mono StereoMode = iota
+	// Off-axis perspective (or shifted ortographic) projection per eye
+	OffAxisStereo
+	// Omni-directional stereo, equirectangular projection per eye
+	OmniDirectionalStereo
+)
+
+type StereoLayout int
+
+const (
+	// Both eyes in one image, left eye on the left half
+	SideBySide StereoLayout = iota
+	// Both eyes in one image, left eye on the top half
+	TopBottom
+	// Only Camera.Eye is rendered, using the whole image
+	SingleEye
+)
+
+type Eye int
+
+const (
+	LeftEye Eye = iota
+	RightEye
+)
+
 type Camera struct {
-	Transform               mgl32.Mat4
+	Transform mgl32.Mat4
+	// Transform at the end of the frame interval for motion blur.
+	// Left empty for a static camera
+	EndTransform            mgl32.Mat4
 	ProjectionPlaneDistance float32
 	RaysPerPixel            int
 	Projection              ProjectionType
@@ -30,6 +62,41 @@ type Camera struct {
 	// Half-height of the projection plane
 	OrtographicSize float32
 
+	// Stereoscopic rendering
+	Stereo       StereoMode
+	StereoLayout StereoLayout
+	Eye          Eye
+	// Distance between the eyes in world units
+	InterocularDistance float32
+	// Distance where the eyes converge. Objects at this distance
+	// have no parallax. Zero or less means parallel eyes
+	ZeroParallaxDistance float32
+
+	// Physical camera exposure, used when PhysicalExposure is set.
+	// Shutter speed is in seconds
+	PhysicalExposure bool
+	ISO              float32
+	ShutterSpeed     float32
+	FStop            float32
+	// Exposure metered from the rendered image
+	AutoExposure bool
+	// White balance in Kelvin, zero or less disables it
+	WhiteBalance float32
+
+	// Lens imperfections. Chromatic aberration is the relative lateral
+	// magnification of the red channel, blue is magnified by the negation
+	Distortion          LensDistortion
+	Vignetting          bool
+	ChromaticAberration float32
+
+	// Size of the image of a single eye
+	eyeWidth  int
+	eyeHeight int
+
+	motion       *MotionTransform
+	shutterOpen  float32
+	shutterClose float32
+
 	projectionPlaneTopLeft mgl32.Vec3
 	horizontalStep         float32
 	verticalStep           float32
@@ -43,14 +110,34 @@ type Camera struct {
 func (camera *Camera) Initialize(totalWidth int, totalHeight int) {
 	// Create sampler
 	camera.maxSamples = 12345
-	camera.batch = mat.NewDense(camera.maxSamples, 2, nil)
+	camera.batch = mat.NewDense(camera.maxSamples, 4, nil)
 	camera.sampler = &samplemv.Halton{
 		Kind: samplemv.Owen,
-		Q:    distmv.NewUnitUniform(2, nil),
+		Q:    distmv.NewUnitUniform(4, nil),
 	}
 
 	camera.sampler.Sample(camera.batch)
 
+	camera.motion = NewMotionTransform(camera.Transform, camera.EndTransform)
+
+	camera.eyeWidth = totalWidth
+	camera.eyeHeight = totalHeight
+	if camera.Stereo != Mono {
+		if camera.StereoLayout == SideBySide {
+			camera.eyeWidth = totalWidth / 2
+		} else if camera.StereoLayout == TopBottom {
+			camera.eyeHeight = totalHeight / 2
+		}
+	}
+	if camera.eyeWidth < 1 {
+		camera.eyeWidth = 1
+	}
+	if camera.eyeHeight < 1 {
+		camera.eyeHeight = 1
+	}
+	totalWidth = camera.eyeWidth
+	totalHeight = camera.eyeHeight
+
 	var projectionPlaneTopLeft mgl32.Vec3
 	var projectionPlaneBottomRight mgl32.Vec3
 
@@ -84,11 +171,15 @@ func (camera *Camera) Initialize(totalWidth int, totalHeight int) {
 	camera.projectionPlaneTopLeft = projectionPlaneTopLeft
 }
 
-func (camera *Camera) samplePixel() mgl32.Vec2 {
+// Returns the subpixel position, the shutter time sample and
+// the lens channel sample
+func (camera *Camera) samplePixel() mgl32.Vec4 {
 	// Get Halton sample
-	sample := mgl32.Vec2{
+	sample := mgl32.Vec4{
 		float32(camera.batch.At(camera.index, 0)),
 		float32(camera.batch.At(camera.index, 1)),
+		float32(camera.batch.At(camera.index, 2)),
+		float32(camera.batch.At(camera.index, 3)),
 	}
 
 	camera.index = (camera.index + 1) % camera.maxSamples
@@ -96,34 +187,171 @@ func (camera *Camera) samplePixel() mgl32.Vec2 {
 	return sample
 }
 
-func (camera *Camera) GetCameraRay(xoffset int, yoffset int, x int, y int) *Ray {
+// Position in the pixel sample sequence, stored in checkpoints
+func (camera *Camera) SampleIndex() int {
+	return camera.index
+}
+
+func (camera *Camera) SetSampleIndex(index int) {
+	camera.index = index % camera.maxSamples
+}
+
+// Restarts the pixel samples from a sequence scrambled by the seed,
+// so that the same samples can be taken again
+func (camera *Camera) SetSampleSeed(seed int64) {
+	camera.sampler.Src = newSampleSource(seed)
+	camera.batch.Zero()
+	camera.sampler.Sample(camera.batch)
+	camera.index = 0
+}
 
-	var dir mgl32.Vec3
+// Seeded source of the Halton sequence scrambling, which uses
+// its own random numbers otherwise
+type sampleSource struct {
+	rng *rand.Rand
+}
 
-	/*
-		rx := rand.Float32()*0.5 - 1
-		ry := rand.Float32()*0.5 - 1
+func newSampleSource(seed int64) *sampleSource {
+	return &sampleSource{rng: rand.New(rand.NewSource(seed))}
+}
 
-		lx := camera.projectionPlaneTopLeft.X() + camera.horizontalStep*(float32(xoffset+x)+rx)
-		ly := camera.projectionPlaneTopLeft.Y() - camera.verticalStep*(float32(yoffset+y)+ry)
-	*/
+func (source *sampleSource) Uint64() uint64 {
+	return source.rng.Uint64()
+}
 
-	sample := camera.samplePixel()
-	lx := camera.projectionPlaneTopLeft.X() + camera.horizontalStep*(float32(xoffset+x)+sample.X())
-	ly := camera.projectionPlaneTopLeft.Y() - camera.verticalStep*(float32(yoffset+y)+sample.Y())
+func (source *sampleSource) Seed(seed uint64) {
+	source.rng.Seed(int64(seed))
+}
 
-	originCameraSpace := mgl32.Vec3{lx, ly, -camera.ProjectionPlaneDistance}
-	origin := mgl32.TransformCoordinate(originCameraSpace, camera.Transform)
+// Maps a pixel of the whole image to the eye and the pixel within
+// the image of that eye
+func (camera *Camera) eyePixel(x int, y int) (Eye, int, int) {
+	if camera.Stereo == Mono {
+		return LeftEye, x, y
+	}
 
-	if camera.Projection == Perspective {
-		// Camera local origin is always at 0,0,0 so the normalized
-		// ray origin is it's direction
-		dir = origin.Sub(camera.Transform.Col(3).Vec3()).Normalize()
+	switch camera.StereoLayout {
+	case SideBySide:
+		if x >= camera.eyeWidth {
+			return RightEye, x - camera.eyeWidth, y
+		}
+		return LeftEye, x, y
+	case TopBottom:
+		if y >= camera.eyeHeight {
+			return RightEye, x, y - camera.eyeHeight
+		}
+		return LeftEye, x, y
+	}
+
+	return camera.Eye, x, y
+}
+
+// Horizontal offset of the eye from the camera center in camera space
+func (camera *Camera) eyeOffset(eye Eye) float32 {
+	if camera.Stereo == Mono {
+		return 0
+	}
+	if eye == LeftEye {
+		return -camera.InterocularDistance / 2.0
+	}
+	return camera.InterocularDistance / 2.0
+}
+
+func (camera *Camera) GetCameraRay(xoffset int, yoffset int, x int, y int) *Ray {
+	eye, px, py := camera.eyePixel(xoffset+x, yoffset+y)
+	sample := camera.samplePixel()
+
+	var origin, dir mgl32.Vec3
+	weight := mgl32.Vec3{1, 1, 1}
+	if camera.Stereo == OmniDirectionalStereo {
+		origin, dir = camera.omniDirectionalRay(eye, float32(px)+sample.X(), float32(py)+sample.Y())
 	} else {
-		dir = mgl32.TransformCoordinate(mgl32.Vec3{0, 0, -1}, camera.Transform).Sub(camera.Transform.Col(3).Vec3()).Normalize()
+		lx, ly, lensWeight := camera.applyLens(float32(px)+sample.X(), float32(py)+sample.Y(), sample.W())
+		origin, dir = camera.planarRay(eye, lx, ly)
+		weight = lensWeight
+		if camera.Vignetting && camera.Projection == Perspective {
+			weight = weight.Mul(vignetting(dir))
+		}
 	}
 
+	time := camera.shutterOpen + (camera.shutterClose-camera.shutterOpen)*sample.Z()
+	transform := camera.motion.At(time)
+
+	origin = mgl32.TransformCoordinate(origin, transform)
+	dir = mgl32.TransformNormal(dir, transform).Normalize()
+
 	ray := NewRay(origin, dir, 0, x-xoffset, y-yoffset)
+	ray.Time = time
+	ray.Weight = weight
+	ray.PixelSample = sample.Vec2()
 
 	return ray
 }
+
+// Returns the camera space ray through the projection plane for the
+// given continuous pixel coordinates of an eye image
+func (camera *Camera) planarRay(eye Eye, px float32, py float32) (mgl32.Vec3, mgl32.Vec3) {
+	lx := camera.projectionPlaneTopLeft.X() + camera.horizontalStep*px
+	ly := camera.projectionPlaneTopLeft.Y() - camera.verticalStep*py
+
+	// Camera local origin is always at 0,0,0 so the normalized
+	// ray origin is it's direction
+	origin := mgl32.Vec3{lx, ly, -camera.ProjectionPlaneDistance}
+	dir := mgl32.Vec3{0, 0, -1}
+	if camera.Projection == Perspective {
+		dir = origin.Normalize()
+	}
+
+	offset := camera.eyeOffset(eye)
+	if offset == 0 {
+		return origin, dir
+	}
+
+	eyePosition := mgl32.Vec3{offset, 0, 0}
+	if camera.ZeroParallaxDistance <= 0 {
+		// Parallel eyes
+		return origin.Add(eyePosition), dir
+	}
+
+	// Point on the zero parallax plane seen through the pixel from the camera
+	// center. Both eyes see it at the same pixel, which gives the off-axis frustum
+	depth := (camera.ZeroParallaxDistance - camera.ProjectionPlaneDistance) / -dir.Z()
+	target := origin.Add(dir.Mul(depth))
+
+	if camera.Projection == Perspective {
+		dir = target.Sub(eyePosition).Normalize()
+		origin = eyePosition.Add(dir.Mul(camera.ProjectionPlaneDistance / -dir.Z()))
+		return origin, dir
+	}
+
+	origin = origin.Add(eyePosition)
+	dir = target.Sub(origin).Normalize()
+	return origin, dir
+}
+
+// Returns the camera space ray of an omni-directional stereo equirectangular
+// projection for the given continuous pixel coordinates of an eye image
+func (camera *Camera) omniDirectionalRay(eye Eye, px float32, py float32) (mgl32.Vec3, mgl32.Vec3) {
+	theta := (px/float32(camera.eyeWidth) - 0.5) * 2.0 * math.Pi
+	phi := (0.5 - py/float32(camera.eyeHeight)) * math.Pi
+
+	sinTheta, cosTheta := math.Sincos(float64(theta))
+	sinPhi, cosPhi := math.Sincos(float64(phi))
+
+	dir := mgl32.Vec3{
+		float32(sinTheta * cosPhi),
+		float32(sinPhi),
+		float32(-cosTheta * cosPhi),
+	}
+
+	// Eyes lie on a horizontal circle with diameter of the interocular
+	// distance, the ray origin is tangential to the view direction
+	right := mgl32.Vec3{float32(cosTheta), 0, float32(sinTheta)}
+	origin := right.Mul(camera.eyeOffset(eye))
+
+	if camera.ZeroParallaxDistance > 0 && origin.LenSqr() > 0 {
+		dir = dir.Mul(camera.ZeroParallaxDistance).Sub(origin).Normalize()
+	}
+
+	return origin, dir
+}
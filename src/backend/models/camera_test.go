@@ -0,0 +1,81 @@
+package models
+
+import (
+	"math"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func TestStereoOffAxisConvergence(t *testing.T) {
+	camera := Camera{
+		Transform:               mgl32.Ident4(),
+		ProjectionPlaneDistance: 1,
+		FieldOfView:             45,
+		Stereo:                  OffAxisStereo,
+		StereoLayout:            SideBySide,
+		InterocularDistance:     0.064,
+		ZeroParallaxDistance:    5,
+	}
+	camera.Initialize(200, 100)
+
+	// Same pixel in both eyes, left eye on the left half
+	left, leftDir := camera.planarRay(LeftEye, 50, 50)
+	right, rightDir := camera.planarRay(RightEye, 50, 50)
+
+	if eye, x, _ := camera.eyePixel(150, 50); eye != RightEye || x != 50 {
+		t.Errorf("Side-by-side pixel mapping not working, got eye %v x %v", eye, x)
+	}
+
+	// Both rays should reach the same point at the zero parallax distance
+	leftPoint := left.Add(leftDir.Mul((5 + left.Z()) / -leftDir.Z()))
+	rightPoint := right.Add(rightDir.Mul((5 + right.Z()) / -rightDir.Z()))
+	if leftPoint.Sub(rightPoint).Len() > 0.0001 {
+		t.Errorf("Stereo rays do not converge, left %v right %v", leftPoint, rightPoint)
+	}
+	if math.Abs(float64(left.X()-right.X())) < 0.001 {
+		t.Errorf("Stereo ray origins are not separated")
+	}
+}
+
+func TestStereoOmniDirectionalForward(t *testing.T) {
+	camera := Camera{
+		Transform:           mgl32.Ident4(),
+		Stereo:              OmniDirectionalStereo,
+		StereoLayout:        TopBottom,
+		InterocularDistance: 0.064,
+	}
+	camera.Initialize(400, 400)
+
+	// Center of the equirectangular image looks forward
+	origin, dir := camera.omniDirectionalRay(LeftEye, 200, 100)
+	if dir.Sub(mgl32.Vec3{0, 0, -1}).Len() > 0.0001 {
+		t.Errorf("ODS center direction not forward, got %v", dir)
+	}
+	if math.Abs(float64(origin.X()+0.032)) > 0.0001 {
+		t.Errorf("ODS left eye origin not offset, got %v", origin)
+	}
+}
+
+func TestLensDistortionRoundTrip(t *testing.T) {
+	distortion := LensDistortion{K1: -0.12, K2: 0.03, P1: 0.001, P2: -0.002}
+
+	p := mgl32.Vec2{0.6, -0.4}
+	undistorted := distortion.Undistort(distortion.Distort(p))
+	if undistorted.Sub(p).Len() > 0.0001 {
+		t.Errorf("Lens distortion inverse not working, got %v expected %v", undistorted, p)
+	}
+}
+
+func TestSTMapIdentityWithoutDistortion(t *testing.T) {
+	camera := Camera{Transform: mgl32.Ident4(), ProjectionPlaneDistance: 1, FieldOfView: 45}
+	camera.Initialize(64, 32)
+
+	stmap := camera.STMap()
+	c := stmap.NRGBA64At(0, 31)
+	s := float64(c.R) / 65535
+	tc := float64(c.G) / 65535
+	if math.Abs(s-0.5/64) > 0.001 || math.Abs(tc-0.5/32) > 0.001 {
+		t.Errorf("ST-map of an ideal lens should be identity, got %v %v", s, tc)
+	}
+}
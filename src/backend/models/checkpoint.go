@@ -0,0 +1,104 @@
+package models
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Checkpoint file header. The version is increased whenever
+// the encoded state changes
+const (
+	checkpointMagic   = "RTCK"
+	CheckpointVersion = 1
+)
+
+var ErrCheckpointMismatch = errors.New("checkpoint does not match the scene")
+
+// Serializable state of an incremental render
+type Checkpoint struct {
+	Version     int
+	ContentHash string
+
+	Pass RenderPass
+	Film *Film
+
+	// Completed sample rounds and the positions of the samplers
+	Rounds            int
+	CameraSampleIndex int
+	LightSampleIndex  int
+}
+
+func WriteCheckpoint(w io.Writer, checkpoint *Checkpoint) error {
+	checkpoint.Version = CheckpointVersion
+	return writeVersioned(w, checkpointMagic, CheckpointVersion, checkpoint)
+}
+
+func ReadCheckpoint(r io.Reader) (*Checkpoint, error) {
+	checkpoint := &Checkpoint{}
+	if err := readVersioned(r, checkpointMagic, CheckpointVersion, checkpoint); err != nil {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+// Writes the file header of magic bytes and version followed by the gob encoded value
+func writeVersioned(w io.Writer, magic string, version int, v interface{}) error {
+	writer := bufio.NewWriter(w)
+	if err := writeHeader(writer, magic, version); err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(writer).Encode(v); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// Reads a value written by writeVersioned, refusing other file types and versions
+func readVersioned(r io.Reader, magic string, version int, v interface{}) error {
+	reader := bufio.NewReader(r)
+	if err := readHeader(reader, magic, version); err != nil {
+		return err
+	}
+	return gob.NewDecoder(reader).Decode(v)
+}
+
+func writeHeader(w io.Writer, magic string, version int) error {
+	if _, err := io.WriteString(w, magic); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, uint32(version))
+}
+
+func readHeader(r io.Reader, magic string, version int) error {
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if string(header) != magic {
+		return fmt.Errorf("not a %s file", magic)
+	}
+
+	var fileVersion uint32
+	if err := binary.Read(r, binary.LittleEndian, &fileVersion); err != nil {
+		return err
+	}
+	if fileVersion != uint32(version) {
+		return fmt.Errorf("unsupported %s version %d, expected %d", magic, fileVersion, version)
+	}
+	return nil
+}
+
+// Returns an error if the checkpoint was not rendered from the given scene
+func (checkpoint *Checkpoint) Validate(context *RenderContext) error {
+	if checkpoint.ContentHash != context.ContentHash() {
+		return ErrCheckpointMismatch
+	}
+	if checkpoint.Film == nil || !checkpoint.Film.HasSize(checkpoint.Pass.Width, checkpoint.Pass.Height) {
+		return fmt.Errorf("checkpoint film does not match the render pass")
+	}
+	return nil
+}
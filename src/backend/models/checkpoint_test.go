@@ -0,0 +1,67 @@
+package models
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func checkpointTestContext() *RenderContext {
+	return &RenderContext{
+		Triangles: []*Triangle{
+			{Vertices: [3]mgl32.Vec3{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}}},
+		},
+	}
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	context := checkpointTestContext()
+	film := NewFilm(2, 1, NewFilter(GaussianFilter, 0))
+	film.AddPixelSample(1, 0, mgl32.Vec3{0.5, 1, 2}, nil)
+
+	checkpoint := &Checkpoint{
+		ContentHash:       context.ContentHash(),
+		Pass:              RenderPass{Width: 2, Height: 1, RNGSeed: 42},
+		Film:              film,
+		Rounds:            3,
+		CameraSampleIndex: 7,
+	}
+
+	var buffer bytes.Buffer
+	if err := WriteCheckpoint(&buffer, checkpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadCheckpoint(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := read.Validate(context); err != nil {
+		t.Errorf("Checkpoint should match its scene: %v", err)
+	}
+	if read.Rounds != 3 || read.CameraSampleIndex != 7 || read.Pass.RNGSeed != 42 {
+		t.Errorf("Checkpoint state not restored: %+v", read)
+	}
+	if read.Film.Colors[1] != film.Colors[1] || read.Film.Samples[1] != 1 {
+		t.Errorf("Film not restored: %v, expected %v", read.Film.Colors[1], film.Colors[1])
+	}
+}
+
+func TestCheckpointRejectsOtherScene(t *testing.T) {
+	context := checkpointTestContext()
+	checkpoint := &Checkpoint{
+		ContentHash: context.ContentHash(),
+		Pass:        RenderPass{Width: 1, Height: 1},
+		Film:        NewFilm(1, 1, NewFilter(BoxFilter, 0)),
+	}
+
+	context.Triangles[0].Vertices[2] = mgl32.Vec3{0, 2, 0}
+	if err := checkpoint.Validate(context); err != ErrCheckpointMismatch {
+		t.Errorf("Checkpoint of a different scene should be rejected, got %v", err)
+	}
+
+	if _, err := ReadCheckpoint(bytes.NewReader([]byte("RTCX\x01\x00\x00\x00"))); err == nil {
+		t.Error("File without the checkpoint header should be rejected")
+	}
+}
@@ -1,7 +1,10 @@
 package models
 
 import (
+	"fmt"
+	"image"
 	"math"
+	"math/rand"
 	"raytracer/utility"
 
 	"github.com/go-gl/mathgl/mgl32"
@@ -13,19 +16,45 @@ type RenderContext struct {
 	Scene         Scene
 	ObjBuffer     string
 	MtlBuffer     string
+	LUTBuffer     string
 	RawTextures   []Texture
 	Object        *gwob.Obj
 	MaterialLib   *gwob.MaterialLib
 	DebugMaterial *gwob.Material
 	Triangles     []*Triangle
+	Groups        []TriangleGroup
+	Meshes        []*Mesh
+	Instances     []*Instance
 	Light         *AreaLight
+	LUT           *LUT3D
 	WorkerID      int
 
 	UseBVH         bool
 	BVHMaxLeafSize int
 	BVHMaxDepth    int
+	// Split plane search and the bins per axis of the binned builder
+	BVHBuilder BVHBuilder
+	BVHBins    int
+	// Overlap threshold of the spatial builder, relative to the scene area.
+	// DefaultBVHSplitAlpha if not set
+	BVHSplitAlpha *float32
+	// Threads building the BVH, every CPU if not set. The BVH does not
+	// depend on the thread count
+	BVHThreads int
+	// Builds a BVH per OBJ group under a top-level BVH, so that moving
+	// a group only refits its own BVH
+	BVHTwoLevel bool
+	// Relative growth of the SAH cost by refits that rebuilds the BVH,
+	// DefaultBVHRebuildThreshold if not set
+	BVHRebuildThreshold float32
+	// Children per node of the traversed BVH, 4 or 8 collapse the
+	// binary BVH into a wide one
+	BVHWidth int
 
 	BVH *BVH
+	// Scene triangles and instances moved since the BVH was built or refit
+	moved          []bool
+	instancesMoved bool
 
 	// Statistics
 	Rays                uint64
@@ -34,7 +63,11 @@ type RenderContext struct {
 
 	TextureLookup map[string]*Texture
 
+	// Polled between scanlines, a render stops early when it returns true
+	Cancelled func() bool `json:"-"`
+
 	useDebugLight bool
+	movingLight   bool
 }
 
 type RenderPass struct {
@@ -49,6 +82,37 @@ type RenderPass struct {
 	Height      int
 	Settings    RenderSettings
 	RenderKey   int
+
+	// Shutter interval within the frame interval [0, 1]
+	ShutterOpen  float32
+	ShutterClose float32
+
+	// Auto exposure metered once over the whole frame, so that all tiles
+	// of the frame are developed alike. Passes without it meter their colors
+	MeteredEV100 *float32
+
+	// Region of the results within the rendered region, when pixels around
+	// them are rendered for the denoiser. Empty for the whole region
+	Output image.Rectangle
+
+	random *rand.Rand
+}
+
+// Source of the random numbers of the pass. Nil uses the global source
+func (pass *RenderPass) Random() *rand.Rand {
+	return pass.random
+}
+
+func (pass *RenderPass) SetRandom(random *rand.Rand) {
+	pass.random = random
+}
+
+// Size of the results of the pass
+func (pass *RenderPass) OutputSize() (int, int) {
+	if pass.Output.Empty() {
+		return pass.Width, pass.Height
+	}
+	return pass.Output.Dx(), pass.Output.Dy()
 }
 
 func (context *RenderContext) Initialize(rawTextureData []*[]byte) error {
@@ -58,6 +122,18 @@ func (context *RenderContext) Initialize(rawTextureData []*[]byte) error {
 	context.BVHNodeTriangles = 0
 
 	context.Scene.LinkMaterials()
+
+	if len(context.LUTBuffer) > 0 {
+		lut, err := ParseCubeLUT(context.LUTBuffer)
+		if err != nil {
+			return err
+		}
+		context.LUT = lut
+		context.LUTBuffer = ""
+	}
+	for i := range context.Scene.Motions {
+		context.Scene.Motions[i].Initialize()
+	}
 	if len(context.ObjBuffer) > 0 && len(context.MtlBuffer) > 0 {
 		optionsLogger := &gwob.ObjParserOptions{LogStats: context.Debug, Logger: func(msg string) { println(msg) }}
 		//options := &gwob.ObjParserOptions{LogStats: context.Debug, Logger: nil}
@@ -94,8 +170,14 @@ func (context *RenderContext) Initialize(rawTextureData []*[]byte) error {
 		context.TextureLookup = make(map[string]*Texture)
 		for i, texture := range context.RawTextures {
 			// Read the texture
-			rawData := rawTextureData[i]
-			t := NewTexture(texture.Name, rawData)
+			var rawData *[]byte
+			if i < len(rawTextureData) {
+				rawData = rawTextureData[i]
+			}
+			t, err := NewTexture(texture.Name, rawData)
+			if err != nil {
+				return err
+			}
 			context.TextureLookup[texture.Name] = t
 		}
 
@@ -105,6 +187,8 @@ func (context *RenderContext) Initialize(rawTextureData []*[]byte) error {
 		// Build triangles
 		// TODO: Preallocate triangle array length
 		context.Triangles = make([]*Triangle, 0)
+		context.Groups = make([]TriangleGroup, 0, len(context.Object.Groups))
+		context.initializeMeshes()
 
 		for _, group := range context.Object.Groups {
 			// Each group is an independent object
@@ -115,7 +199,17 @@ func (context *RenderContext) Initialize(rawTextureData []*[]byte) error {
 
 			//println("Group", group.Name, group.IndexBegin, group.IndexCount)
 
+			motion := context.Scene.GroupMotion(group.Name)
+
+			// Instanced groups are built once into their mesh
+			triangles := &context.Triangles
+			mesh := context.mesh(group.Name)
+			if mesh != nil {
+				triangles = &mesh.Triangles
+			}
+
 			triangleIndex := 0
+			groupStart := len(context.Triangles)
 
 			for index := group.IndexBegin; index < group.IndexBegin+group.IndexCount; index += 3 {
 				strideIndex0 := context.Object.Indices[index]
@@ -161,64 +255,30 @@ func (context *RenderContext) Initialize(rawTextureData []*[]byte) error {
 					{t1u, t1v},
 					{t2u, t2v},
 				}
+				tri.SetMotion(motion)
 				triangleIndex++
 
-				context.Triangles = append(context.Triangles, tri)
+				*triangles = append(*triangles, tri)
+			}
+
+			if mesh != nil {
+				continue
 			}
+			context.Groups = append(context.Groups, TriangleGroup{
+				Name:  group.Name,
+				Start: groupStart,
+				Count: len(context.Triangles) - groupStart,
+			})
 		}
 
 		context.Object = nil
-
-		// Parse the area light
-		var minx, miny, minz float32 = math.MaxFloat32, math.MaxFloat32, math.MaxFloat32
-		var maxx, maxy, maxz float32 = -math.MaxFloat32, -math.MaxFloat32, -math.MaxFloat32
-		var normal mgl32.Vec3
-		var up mgl32.Vec3
-		var shortestSide mgl32.Vec3
-		var middleSide mgl32.Vec3
-		var found bool
-		for _, triangle := range context.Triangles {
-			if triangle.Material.Name == "Light" {
-				found = true
-				normal = triangle.Normal
-				// Choose the edge to cross normal with to find up
-				// as the edge that is shortest. Up will then
-				// point from the middle of the arealight towards
-				// the long axis
-				shortestSide = triangle.GetShortestEdge()
-				middleSide = triangle.GetMiddleEdge()
-				up = shortestSide.Cross(triangle.Normal).Normalize()
-				for _, vertex := range triangle.Vertices {
-					if vertex.X() < minx {
-						minx = vertex.X()
-					}
-					if vertex.Y() < miny {
-						miny = vertex.Y()
-					}
-					if vertex.Z() < minz {
-						minz = vertex.Z()
-					}
-					if vertex.X() > maxx {
-						maxx = vertex.X()
-					}
-					if vertex.Y() > maxy {
-						maxy = vertex.Y()
-					}
-					if vertex.Z() > maxz {
-						maxz = vertex.Z()
-					}
-				}
-			}
+		if err := context.initializeInstances(); err != nil {
+			return err
 		}
 
+		// Parse the area light
+		transform, size, normal, found := context.lightGeometry(0)
 		if found {
-			center := mgl32.Vec3{(minx + maxx) / 2.0, (miny + maxy) / 2.0, (minz + maxz) / 2.0}
-
-			//transform := mgl32.LookAtV(normal, center, up).Inv()
-			transform := mgl32.Translate3D(center.X(), center.Y(), center.Z())
-			transform = transform.Mul4(mgl32.Mat3FromCols(normal.Cross(up), up, normal).Mat4())
-
-			size := mgl32.Vec2{shortestSide.Len() / 2.0, middleSide.Len() / 2.0}
 			emission := mgl32.Vec3{100, 100, 100} // Overriden in render pass Initialize()
 
 			light := NewAreaLight(transform, size, emission, normal)
@@ -233,13 +293,78 @@ func (context *RenderContext) Initialize(rawTextureData []*[]byte) error {
 	return nil
 }
 
+func (context *RenderContext) IsCancelled() bool {
+	return context.Cancelled != nil && context.Cancelled()
+}
+
 func (context *RenderContext) BuildBVH() *BVH {
 	return BuildBVH(context)
 }
 
-func (context *RenderContext) LoadBVH(bvh *BVH) {
+// Validates a BVH built for the scene, usually by another worker or
+// read from a cache, and reorders the triangles to the BVH order
+func (context *RenderContext) LoadBVH(bvh *BVH) error {
+	triangles := context.sceneTriangles()
+
+	if bvh.MeshHash != context.MeshHash() {
+		return fmt.Errorf("BVH was built for another mesh or build settings: %w", ErrBVHMismatch)
+	}
+	if len(bvh.Permutation) < len(triangles) {
+		return fmt.Errorf("BVH has %d of %d triangles: %w", len(bvh.Permutation), len(triangles), ErrBVHMismatch)
+	}
+	if err := bvh.linkInstances(context); err != nil {
+		return err
+	}
+	if err := bvh.Validate(len(bvh.Permutation)); err != nil {
+		return err
+	}
+
+	ordered, err := context.orderTriangles(triangles, bvh.Permutation)
+	if err != nil {
+		return err
+	}
+	meshes := make([][]*Triangle, len(context.Meshes))
+	for i := range context.Meshes {
+		meshes[i], err = context.orderTriangles(context.sceneMeshTriangles(i), bvh.Meshes[i].Permutation)
+		if err != nil {
+			return fmt.Errorf("BVH mesh %d: %w", i, err)
+		}
+		bvh.Meshes[i].BuildCost = bvh.Meshes[i].SAHCost()
+	}
+
+	bvh.BuildCost = bvh.SAHCost()
+	bvh.Widen(context.BVHWidth)
+	context.Triangles = ordered
+	for i, mesh := range context.Meshes {
+		mesh.Triangles = meshes[i]
+	}
 	context.BVH = bvh
-	context.BVH.Load(context.Triangles)
+	context.moved = nil
+	context.instancesMoved = false
+	return nil
+}
+
+// Returns the triangles in the order of the permutation, which has to
+// reference every triangle
+func (context *RenderContext) orderTriangles(triangles []*Triangle, permutation []int32) ([]*Triangle, error) {
+	// Only the spatial builder references triangles more than once
+	ordered := make([]*Triangle, len(permutation))
+	seen := make([]bool, len(triangles))
+	seenCount := 0
+	for i, index := range permutation {
+		if index < 0 || int(index) >= len(triangles) || (seen[index] && context.BVHBuilder != SpatialBVHBuilder) {
+			return nil, fmt.Errorf("BVH triangle index %d is invalid: %w", index, ErrBVHMismatch)
+		}
+		if !seen[index] {
+			seen[index] = true
+			seenCount++
+		}
+		ordered[i] = triangles[index]
+	}
+	if seenCount != len(triangles) {
+		return nil, fmt.Errorf("BVH references %d of %d triangles: %w", seenCount, len(triangles), ErrBVHMismatch)
+	}
+	return ordered, nil
 }
 
 func (pass *RenderPass) Initialize(context *RenderContext) {
@@ -254,6 +379,12 @@ func (pass *RenderPass) Initialize(context *RenderContext) {
 		pass.Camera.Transform = mgl32.Ident4()
 	}
 
+	if pass.ShutterClose < pass.ShutterOpen {
+		pass.ShutterClose = pass.ShutterOpen
+	}
+	pass.Camera.shutterOpen = pass.ShutterOpen
+	pass.Camera.shutterClose = pass.ShutterClose
+
 	if context.useDebugLight || pass.Settings.ForceDebugLight {
 		var transform mgl32.Mat4
 		if pass.Settings.DebugLightAtCamera {
@@ -271,5 +402,11 @@ func (pass *RenderPass) Initialize(context *RenderContext) {
 		context.Light = light
 	} else {
 		context.Light.Emission = mgl32.Vec3{1, 1, 1}.Mul(pass.Settings.LightIntensity)
+
+		// A moving light is placed at the middle of the shutter interval
+		if context.movingLight {
+			transform, size, normal, _ := context.lightGeometry((pass.ShutterOpen + pass.ShutterClose) / 2)
+			context.Light.Transform, context.Light.Size, context.Light.Normal = transform, size, normal
+		}
 	}
 }
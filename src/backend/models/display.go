@@ -0,0 +1,186 @@
+package models
+
+import (
+	"math"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+type ToneMapper int
+
+const (
+	// Values above 1 are clipped
+	ClampToneMapper ToneMapper = iota
+	ReinhardToneMapper
+	ExtendedReinhardToneMapper
+	HableToneMapper
+	ACESFittedToneMapper
+	AgXToneMapper
+)
+
+type OutputEncoding int
+
+const (
+	// Optional power curve from RenderSettings.Gamma
+	GammaEncoding OutputEncoding = iota
+	SRGBEncoding
+	Rec709Encoding
+	DisplayP3Encoding
+)
+
+// Default white point of the extended Reinhard operator
+const defaultWhitePoint = 4.0
+
+// Hable filmic curve parameters and linear white point
+const (
+	hableA     = 0.15
+	hableB     = 0.50
+	hableC     = 0.10
+	hableD     = 0.20
+	hableE     = 0.02
+	hableF     = 0.30
+	hableWhite = 11.2
+	hableBias  = 2.0
+)
+
+// ACES fitted (Stephen Hill) input and output matrices in linear sRGB
+var acesInput = mgl32.Mat3{
+	0.59719, 0.07600, 0.02840,
+	0.35458, 0.90834, 0.13383,
+	0.04823, 0.01566, 0.83777,
+}
+var acesOutput = mgl32.Mat3{
+	1.60475, -0.10208, -0.00327,
+	-0.53108, 1.10813, -0.07276,
+	-0.07367, -0.00605, 1.07602,
+}
+
+// AgX inset matrix and log2 encoding range
+var agxInset = mgl32.Mat3{
+	0.842479062253094, 0.0423282422610123, 0.0423756549057051,
+	0.0784335999999992, 0.878468636469772, 0.0784336,
+	0.0792237451477643, 0.0791661274605434, 0.879142973793104,
+}
+var agxOutset = agxInset.Inv()
+
+const (
+	agxMinEV = -12.47393
+	agxMaxEV = 4.026069
+)
+
+// Linear sRGB to linear Display P3
+var srgbToP3 = mgl32.Mat3{
+	0.8224621, 0.0331941, 0.0170827,
+	0.1775380, 0.9668058, 0.0723974,
+	0.0000000, 0.0000000, 0.9105199,
+}
+
+// Maps linear scene colors to linear display colors in [0, 1]
+func ToneMap(c mgl32.Vec3, toneMapper ToneMapper, whitePoint float32) mgl32.Vec3 {
+	c = mgl32.Vec3{
+		float32(math.Max(float64(c.X()), 0)),
+		float32(math.Max(float64(c.Y()), 0)),
+		float32(math.Max(float64(c.Z()), 0)),
+	}
+
+	switch toneMapper {
+	case ReinhardToneMapper:
+		c = mapChannels(c, func(x float64) float64 {
+			return x / (1 + x)
+		})
+	case ExtendedReinhardToneMapper:
+		white := float64(whitePoint)
+		if white <= 0 {
+			white = defaultWhitePoint
+		}
+		c = mapChannels(c, func(x float64) float64 {
+			return x * (1 + x/(white*white)) / (1 + x)
+		})
+	case HableToneMapper:
+		scale := 1.0 / hable(hableWhite)
+		c = mapChannels(c, func(x float64) float64 {
+			return hable(x*hableBias) * scale
+		})
+	case ACESFittedToneMapper:
+		c = acesInput.Mul3x1(c)
+		c = mapChannels(c, func(x float64) float64 {
+			a := x*(x+0.0245786) - 0.000090537
+			b := x*(0.983729*x+0.4329510) + 0.238081
+			return a / b
+		})
+		c = acesOutput.Mul3x1(c)
+	case AgXToneMapper:
+		c = agxInset.Mul3x1(c)
+		c = mapChannels(c, func(x float64) float64 {
+			x = math.Max(x, 1e-10)
+			x = (math.Log2(x) - agxMinEV) / (agxMaxEV - agxMinEV)
+			x = math.Min(math.Max(x, 0), 1)
+			return agxContrast(x)
+		})
+		c = agxOutset.Mul3x1(c)
+		// The AgX curve output is display encoded with a 2.2 power
+		c = mapChannels(c, func(x float64) float64 {
+			return math.Pow(math.Max(x, 0), 2.2)
+		})
+	}
+
+	return clamp01(c)
+}
+
+func hable(x float64) float64 {
+	return ((x*(hableA*x+hableC*hableB) + hableD*hableE) / (x*(hableA*x+hableB) + hableD*hableF)) - hableE/hableF
+}
+
+// Polynomial fit of the AgX base contrast sigmoid
+func agxContrast(x float64) float64 {
+	x2 := x * x
+	x4 := x2 * x2
+	return 15.5*x4*x2 - 40.14*x4*x + 31.96*x4 - 6.868*x2*x + 0.4298*x2 + 0.1191*x - 0.00232
+}
+
+// Encodes linear display colors in [0, 1] for output
+func EncodeOutput(c mgl32.Vec3, settings *RenderSettings) mgl32.Vec3 {
+	switch settings.OutputEncoding {
+	case SRGBEncoding:
+		c = mapChannels(c, srgbTransfer)
+	case Rec709Encoding:
+		c = mapChannels(c, func(x float64) float64 {
+			if x < 0.018 {
+				return 4.5 * x
+			}
+			return 1.099*math.Pow(x, 0.45) - 0.099
+		})
+	case DisplayP3Encoding:
+		c = mapChannels(clamp01(srgbToP3.Mul3x1(c)), srgbTransfer)
+	default:
+		if settings.GammaCorrection {
+			gamma := float64(1.0 / settings.Gamma)
+			c = mapChannels(c, func(x float64) float64 {
+				return math.Pow(x, gamma)
+			})
+		}
+	}
+
+	return clamp01(c)
+}
+
+func srgbTransfer(x float64) float64 {
+	if x <= 0.0031308 {
+		return 12.92 * x
+	}
+	return 1.055*math.Pow(x, 1/2.4) - 0.055
+}
+
+func mapChannels(c mgl32.Vec3, f func(float64) float64) mgl32.Vec3 {
+	return mgl32.Vec3{
+		float32(f(float64(c.X()))),
+		float32(f(float64(c.Y()))),
+		float32(f(float64(c.Z()))),
+	}
+}
+
+func clamp01(c mgl32.Vec3) mgl32.Vec3 {
+	return mapChannels(c, func(x float64) float64 {
+		return math.Min(math.Max(x, 0), 1)
+	})
+}
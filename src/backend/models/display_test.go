@@ -0,0 +1,80 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func TestToneMappersAreMonotonic(t *testing.T) {
+	toneMappers := []ToneMapper{
+		ClampToneMapper,
+		ReinhardToneMapper,
+		ExtendedReinhardToneMapper,
+		HableToneMapper,
+		ACESFittedToneMapper,
+		AgXToneMapper,
+	}
+
+	for _, toneMapper := range toneMappers {
+		previous := float32(-1)
+		for x := float32(0); x < 64; x += 0.25 {
+			c := ToneMap(mgl32.Vec3{x, x, x}, toneMapper, 0)
+			if c.Y() < previous-0.0001 || c.Y() > 1 {
+				t.Errorf("Tone mapper %v not monotonic in [0, 1] at %v, got %v", toneMapper, x, c.Y())
+				break
+			}
+			previous = c.Y()
+		}
+	}
+}
+
+func TestSRGBEncoding(t *testing.T) {
+	settings := RenderSettings{OutputEncoding: SRGBEncoding}
+	c := EncodeOutput(mgl32.Vec3{0.214041, 0, 1}, &settings)
+	if math.Abs(float64(c.X()-0.5)) > 0.001 || c.Y() != 0 || c.Z() != 1 {
+		t.Errorf("sRGB encoding not working, got %v", c)
+	}
+}
+
+func TestCubeLUTIdentity(t *testing.T) {
+	var raw strings.Builder
+	raw.WriteString("# Identity\nTITLE \"identity\"\nLUT_3D_SIZE 2\n")
+	for b := 0; b < 2; b++ {
+		for g := 0; g < 2; g++ {
+			for r := 0; r < 2; r++ {
+				raw.WriteString(fmt.Sprintf("%d %d %d\n", r, g, b))
+			}
+		}
+	}
+
+	lut, err := ParseCubeLUT(raw.String())
+	if err != nil {
+		t.Fatalf("Parsing LUT failed: %v", err)
+	}
+
+	c := mgl32.Vec3{0.2, 0.5, 0.9}
+	if lut.Apply(c).Sub(c).Len() > 0.0001 {
+		t.Errorf("Identity LUT changed the color, got %v", lut.Apply(c))
+	}
+
+	if _, err := ParseCubeLUT("LUT_3D_SIZE 2\n0 0 0\n"); err == nil {
+		t.Errorf("Truncated LUT should not parse")
+	}
+
+	// The input range scales every axis like the domain
+	ranged, err := ParseCubeLUT("LUT_3D_INPUT_RANGE 0 2\n" + raw.String())
+	if err != nil {
+		t.Fatalf("Parsing LUT with an input range failed: %v", err)
+	}
+	if ranged.DomainMax != (mgl32.Vec3{2, 2, 2}) || ranged.Apply(c).Sub(c.Mul(0.5)).Len() > 0.0001 {
+		t.Errorf("Input range was not applied, got %v", ranged.Apply(c))
+	}
+
+	if _, err := ParseCubeLUT("DOMAIN_MIN 0 1 0\nDOMAIN_MAX 1 1 1\n" + raw.String()); err == nil {
+		t.Errorf("LUT with an empty domain should not parse")
+	}
+}
@@ -0,0 +1,178 @@
+package models
+
+import (
+	"math"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Auto exposure histogram range in log2 luminance and the
+// percentiles averaged when metering
+const (
+	meteringBins    = 64
+	meteringMinLog2 = -16.0
+	meteringMaxLog2 = 16.0
+	meteringLowCut  = 0.5
+	meteringHighCut = 0.95
+)
+
+// Valid white balance temperatures in Kelvin
+const (
+	minWhiteBalanceK = 1667.0
+	maxWhiteBalanceK = 25000.0
+)
+
+// White point of the rendered colors
+var d65White = mgl32.Vec3{0.95047, 1.0, 1.08883}
+
+// Linear sRGB <-> CIE XYZ (D65)
+var rgbToXYZ = mgl32.Mat3{
+	0.4124564, 0.2126729, 0.0193339,
+	0.3575761, 0.7151522, 0.1191920,
+	0.1804375, 0.0721750, 0.9503041,
+}
+var xyzToRGB = rgbToXYZ.Inv()
+
+// Bradford chromatic adaptation cone response
+var bradford = mgl32.Mat3{
+	0.8951, -0.7502, 0.0389,
+	0.2664, 1.7135, -0.0685,
+	-0.1614, 0.0367, 1.0296,
+}
+var bradfordInv = bradford.Inv()
+
+// Exposure value at ISO 100 given by the camera settings
+func (camera *Camera) EV100() float32 {
+	iso := camera.ISO
+	if iso <= 0 {
+		iso = 100
+	}
+	shutter := camera.ShutterSpeed
+	if shutter <= 0 {
+		shutter = 1.0 / 125.0
+	}
+	fstop := camera.FStop
+	if fstop <= 0 {
+		fstop = 8
+	}
+	return float32(math.Log2(float64(fstop*fstop) / float64(shutter) * 100.0 / float64(iso)))
+}
+
+// Scale from scene luminance to sensor value for an exposure value,
+// so that the sensor saturates at 1.2 * 2^EV100
+func exposureFromEV100(ev100 float32) float32 {
+	return float32(1.0 / (1.2 * math.Exp2(float64(ev100))))
+}
+
+// Returns the linear transform from rendered radiance to sensor values.
+// The metered exposure value of the whole frame is used with auto exposure
+func (camera *Camera) SensorTransform(meteredEV100 float32) mgl32.Mat3 {
+	exposure := float32(1.0)
+	if camera.AutoExposure {
+		exposure = exposureFromEV100(meteredEV100)
+	} else if camera.PhysicalExposure {
+		exposure = exposureFromEV100(camera.EV100())
+	}
+
+	transform := mgl32.Ident3().Mul(exposure)
+	if camera.WhiteBalance > 0 {
+		transform = WhiteBalanceTransform(camera.WhiteBalance).Mul3(transform)
+	}
+
+	return transform
+}
+
+// Measures the exposure value of the colors from a log luminance histogram,
+// averaging between the low and high percentiles to ignore outliers
+func MeterEV100(colors []mgl32.Vec3) float32 {
+	var histogram [meteringBins]int
+	binSize := (meteringMaxLog2 - meteringMinLog2) / meteringBins
+	count := 0
+
+	for _, c := range colors {
+		luminance := Luminance(c)
+		if luminance <= 0 {
+			continue
+		}
+		bin := int((math.Log2(float64(luminance)) - meteringMinLog2) / binSize)
+		if bin < 0 {
+			bin = 0
+		} else if bin >= meteringBins {
+			bin = meteringBins - 1
+		}
+		histogram[bin]++
+		count++
+	}
+
+	if count == 0 {
+		return 0
+	}
+
+	low := meteringLowCut * float64(count)
+	high := meteringHighCut * float64(count)
+	var sum, weight, seen float64
+	for bin, binCount := range histogram {
+		// Portion of the bin within the percentile window
+		start := math.Max(seen, low)
+		end := math.Min(seen+float64(binCount), high)
+		seen += float64(binCount)
+		if end <= start {
+			continue
+		}
+		log2Luminance := meteringMinLog2 + (float64(bin)+0.5)*binSize
+		sum += log2Luminance * (end - start)
+		weight += end - start
+	}
+
+	average := math.Exp2(sum / weight)
+
+	// Reflected light meter calibration constant K = 12.5
+	return float32(math.Log2(average * 100.0 / 12.5))
+}
+
+func Luminance(c mgl32.Vec3) float32 {
+	return 0.2126*c.X() + 0.7152*c.Y() + 0.0722*c.Z()
+}
+
+// Returns the chromatic adaptation in linear sRGB that maps white lit by a
+// blackbody of the given temperature to the D65 white point
+func WhiteBalanceTransform(kelvin float32) mgl32.Mat3 {
+	source := kelvinToXYZ(kelvin)
+	destination := d65White
+
+	sourceCone := bradford.Mul3x1(source)
+	destinationCone := bradford.Mul3x1(destination)
+	scale := mgl32.Diag3(mgl32.Vec3{
+		destinationCone.X() / sourceCone.X(),
+		destinationCone.Y() / sourceCone.Y(),
+		destinationCone.Z() / sourceCone.Z(),
+	})
+
+	adaptation := bradfordInv.Mul3(scale).Mul3(bradford)
+
+	return xyzToRGB.Mul3(adaptation).Mul3(rgbToXYZ)
+}
+
+// White point XYZ with Y = 1 on the Planckian locus, using the cubic
+// approximation by Kim et al.
+func kelvinToXYZ(kelvin float32) mgl32.Vec3 {
+	t := math.Min(math.Max(float64(kelvin), minWhiteBalanceK), maxWhiteBalanceK)
+
+	var x float64
+	if t <= 4000 {
+		x = -0.2661239e9/(t*t*t) - 0.2343589e6/(t*t) + 0.8776956e3/t + 0.179910
+	} else {
+		x = -3.0258469e9/(t*t*t) + 2.1070379e6/(t*t) + 0.2226347e3/t + 0.240390
+	}
+
+	var y float64
+	if t <= 2222 {
+		y = -1.1063814*x*x*x - 1.34811020*x*x + 2.18555832*x - 0.20219683
+	} else if t <= 4000 {
+		y = -0.9549476*x*x*x - 1.37418593*x*x + 2.09137015*x - 0.16748867
+	} else {
+		y = 3.0817580*x*x*x - 5.87338670*x*x + 3.75112997*x - 0.37001483
+	}
+
+	return mgl32.Vec3{float32(x / y), 1, float32((1 - x - y) / y)}
+}
@@ -0,0 +1,44 @@
+package models
+
+import (
+	"math"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func TestEV100(t *testing.T) {
+	// Sunny 16 rule: f/16, 1/100 s at ISO 100 is roughly EV 15
+	camera := Camera{ISO: 100, ShutterSpeed: 1.0 / 100.0, FStop: 16}
+	if ev := camera.EV100(); math.Abs(float64(ev)-14.64) > 0.01 {
+		t.Errorf("Wrong exposure value, got %v", ev)
+	}
+}
+
+func TestWhiteBalanceNeutralizesIlluminant(t *testing.T) {
+	// Daylight is close to the D65 white point of the rendered colors
+	daylight := WhiteBalanceTransform(6504).Mul3x1(mgl32.Vec3{1, 1, 1})
+	if daylight.Sub(mgl32.Vec3{1, 1, 1}).Len() > 0.1 {
+		t.Errorf("Daylight white balance should barely change white, got %v", daylight)
+	}
+
+	// Tungsten light rendered with a matching white balance is neutral
+	tungsten := xyzToRGB.Mul3x1(kelvinToXYZ(3200))
+	balanced := WhiteBalanceTransform(3200).Mul3x1(tungsten)
+	if math.Abs(float64(balanced.X()-balanced.Z())) > 0.001 || math.Abs(float64(balanced.X()-balanced.Y())) > 0.001 {
+		t.Errorf("White balance did not neutralize the illuminant, got %v", balanced)
+	}
+}
+
+func TestAutoExposureMetersMiddleGray(t *testing.T) {
+	colors := make([]mgl32.Vec3, 100)
+	for i := range colors {
+		colors[i] = mgl32.Vec3{4, 4, 4}
+	}
+
+	camera := Camera{AutoExposure: true}
+	exposed := camera.SensorTransform(MeterEV100(colors)).Mul3x1(colors[0])
+	if exposed.X() < 0.05 || exposed.X() > 0.2 {
+		t.Errorf("Auto exposure should bring the image near middle gray, got %v", exposed)
+	}
+}
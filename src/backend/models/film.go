@@ -0,0 +1,313 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"raytracer/utility"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Luminance added to the pixel mean when estimating the relative error
+const relativeErrorFloor = 0.01
+
+// First hit features of a camera ray
+type AOVSample struct {
+	Albedo mgl32.Vec3
+	Normal mgl32.Vec3
+	Depth  float32
+}
+
+// Accumulates filtered samples of a render pass region. Samples are
+// splatted to every pixel within the filter radius, so samples taken
+// up to Margin() pixels outside the region contribute to its border.
+// Neighbouring regions sampling their margins merge without seams
+type Film struct {
+	Width  int
+	Height int
+	Filter *Filter
+
+	// Weighted sum of the samples and the sum of the weights
+	Colors  []mgl32.Vec3
+	Weights []float32
+
+	// Statistics of the unfiltered samples taken in each pixel:
+	// sample count, running mean and squared deviations (Welford)
+	// of the luminance
+	Samples []int
+	Mean    []float32
+	M2      []float32
+
+	// Sums of the first hit features of the pixel samples
+	Albedo []mgl32.Vec3
+	Normal []mgl32.Vec3
+	Depth  []float32
+
+	// Statistics of the samples taken in the margin, over the film grown
+	// by the margin. Margin pixels decide their convergence by their own
+	// samples, as they do in the film of their tile. Nil until sampled
+	MarginSamples []int
+	MarginMean    []float32
+	MarginM2      []float32
+}
+
+func NewFilm(width int, height int, filter *Filter) *Film {
+	return &Film{
+		Width:   width,
+		Height:  height,
+		Filter:  filter,
+		Colors:  make([]mgl32.Vec3, width*height),
+		Weights: make([]float32, width*height),
+		Samples: make([]int, width*height),
+		Mean:    make([]float32, width*height),
+		M2:      make([]float32, width*height),
+		Albedo:  make([]mgl32.Vec3, width*height),
+		Normal:  make([]mgl32.Vec3, width*height),
+		Depth:   make([]float32, width*height),
+	}
+}
+
+// Number of pixels outside the film whose samples reach it
+func (film *Film) Margin() int {
+	return int(math.Ceil(float64(film.Filter.Radius - 0.5)))
+}
+
+// Adds a sample at the continuous film position, pixel centers
+// are at half-integer coordinates
+func (film *Film) AddSample(x float32, y float32, c mgl32.Vec3) {
+	radius := film.Filter.Radius
+
+	// Pixels with their center within (position - radius, position + radius]
+	x0 := int(math.Floor(float64(x-radius-0.5))) + 1
+	x1 := int(math.Floor(float64(x + radius - 0.5)))
+	y0 := int(math.Floor(float64(y-radius-0.5))) + 1
+	y1 := int(math.Floor(float64(y + radius - 0.5)))
+
+	if x0 < 0 {
+		x0 = 0
+	}
+	if y0 < 0 {
+		y0 = 0
+	}
+	if x1 >= film.Width {
+		x1 = film.Width - 1
+	}
+	if y1 >= film.Height {
+		y1 = film.Height - 1
+	}
+
+	for j := y0; j <= y1; j++ {
+		for i := x0; i <= x1; i++ {
+			weight := film.Filter.Evaluate(float32(i)+0.5-x, float32(j)+0.5-y)
+			if weight == 0 {
+				continue
+			}
+			index := i + j*film.Width
+			film.Colors[index] = film.Colors[index].Add(c.Mul(weight))
+			film.Weights[index] += weight
+		}
+	}
+}
+
+// Index of a pixel in the film grown by the margin, -1 outside of it
+func (film *Film) marginIndex(x int, y int) int {
+	margin := film.Margin()
+	if x < -margin || y < -margin || x >= film.Width+margin || y >= film.Height+margin {
+		return -1
+	}
+	return (x + margin) + (y+margin)*(film.Width+2*margin)
+}
+
+func (film *Film) marginPixels() int {
+	margin := film.Margin()
+	return (film.Width + 2*margin) * (film.Height + 2*margin)
+}
+
+// Records an unfiltered sample taken in the pixel. Only the luminance
+// statistics are kept for pixels in the margin, pixels further out are ignored
+func (film *Film) AddPixelSample(x int, y int, c mgl32.Vec3, aov *AOVSample) {
+	luminance := Luminance(c)
+
+	if x < 0 || y < 0 || x >= film.Width || y >= film.Height {
+		index := film.marginIndex(x, y)
+		if index < 0 {
+			return
+		}
+		if film.MarginSamples == nil {
+			film.MarginSamples = make([]int, film.marginPixels())
+			film.MarginMean = make([]float32, film.marginPixels())
+			film.MarginM2 = make([]float32, film.marginPixels())
+		}
+		addLuminance(&film.MarginSamples[index], &film.MarginMean[index], &film.MarginM2[index], luminance)
+		return
+	}
+	index := x + y*film.Width
+
+	addLuminance(&film.Samples[index], &film.Mean[index], &film.M2[index], luminance)
+
+	if aov != nil {
+		film.Albedo[index] = film.Albedo[index].Add(aov.Albedo)
+		film.Normal[index] = film.Normal[index].Add(aov.Normal)
+		film.Depth[index] += aov.Depth
+	}
+}
+
+// Updates the running luminance statistics of a pixel (Welford)
+func addLuminance(samples *int, mean *float32, m2 *float32, luminance float32) {
+	*samples++
+	delta := luminance - *mean
+	*mean += delta / float32(*samples)
+	*m2 += delta * (luminance - *mean)
+}
+
+// Sample variance of the luminance in the pixel
+func (film *Film) Variance(index int) float32 {
+	if film.Samples[index] < 2 {
+		return 0
+	}
+	return film.M2[index] / float32(film.Samples[index]-1)
+}
+
+// Estimated relative error of the pixel mean. Dark pixels are measured
+// against a luminance floor so that they can converge
+func (film *Film) RelativeError(index int) float32 {
+	return relativeError(film.Samples[index], film.Mean[index], film.M2[index])
+}
+
+func relativeError(n int, mean float32, m2 float32) float32 {
+	if n < 2 {
+		return math.MaxFloat32
+	}
+	variance := float64(m2) / float64(n-1)
+	standardError := math.Sqrt(variance / float64(n))
+	return float32(standardError / (math.Abs(float64(mean)) + relativeErrorFloor))
+}
+
+// Returns the number of samples and the relative error of a pixel of the
+// film or of its margin, given in film coordinates
+func (film *Film) PixelError(x int, y int) (int, float32) {
+	if x >= 0 && y >= 0 && x < film.Width && y < film.Height {
+		index := x + y*film.Width
+		return film.Samples[index], film.RelativeError(index)
+	}
+	index := film.marginIndex(x, y)
+	if index < 0 || film.MarginSamples == nil {
+		return 0, math.MaxFloat32
+	}
+	return film.MarginSamples[index], relativeError(film.MarginSamples[index], film.MarginMean[index], film.MarginM2[index])
+}
+
+// Returns true if the pixel data of the film matches its size,
+// for films read from files
+func (film *Film) HasSize(width int, height int) bool {
+	pixels := width * height
+	if film.Width != width || film.Height != height || film.Filter == nil ||
+		len(film.Colors) != pixels || len(film.Weights) != pixels || len(film.Samples) != pixels ||
+		len(film.Mean) != pixels || len(film.M2) != pixels ||
+		len(film.Albedo) != pixels || len(film.Normal) != pixels || len(film.Depth) != pixels {
+		return false
+	}
+	if film.MarginSamples == nil {
+		return film.MarginMean == nil && film.MarginM2 == nil
+	}
+	margin := film.marginPixels()
+	return len(film.MarginSamples) == margin && len(film.MarginMean) == margin && len(film.MarginM2) == margin
+}
+
+// Average number of samples taken in the pixels
+func (film *Film) SamplesPerPixel() float32 {
+	total := 0
+	for _, n := range film.Samples {
+		total += n
+	}
+	return float32(total) / float32(utility.MaxInt(len(film.Samples), 1))
+}
+
+// Estimated relative mean squared error of the image, averaged over the
+// pixels. Infinite until every pixel has enough samples for an estimate
+func (film *Film) RelativeMSE() float32 {
+	var sum float64
+	for i := range film.Samples {
+		if film.Samples[i] < 2 {
+			return math.MaxFloat32
+		}
+		e := float64(film.RelativeError(i))
+		sum += e * e
+	}
+	return float32(sum / float64(utility.MaxInt(len(film.Samples), 1)))
+}
+
+// Returns the averaged first hit features of the pixel
+func (film *Film) Features(index int) (mgl32.Vec3, mgl32.Vec3, float32) {
+	n := film.Samples[index]
+	if n == 0 {
+		return mgl32.Vec3{}, mgl32.Vec3{}, 0
+	}
+	normal := film.Normal[index]
+	if normal.LenSqr() > 0 {
+		normal = normal.Normalize()
+	}
+	return film.Albedo[index].Mul(1.0 / float32(n)), normal, film.Depth[index] / float32(n)
+}
+
+// Adds the samples of another film of the same region. The filtered sums
+// add up, so every film is weighted by the samples it took
+func (film *Film) Merge(other *Film) error {
+	if film.Width != other.Width || film.Height != other.Height {
+		return fmt.Errorf("film size %dx%d does not match %dx%d", other.Width, other.Height, film.Width, film.Height)
+	}
+	return film.MergeRegion(other, 0, 0)
+}
+
+// Adds the samples of a film covering the region at the given offset
+// within this film, such as a tile of the frame
+func (film *Film) MergeRegion(other *Film, x int, y int) error {
+	if x < 0 || y < 0 || x+other.Width > film.Width || y+other.Height > film.Height {
+		return fmt.Errorf("film region %dx%d+%d+%d is outside the film", other.Width, other.Height, x, y)
+	}
+	if *film.Filter != *other.Filter {
+		return fmt.Errorf("film filter %v does not match %v", *other.Filter, *film.Filter)
+	}
+
+	for j := 0; j < other.Height; j++ {
+		for i := 0; i < other.Width; i++ {
+			film.mergePixel((x+i)+(y+j)*film.Width, other, i+j*other.Width)
+		}
+	}
+
+	return nil
+}
+
+// The luminance statistics are combined with the parallel
+// variance algorithm (Chan et al.)
+func (film *Film) mergePixel(index int, other *Film, otherIndex int) {
+	film.Colors[index] = film.Colors[index].Add(other.Colors[otherIndex])
+	film.Weights[index] += other.Weights[otherIndex]
+
+	film.Albedo[index] = film.Albedo[index].Add(other.Albedo[otherIndex])
+	film.Normal[index] = film.Normal[index].Add(other.Normal[otherIndex])
+	film.Depth[index] += other.Depth[otherIndex]
+
+	n := film.Samples[index] + other.Samples[otherIndex]
+	if n == 0 {
+		return
+	}
+	na := float32(film.Samples[index])
+	nb := float32(other.Samples[otherIndex])
+	delta := other.Mean[otherIndex] - film.Mean[index]
+	film.Mean[index] += delta * nb / float32(n)
+	film.M2[index] += other.M2[otherIndex] + delta*delta*na*nb/float32(n)
+	film.Samples[index] = n
+}
+
+// Returns the filtered pixel colors
+func (film *Film) Resolve() []mgl32.Vec3 {
+	colors := make([]mgl32.Vec3, len(film.Colors))
+	for i, c := range film.Colors {
+		// Negative lobes can cancel out the weights with few samples
+		if film.Weights[i] > 1e-6 {
+			colors[i] = c.Mul(1.0 / film.Weights[i])
+		}
+	}
+	return colors
+}
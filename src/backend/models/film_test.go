@@ -0,0 +1,121 @@
+package models
+
+import (
+	"math"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func TestBoxFilterKeepsSamplesInPixel(t *testing.T) {
+	film := NewFilm(4, 4, NewFilter(BoxFilter, 0))
+	if film.Margin() != 0 {
+		t.Errorf("Box filter should not need a margin, got %v", film.Margin())
+	}
+
+	film.AddSample(1.0, 1.0, mgl32.Vec3{1, 1, 1})
+	film.AddSample(1.99, 1.99, mgl32.Vec3{3, 3, 3})
+
+	colors := film.Resolve()
+	if colors[1+1*4].X() != 2 {
+		t.Errorf("Box filter should average the pixel samples, got %v", colors[1+1*4])
+	}
+	for i, c := range colors {
+		if i != 1+1*4 && c.X() != 0 {
+			t.Errorf("Sample leaked to pixel %v", i)
+		}
+	}
+}
+
+func TestFilmTilesMergeSeamlessly(t *testing.T) {
+	filters := []FilterType{TentFilter, GaussianFilter, MitchellFilter, LanczosFilter, BlackmanHarrisFilter}
+
+	for _, filterType := range filters {
+		filter := NewFilter(filterType, 0)
+		full := NewFilm(8, 2, filter)
+		left := NewFilm(4, 2, filter)
+		right := NewFilm(4, 2, filter)
+		margin := full.Margin()
+
+		// Same samples seen by the full film and the tiles sampling their margins
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 8; x++ {
+				sx := float32(x) + 0.3
+				sy := float32(y) + 0.6
+				c := mgl32.Vec3{float32(x), float32(y), 1}
+				full.AddSample(sx, sy, c)
+				if x < 4+margin {
+					left.AddSample(sx, sy, c)
+				}
+				if x >= 4-margin {
+					right.AddSample(sx-4, sy, c)
+				}
+			}
+		}
+
+		fullColors := full.Resolve()
+		leftColors := left.Resolve()
+		rightColors := right.Resolve()
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 8; x++ {
+				var tile mgl32.Vec3
+				if x < 4 {
+					tile = leftColors[x+y*4]
+				} else {
+					tile = rightColors[x-4+y*4]
+				}
+				if math.Abs(float64(tile.Sub(fullColors[x+y*8]).Len())) > 0.0001 {
+					t.Errorf("Filter %v tile pixel %v,%v differs from full film: %v != %v", filterType, x, y, tile, fullColors[x+y*8])
+				}
+			}
+		}
+	}
+}
+
+func TestFilmPixelStatistics(t *testing.T) {
+	film := NewFilm(2, 1, NewFilter(BoxFilter, 0))
+
+	values := []float32{1, 2, 3, 4}
+	for _, v := range values {
+		film.AddPixelSample(0, 0, mgl32.Vec3{v, v, v}, nil)
+		film.AddPixelSample(1, 0, mgl32.Vec3{1, 1, 1}, nil)
+	}
+
+	if math.Abs(float64(film.Mean[0]-2.5)) > 0.0001 {
+		t.Errorf("Wrong running mean, got %v", film.Mean[0])
+	}
+	// Sample variance of 1, 2, 3, 4
+	if math.Abs(float64(film.Variance(0)-5.0/3.0)) > 0.0001 {
+		t.Errorf("Wrong running variance, got %v", film.Variance(0))
+	}
+	if film.RelativeError(1) != 0 || film.RelativeError(0) <= 0 {
+		t.Errorf("Constant pixel should have no error, noisy pixel should")
+	}
+}
+
+func TestFilmMarginStatistics(t *testing.T) {
+	film := NewFilm(2, 2, NewFilter(GaussianFilter, 2))
+	if film.Margin() != 2 {
+		t.Fatalf("Film margin is %d", film.Margin())
+	}
+
+	for _, v := range []float32{1, 3, 1, 3} {
+		film.AddPixelSample(-1, 0, mgl32.Vec3{v, v, v}, nil)
+		film.AddPixelSample(0, 0, mgl32.Vec3{1, 1, 1}, nil)
+		film.AddPixelSample(-3, 0, mgl32.Vec3{v, v, v}, nil)
+	}
+
+	// The margin pixel keeps its own statistics
+	if samples, relativeError := film.PixelError(-1, 0); samples != 4 || relativeError <= 0 {
+		t.Errorf("Margin pixel has %d samples with error %v", samples, relativeError)
+	}
+	if samples, relativeError := film.PixelError(0, 0); samples != 4 || relativeError != 0 {
+		t.Errorf("Film pixel has %d samples with error %v", samples, relativeError)
+	}
+	if samples, _ := film.PixelError(-3, 0); samples != 0 {
+		t.Errorf("Pixel outside the margin has %d samples", samples)
+	}
+	if !film.HasSize(2, 2) {
+		t.Errorf("Film with margin statistics does not match its size")
+	}
+}
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// Film file header. The version is increased whenever
+// the encoded state changes
+const (
+	filmFileMagic   = "RTFM"
+	FilmFileVersion = 2
+)
+
+var ErrFilmMismatch = errors.New("film was rendered from another scene")
+
+// Float film of a render pass with the per-pixel sample counts and
+// variance, so that renders of the same frame can be merged later
+type FilmFile struct {
+	Version     int
+	ContentHash string
+
+	// The pass holds the camera exposure and display settings,
+	// the LUT of the scene is kept for developing the film
+	Pass RenderPass
+	LUT  *LUT3D
+	Film *Film
+}
+
+func WriteFilmFile(w io.Writer, file *FilmFile) error {
+	file.Version = FilmFileVersion
+	return writeVersioned(w, filmFileMagic, FilmFileVersion, file)
+}
+
+func ReadFilmFile(r io.Reader) (*FilmFile, error) {
+	file := &FilmFile{}
+	if err := readVersioned(r, filmFileMagic, FilmFileVersion, file); err != nil {
+		return nil, err
+	}
+	if file.Film == nil || !file.Film.HasSize(file.Pass.Width, file.Pass.Height) {
+		return nil, fmt.Errorf("film does not match the render pass")
+	}
+	return file, nil
+}
+
+// Combines films of the same frame rendered independently, usually with
+// different RNG seeds. The region, camera and scene must match
+func MergeFilms(files []*FilmFile) (*FilmFile, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no films to merge")
+	}
+
+	first := files[0]
+	camera, err := json.Marshal(first.Pass.Camera)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := &FilmFile{
+		ContentHash: first.ContentHash,
+		Pass:        first.Pass,
+		LUT:         first.LUT,
+		Film:        NewFilm(first.Film.Width, first.Film.Height, first.Film.Filter),
+	}
+
+	seeds := make(map[int64]bool)
+	for i, file := range files {
+		if file.ContentHash != first.ContentHash {
+			return nil, fmt.Errorf("film %d: %w", i, ErrFilmMismatch)
+		}
+		if !samePassRegion(&file.Pass, &first.Pass) {
+			return nil, fmt.Errorf("film %d: region %dx%d+%d+%d of %dx%d does not match", i,
+				file.Pass.Width, file.Pass.Height, file.Pass.XOffset, file.Pass.YOffset,
+				file.Pass.TotalWidth, file.Pass.TotalHeight)
+		}
+
+		otherCamera, err := json.Marshal(file.Pass.Camera)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(camera, otherCamera) {
+			return nil, fmt.Errorf("film %d: camera does not match", i)
+		}
+		if !reflect.DeepEqual(file.LUT, first.LUT) {
+			return nil, fmt.Errorf("film %d: LUT does not match", i)
+		}
+
+		// The same seed takes the same samples, merging would only
+		// count them twice
+		if seeds[file.Pass.RNGSeed] {
+			return nil, fmt.Errorf("film %d: RNG seed %d already merged", i, file.Pass.RNGSeed)
+		}
+		seeds[file.Pass.RNGSeed] = true
+
+		if err := merged.Film.Merge(file.Film); err != nil {
+			return nil, fmt.Errorf("film %d: %w", i, err)
+		}
+	}
+
+	return merged, nil
+}
+
+func samePassRegion(a *RenderPass, b *RenderPass) bool {
+	return a.TotalWidth == b.TotalWidth && a.TotalHeight == b.TotalHeight &&
+		a.XOffset == b.XOffset && a.YOffset == b.YOffset &&
+		a.Width == b.Width && a.Height == b.Height
+}
@@ -0,0 +1,114 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func filmFileWithSamples(seed int64, samples []float32) *FilmFile {
+	film := NewFilm(1, 1, NewFilter(BoxFilter, 0))
+	for _, s := range samples {
+		c := mgl32.Vec3{s, s, s}
+		film.AddSample(0.5, 0.5, c)
+		film.AddPixelSample(0, 0, c, nil)
+	}
+	return &FilmFile{
+		ContentHash: "scene",
+		Pass:        RenderPass{TotalWidth: 1, TotalHeight: 1, Width: 1, Height: 1, RNGSeed: seed},
+		Film:        film,
+	}
+}
+
+func TestMergeFilmsWeightsBySamples(t *testing.T) {
+	a := filmFileWithSamples(1, []float32{1, 2})
+	b := filmFileWithSamples(2, []float32{3, 4, 5, 6})
+	all := filmFileWithSamples(3, []float32{1, 2, 3, 4, 5, 6})
+
+	var buffer bytes.Buffer
+	if err := WriteFilmFile(&buffer, b); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ReadFilmFile(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := MergeFilms([]*FilmFile{a, b})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if merged.Film.Samples[0] != 6 {
+		t.Errorf("Merged film should have 6 samples, got %d", merged.Film.Samples[0])
+	}
+	color := merged.Film.Resolve()[0]
+	if math.Abs(float64(color.X()-3.5)) > 1e-5 {
+		t.Errorf("Merged color should be the mean of all samples 3.5, got %v", color.X())
+	}
+	if math.Abs(float64(merged.Film.Variance(0)-all.Film.Variance(0))) > 1e-4 {
+		t.Errorf("Merged variance %v should equal the variance of all samples %v", merged.Film.Variance(0), all.Film.Variance(0))
+	}
+}
+
+func TestMergeFilmsValidates(t *testing.T) {
+	a := filmFileWithSamples(1, []float32{1})
+
+	b := filmFileWithSamples(2, []float32{1})
+	b.ContentHash = "other"
+	if _, err := MergeFilms([]*FilmFile{a, b}); !errors.Is(err, ErrFilmMismatch) {
+		t.Errorf("Films of different scenes should not merge, got %v", err)
+	}
+
+	b = filmFileWithSamples(2, []float32{1})
+	b.Pass.TotalWidth = 2
+	if _, err := MergeFilms([]*FilmFile{a, b}); err == nil {
+		t.Error("Films of different resolutions should not merge")
+	}
+
+	b = filmFileWithSamples(2, []float32{1})
+	b.Pass.Camera.FieldOfView = 90
+	if _, err := MergeFilms([]*FilmFile{a, b}); err == nil {
+		t.Error("Films of different cameras should not merge")
+	}
+
+	b = filmFileWithSamples(1, []float32{1})
+	if _, err := MergeFilms([]*FilmFile{a, b}); err == nil {
+		t.Error("Films with the same seed should not merge")
+	}
+
+	b = filmFileWithSamples(2, []float32{1})
+	b.LUT = &LUT3D{Size: 2}
+	if _, err := MergeFilms([]*FilmFile{a, b}); err == nil {
+		t.Error("Films with different LUTs should not merge")
+	}
+}
+
+func TestFilmFileKeepsLUT(t *testing.T) {
+	file := filmFileWithSamples(1, []float32{1})
+	lut, err := ParseCubeLUT("DOMAIN_MAX 2 2 2\nLUT_3D_SIZE 2\n0 0 0\n1 0 0\n0 1 0\n1 1 0\n0 0 1\n1 0 1\n0 1 1\n1 1 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.LUT = lut
+
+	var buffer bytes.Buffer
+	if err := WriteFilmFile(&buffer, file); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadFilmFile(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged, err := MergeFilms([]*FilmFile{read})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(merged.LUT, lut) {
+		t.Errorf("Merged film lost the LUT, got %+v", merged.LUT)
+	}
+}
@@ -0,0 +1,90 @@
+package models
+
+import "math"
+
+type FilterType int
+
+const (
+	BoxFilter FilterType = iota
+	TentFilter
+	GaussianFilter
+	MitchellFilter
+	LanczosFilter
+	BlackmanHarrisFilter
+)
+
+// Radius used when the settings leave it empty
+var defaultFilterRadius = map[FilterType]float32{
+	BoxFilter:            0.5,
+	TentFilter:           1.0,
+	GaussianFilter:       1.5,
+	MitchellFilter:       2.0,
+	LanczosFilter:        3.0,
+	BlackmanHarrisFilter: 2.0,
+}
+
+// Mitchell-Netravali parameters B and C
+const (
+	mitchellB = 1.0 / 3.0
+	mitchellC = 1.0 / 3.0
+)
+
+// Separable pixel reconstruction filter
+type Filter struct {
+	Type   FilterType
+	Radius float32
+}
+
+func NewFilter(filterType FilterType, radius float32) *Filter {
+	if radius <= 0 {
+		radius = defaultFilterRadius[filterType]
+	}
+	return &Filter{Type: filterType, Radius: radius}
+}
+
+// Weight of a sample at the given offset from the pixel center
+func (filter *Filter) Evaluate(dx float32, dy float32) float32 {
+	return filter.evaluate1D(dx) * filter.evaluate1D(dy)
+}
+
+func (filter *Filter) evaluate1D(d float32) float32 {
+	x := math.Abs(float64(d))
+	r := float64(filter.Radius)
+	if x > r {
+		return 0
+	}
+
+	switch filter.Type {
+	case TentFilter:
+		return float32(1 - x/r)
+	case GaussianFilter:
+		// Standard deviation of a third of the radius, shifted to reach zero at the radius
+		alpha := 4.5 / (r * r)
+		return float32(math.Max(math.Exp(-alpha*x*x)-math.Exp(-alpha*r*r), 0))
+	case MitchellFilter:
+		return float32(mitchell(2 * x / r))
+	case LanczosFilter:
+		return float32(sinc(x) * sinc(x/r))
+	case BlackmanHarrisFilter:
+		t := math.Pi * (x/r + 1)
+		return float32(0.35875 - 0.48829*math.Cos(t) + 0.14128*math.Cos(2*t) - 0.01168*math.Cos(3*t))
+	}
+
+	return 1
+}
+
+// Mitchell-Netravali cubic for x in [0, 2]
+func mitchell(x float64) float64 {
+	const B, C = mitchellB, mitchellC
+	if x < 1 {
+		return ((12-9*B-6*C)*x*x*x + (-18+12*B+6*C)*x*x + (6 - 2*B)) / 6
+	}
+	return ((-B-6*C)*x*x*x + (6*B+30*C)*x*x + (-12*B-48*C)*x + (8*B + 24*C)) / 6
+}
+
+func sinc(x float64) float64 {
+	if x < 1e-5 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"math"
+	"raytracer/utility"
+)
+
+// Returns a hash of the scene geometry and the BVH built over it.
+// Renders of the same frame can only be combined or resumed when
+// their content hashes are equal
+func (context *RenderContext) ContentHash() string {
+	h := sha256.New()
+
+	writeTriangles(h, context.Triangles)
+	for _, mesh := range context.Meshes {
+		writeTriangles(h, mesh.Triangles)
+	}
+	writeInstances(h, context)
+	if context.BVH != nil {
+		writeNodes(h, context.BVH.Nodes)
+		for _, object := range context.BVH.Objects {
+			writeUint64(h, uint64(object.Start))
+			writeUint64(h, uint64(object.Instance))
+			if object.Instance < 0 {
+				writeNodes(h, object.BVH.Nodes)
+			}
+		}
+		for _, mesh := range context.BVH.Meshes {
+			writeNodes(h, mesh.Nodes)
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeNodes(h hash.Hash, nodes []LinearBVHNode) {
+	for _, node := range nodes {
+		writeUint64(h, uint64(node.Offset))
+		writeUint64(h, uint64(node.Info))
+	}
+}
+
+// Returns a hash of the triangles in the scene order and the BVH build
+// parameters. A BVH can be loaded into scenes of the same mesh hash
+func (context *RenderContext) MeshHash() [sha256.Size]byte {
+	h := sha256.New()
+
+	writeTriangles(h, context.sceneTriangles())
+	for i := range context.Meshes {
+		writeTriangles(h, context.sceneMeshTriangles(i))
+	}
+	writeInstances(h, context)
+	if context.UseBVH {
+		writeUint64(h, 1)
+	} else {
+		writeUint64(h, 0)
+	}
+	writeUint64(h, uint64(context.BVHMaxLeafSize))
+	writeUint64(h, uint64(context.BVHMaxDepth))
+	writeUint64(h, uint64(context.BVHBuilder))
+	writeUint64(h, uint64(context.BVHBins))
+	writeUint64(h, uint64(math.Float32bits(context.splitAlpha())))
+	if context.BVHTwoLevel {
+		writeUint64(h, 1)
+	} else {
+		writeUint64(h, 0)
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// Returns the triangles in the order of the scene, undoing the reordering
+// of the loaded BVH. Every scene triangle is referenced by the BVH
+func (context *RenderContext) sceneTriangles() []*Triangle {
+	if context.BVH == nil {
+		return context.Triangles
+	}
+	return sceneOrder(context.Triangles, context.BVH.Permutation)
+}
+
+// Returns the triangles of a mesh in the order of the scene
+func (context *RenderContext) sceneMeshTriangles(mesh int) []*Triangle {
+	triangles := context.Meshes[mesh].Triangles
+	if context.BVH == nil || mesh >= len(context.BVH.Meshes) {
+		return triangles
+	}
+	return sceneOrder(triangles, context.BVH.Meshes[mesh].Permutation)
+}
+
+func sceneOrder(triangles []*Triangle, permutation []int32) []*Triangle {
+	if len(permutation) != len(triangles) {
+		return triangles
+	}
+	count := 0
+	for _, index := range permutation {
+		count = utility.MaxInt(count, int(index)+1)
+	}
+	ordered := make([]*Triangle, count)
+	for i, triangle := range triangles {
+		ordered[permutation[i]] = triangle
+	}
+	return ordered
+}
+
+func writeTriangles(h hash.Hash, triangles []*Triangle) {
+	writeUint64(h, uint64(len(triangles)))
+	for _, triangle := range triangles {
+		for _, vertex := range triangle.Vertices {
+			writeVec(h, vertex[:])
+		}
+		for _, uv := range triangle.TextureCoords {
+			writeVec(h, uv[:])
+		}
+		if triangle.Material != nil {
+			h.Write([]byte(triangle.Material.Name))
+		}
+		if triangle.Motion != nil {
+			writeVec(h, triangle.Motion.Transform[:])
+			writeVec(h, triangle.Motion.EndTransform[:])
+		}
+	}
+}
+
+func writeInstances(h hash.Hash, context *RenderContext) {
+	writeUint64(h, uint64(len(context.Instances)))
+	for _, instance := range context.Instances {
+		writeUint64(h, uint64(context.meshIndex(instance.Mesh)))
+		writeVec(h, instance.Transform[:])
+		if instance.Material != nil {
+			h.Write([]byte(instance.Material.Name))
+		}
+	}
+}
+
+func writeUint64(h hash.Hash, v uint64) {
+	var buffer [8]byte
+	binary.LittleEndian.PutUint64(buffer[:], v)
+	h.Write(buffer[:])
+}
+
+func writeVec(h hash.Hash, v []float32) {
+	var buffer [4]byte
+	for _, f := range v {
+		binary.LittleEndian.PutUint32(buffer[:], math.Float32bits(f))
+		h.Write(buffer[:])
+	}
+}
@@ -0,0 +1,176 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"raytracer/utility"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/udhos/gwob"
+)
+
+// Instance of an OBJ group, declared in the scene. Groups with instances
+// are only rendered through them, the light group cannot be instanced
+type ObjectInstance struct {
+	Group     string
+	Transform mgl32.Mat4
+	// Name of an MTL material replacing the materials of the group
+	Material string
+}
+
+// Triangles of an instanced OBJ group in object space, stored once
+// for all of its instances
+type Mesh struct {
+	Name      string
+	Triangles []*Triangle
+}
+
+// Mesh placed in the world with an object to world transform
+type Instance struct {
+	Mesh      *Mesh
+	Transform mgl32.Mat4
+	Inverse   mgl32.Mat4
+	// Replaces the materials of the mesh triangles if set
+	Material *gwob.Material
+}
+
+// Returns the mesh of the given OBJ group, if the group is instanced
+func (context *RenderContext) mesh(group string) *Mesh {
+	for _, mesh := range context.Meshes {
+		if mesh.Name == group {
+			return mesh
+		}
+	}
+	return nil
+}
+
+func (context *RenderContext) meshIndex(mesh *Mesh) int {
+	for i := range context.Meshes {
+		if context.Meshes[i] == mesh {
+			return i
+		}
+	}
+	return -1
+}
+
+// Creates the meshes of the instanced groups, before the triangles are built
+func (context *RenderContext) initializeMeshes() {
+	context.Meshes = nil
+	for _, declared := range context.Scene.Instances {
+		if context.mesh(declared.Group) == nil {
+			context.Meshes = append(context.Meshes, &Mesh{Name: declared.Group})
+		}
+	}
+}
+
+// Places the meshes of the instances declared in the scene
+func (context *RenderContext) initializeInstances() error {
+	context.Instances = make([]*Instance, 0, len(context.Scene.Instances))
+	for i, declared := range context.Scene.Instances {
+		mesh := context.mesh(declared.Group)
+		if len(mesh.Triangles) == 0 {
+			return fmt.Errorf("instance %d of group %q has no triangles", i, declared.Group)
+		}
+		// The area light is taken from the scene triangles only
+		for _, triangle := range mesh.Triangles {
+			if triangle.IsLight {
+				return fmt.Errorf("instance %d of group %q: light triangles cannot be instanced", i, declared.Group)
+			}
+		}
+
+		var material *gwob.Material
+		if declared.Material != "" {
+			found := false
+			material, found = context.MaterialLib.Lib[declared.Material]
+			if !found {
+				return fmt.Errorf("instance %d has unknown material %q", i, declared.Material)
+			}
+			if material.Name == "Light" {
+				return fmt.Errorf("instance %d: the light material cannot be instanced", i)
+			}
+		}
+
+		instance, err := NewInstance(mesh, declared.Transform, material)
+		if err != nil {
+			return fmt.Errorf("instance %d of group %q: %w", i, declared.Group, err)
+		}
+		context.Instances = append(context.Instances, instance)
+	}
+	return nil
+}
+
+// An empty transform is treated as the identity
+func NewInstance(mesh *Mesh, transform mgl32.Mat4, material *gwob.Material) (*Instance, error) {
+	instance := &Instance{Mesh: mesh, Material: material}
+	if err := instance.SetTransform(transform); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+func (instance *Instance) SetTransform(transform mgl32.Mat4) error {
+	// Rotations by half a turn have a zero trace, only an all zero
+	// matrix is empty
+	if transform == (mgl32.Mat4{}) {
+		transform = mgl32.Ident4()
+	}
+	if math.Abs(float64(transform.Det())) < 1e-12 {
+		return fmt.Errorf("transform cannot be inverted")
+	}
+	instance.Transform = transform
+	instance.Inverse = transform.Inv()
+	return nil
+}
+
+// Returns the ray in object space. The direction is not normalized,
+// so that the ray parameter t is the same in both spaces
+func (instance *Instance) objectRay(ray *Ray) *Ray {
+	local := NewRay(
+		mgl32.TransformCoordinate(ray.Origin, instance.Inverse),
+		mgl32.TransformNormal(ray.Direction, instance.Inverse),
+		ray.Bounce, ray.X, ray.Y,
+	)
+	local.Time = ray.Time
+	return local
+}
+
+// Returns the world space normal of a mesh triangle at the given time
+func (instance *Instance) NormalAt(triangle *Triangle, time float32) mgl32.Vec3 {
+	normal := triangle.NormalAt(time)
+	return instance.Inverse.Transpose().Mat3().Mul3x1(normal).Normalize()
+}
+
+// Returns the material of a mesh triangle of the instance
+func (instance *Instance) MaterialOf(triangle *Triangle) *gwob.Material {
+	if instance.Material != nil {
+		return instance.Material
+	}
+	return triangle.Material
+}
+
+// World bounds of the object space bounds
+func (instance *Instance) bounds(local MinimalAABB) MinimalAABB {
+	bounds := emptyAABB()
+	for i := 0; i < 8; i++ {
+		corner := local.Min
+		for axis := 0; axis < 3; axis++ {
+			if i&(1<<axis) != 0 {
+				corner[axis] = local.Max[axis]
+			}
+		}
+		world := mgl32.TransformCoordinate(corner, instance.Transform)
+		bounds.Min = utility.Vec3Min(bounds.Min, world)
+		bounds.Max = utility.Vec3Max(bounds.Max, world)
+	}
+	return bounds
+}
+
+// Number of mesh triangles rendered through the instances, which would
+// be copied into the scene triangles without instancing
+func (context *RenderContext) InstancedTriangles() int {
+	count := 0
+	for _, instance := range context.Instances {
+		count += len(instance.Mesh.Triangles)
+	}
+	return count
+}
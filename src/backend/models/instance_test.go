@@ -0,0 +1,255 @@
+package models
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/udhos/gwob"
+)
+
+// Rotated, scaled and translated instances around the scene, placed
+// in a context by instanceContext
+func randomInstances(t *testing.T, count int) []*Instance {
+	rng := rand.New(rand.NewSource(4))
+	instances := make([]*Instance, count)
+	for i := range instances {
+		axis := mgl32.Vec3{rng.Float32() - 0.5, rng.Float32() - 0.5, rng.Float32() - 0.5}.Normalize()
+		scale := 0.5 + rng.Float32()*1.5
+		transform := mgl32.Translate3D((rng.Float32()-0.5)*200, (rng.Float32()-0.5)*200, (rng.Float32()-0.5)*200).
+			Mul4(mgl32.HomogRotate3D(rng.Float32()*2*math.Pi, axis)).
+			Mul4(mgl32.Scale3D(scale, scale, scale))
+
+		instance, err := NewInstance(nil, transform, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		instances[i] = instance
+	}
+	return instances
+}
+
+func instanceContext(triangles []*Triangle, mesh []*Triangle, instances []*Instance) *RenderContext {
+	context := bvhContext(triangles, BinnedBVHBuilder)
+	context.Meshes = []*Mesh{{Name: "mesh", Triangles: append([]*Triangle{}, mesh...)}}
+	context.Instances = make([]*Instance, len(instances))
+	for i, instance := range instances {
+		copied := *instance
+		copied.Mesh = context.Meshes[0]
+		context.Instances[i] = &copied
+	}
+	return context
+}
+
+// Checks the closest hits against the scene triangles and copies of the
+// mesh triangles in world space
+func checkInstanceIntersect(t *testing.T, context *RenderContext, triangles []*Triangle, rays []*Ray) {
+	t.Helper()
+
+	type world struct {
+		instance *Instance
+		triangle *Triangle
+	}
+	flattened := append([]*Triangle{}, triangles...)
+	sources := make(map[*Triangle]world)
+	for _, instance := range context.Instances {
+		for _, triangle := range instance.Mesh.Triangles {
+			copied := NewTriangle(
+				mgl32.TransformCoordinate(triangle.Vertices[0], instance.Transform),
+				mgl32.TransformCoordinate(triangle.Vertices[1], instance.Transform),
+				mgl32.TransformCoordinate(triangle.Vertices[2], instance.Transform),
+				triangle.Material, triangle.Index,
+			)
+			flattened = append(flattened, copied)
+			sources[copied] = world{instance, triangle}
+		}
+	}
+
+	hits := 0
+	for i, ray := range rays {
+		var tmin, umin, vmin float32 = math.MaxFloat32, 0, 0
+		var tri *Triangle
+		var instance *Instance
+		context.BVH.IntersectInstance(context.Triangles, ray, &tmin, &umin, &vmin, &tri, &instance)
+
+		var expected *Triangle
+		var expectedT float32 = math.MaxFloat32
+		for _, triangle := range flattened {
+			if triangle.Normal.Dot(ray.Direction) > 0 {
+				continue
+			}
+			if t, _, _ := triangle.RayIntersect(ray); t > 0 && t < expectedT {
+				expected, expectedT = triangle, t
+			}
+		}
+
+		// The object space intersection differs by rounding
+		if (tri == nil) != (expected == nil) || math.Abs(float64(tmin-expectedT)) > 1e-3*float64(expectedT) {
+			t.Fatalf("Ray %d hit %v at %v, expected %v at %v", i, tri, tmin, expected, expectedT)
+		}
+		if expected == nil {
+			continue
+		}
+		hits++
+
+		source, found := sources[expected]
+		if !found {
+			source.triangle = expected
+		}
+		if tri != source.triangle || instance != source.instance {
+			t.Fatalf("Ray %d hit triangle %d of %p, expected triangle %d of %p", i, tri.Index, instance, source.triangle.Index, source.instance)
+		}
+		if instance != nil {
+			if normal := instance.NormalAt(tri, 0); normal.Sub(expected.Normal).Len() > 1e-3 {
+				t.Fatalf("Ray %d instance normal %v, expected %v", i, normal, expected.Normal)
+			}
+		}
+	}
+	if hits == 0 {
+		t.Errorf("No ray hit the scene")
+	}
+}
+
+func TestInstanceIntersect(t *testing.T) {
+	triangles := randomTriangles(500)
+	mesh := randomTriangles(200)
+	context := instanceContext(triangles, mesh, randomInstances(t, 40))
+	bvh := BuildBVH(context)
+
+	if err := bvh.Validate(len(triangles)); err != nil {
+		t.Fatal(err)
+	}
+	if len(bvh.Meshes) != 1 || len(bvh.Objects) != 41 {
+		t.Fatalf("BVH has %d meshes and %d objects", len(bvh.Meshes), len(bvh.Objects))
+	}
+	if instanced := context.InstancedTriangles(); instanced != 40*len(mesh) {
+		t.Errorf("Instances render %d triangles", instanced)
+	}
+
+	rays := randomRays(append(append([]*Triangle{}, triangles...), mesh...), 300)
+	checkInstanceIntersect(t, context, triangles, rays)
+
+	for i, ray := range rays {
+		tmax := float32(50 + i%100)
+		expected := false
+		var tmin, umin, vmin float32 = tmax, 0, 0
+		var tri *Triangle
+		if context.BVH.Intersect(context.Triangles, ray, &tmin, &umin, &vmin, &tri); tri != nil {
+			expected = true
+		}
+		if occluded := context.BVH.Occluded(context.Triangles, ray, tmax, false); occluded != expected {
+			t.Fatalf("Ray %d occluded %v, expected %v", i, occluded, expected)
+		}
+	}
+}
+
+func TestInstanceMaterial(t *testing.T) {
+	mesh := &Mesh{Triangles: randomTriangles(1)}
+	override := &gwob.Material{Name: "Override"}
+
+	instance, err := NewInstance(mesh, mgl32.Mat4{}, override)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.Transform != mgl32.Ident4() {
+		t.Errorf("Empty transform is not the identity")
+	}
+	if material := instance.MaterialOf(mesh.Triangles[0]); material != override {
+		t.Errorf("Instance material is %v", material.Name)
+	}
+
+	instance.Material = nil
+	if material := instance.MaterialOf(mesh.Triangles[0]); material != mesh.Triangles[0].Material {
+		t.Errorf("Instance without override has material %v", material.Name)
+	}
+
+	// A half turn has a zero trace but is a valid transform
+	halfTurn := mgl32.HomogRotate3DY(math.Pi)
+	if err := instance.SetTransform(halfTurn); err != nil || instance.Transform != halfTurn {
+		t.Errorf("Half turn was not kept: %v", err)
+	}
+	if err := instance.SetTransform(mgl32.Scale3D(1, 0, 1)); err == nil {
+		t.Errorf("Singular transform should not be accepted")
+	}
+}
+
+func TestInstanceBVHFile(t *testing.T) {
+	triangles := randomTriangles(500)
+	mesh := randomTriangles(200)
+	instances := randomInstances(t, 20)
+	context := instanceContext(triangles, mesh, instances)
+	context.BVHWidth = 4
+	bvh := BuildBVH(context)
+
+	var buffer bytes.Buffer
+	if err := WriteBVHFile(&buffer, bvh); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadBVHFile(&buffer, int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := instanceContext(triangles, mesh, instances)
+	loaded.BVHWidth = 4
+	if err := loaded.LoadBVH(read); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ContentHash() != context.ContentHash() {
+		t.Errorf("Loaded instance BVH content hash differs from the built one")
+	}
+	rays := randomRays(append(append([]*Triangle{}, triangles...), mesh...), 300)
+	checkInstanceIntersect(t, loaded, triangles, rays)
+
+	// The instances are part of the mesh hash
+	other := instanceContext(triangles, mesh, instances[1:])
+	if err := other.LoadBVH(read); err == nil {
+		t.Errorf("BVH of other instances should not load")
+	}
+
+	// Moving an instance rebuilds the top level only
+	meshNodes := loaded.BVH.Meshes[0].Nodes
+	if err := loaded.UpdateInstance(3, mgl32.Translate3D(30, 30, 30)); err != nil {
+		t.Fatal(err)
+	}
+	loaded.RefitBVH()
+	if err := loaded.BVH.Validate(len(triangles)); err != nil {
+		t.Fatal(err)
+	}
+	if &loaded.BVH.Meshes[0].Nodes[0] != &meshNodes[0] {
+		t.Errorf("Moving an instance rebuilt its mesh")
+	}
+	checkInstanceIntersect(t, loaded, triangles, rays)
+
+	if err := loaded.UpdateInstance(len(instances), mgl32.Ident4()); err == nil {
+		t.Errorf("Unknown instance should not update")
+	}
+}
+
+func TestInstanceLight(t *testing.T) {
+	light := &gwob.Material{Name: "Light"}
+	context := &RenderContext{
+		Scene:       Scene{Instances: []ObjectInstance{{Group: "Lamp"}}},
+		MaterialLib: &gwob.MaterialLib{Lib: map[string]*gwob.Material{"Light": light}},
+	}
+	context.initializeMeshes()
+	mesh := context.mesh("Lamp")
+	mesh.Triangles = randomTriangles(2)
+	if err := context.initializeInstances(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The area light would fall back to the debug light
+	mesh.Triangles[1].IsLight = true
+	if err := context.initializeInstances(); err == nil {
+		t.Errorf("Instanced light triangles should not be accepted")
+	}
+
+	mesh.Triangles[1].IsLight = false
+	context.Scene.Instances[0].Material = "Light"
+	if err := context.initializeInstances(); err == nil {
+		t.Errorf("Instances with the light material should not be accepted")
+	}
+}
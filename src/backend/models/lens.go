@@ -0,0 +1,132 @@
+package models
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Iterations used to invert the distortion model
+const undistortIterations = 10
+
+// Brown-Conrady lens distortion with radial coefficients K1-K3 and
+// tangential coefficients P1, P2. Coordinates are normalized to the
+// half-height of the image, with the origin at the image center
+type LensDistortion struct {
+	K1 float32
+	K2 float32
+	K3 float32
+	P1 float32
+	P2 float32
+}
+
+func (d *LensDistortion) IsZero() bool {
+	return d.K1 == 0 && d.K2 == 0 && d.K3 == 0 && d.P1 == 0 && d.P2 == 0
+}
+
+// Maps undistorted normalized coordinates to distorted ones
+func (d *LensDistortion) Distort(p mgl32.Vec2) mgl32.Vec2 {
+	radial, tangential := d.terms(p)
+	return p.Mul(radial).Add(tangential)
+}
+
+// Maps distorted normalized coordinates to undistorted ones
+// by fixed point iteration of the distortion model
+func (d *LensDistortion) Undistort(p mgl32.Vec2) mgl32.Vec2 {
+	undistorted := p
+	for i := 0; i < undistortIterations; i++ {
+		radial, tangential := d.terms(undistorted)
+		undistorted = p.Sub(tangential).Mul(1.0 / radial)
+	}
+	return undistorted
+}
+
+func (d *LensDistortion) terms(p mgl32.Vec2) (float32, mgl32.Vec2) {
+	x, y := p.X(), p.Y()
+	r2 := x*x + y*y
+	radial := 1 + r2*(d.K1+r2*(d.K2+r2*d.K3))
+	tangential := mgl32.Vec2{
+		2*d.P1*x*y + d.P2*(r2+2*x*x),
+		d.P1*(r2+2*y*y) + 2*d.P2*x*y,
+	}
+	return radial, tangential
+}
+
+// Converts continuous pixel coordinates of an eye image to normalized
+// lens coordinates and back
+func (camera *Camera) pixelToLens(px float32, py float32) mgl32.Vec2 {
+	halfHeight := float32(camera.eyeHeight) / 2.0
+	return mgl32.Vec2{
+		(px - float32(camera.eyeWidth)/2.0) / halfHeight,
+		(halfHeight - py) / halfHeight,
+	}
+}
+
+func (camera *Camera) lensToPixel(p mgl32.Vec2) (float32, float32) {
+	halfHeight := float32(camera.eyeHeight) / 2.0
+	return float32(camera.eyeWidth)/2.0 + p.X()*halfHeight, halfHeight - p.Y()*halfHeight
+}
+
+// Applies the lens to a pixel position of the rendered (distorted) image.
+// Returns the pixel position of the ideal pinhole image to trace and the
+// weight of the ray for the color channels
+func (camera *Camera) applyLens(px float32, py float32, channelSample float32) (float32, float32, mgl32.Vec3) {
+	weight := mgl32.Vec3{1, 1, 1}
+	if camera.Distortion.IsZero() && camera.ChromaticAberration == 0 {
+		return px, py, weight
+	}
+
+	p := camera.Distortion.Undistort(camera.pixelToLens(px, py))
+
+	if camera.ChromaticAberration != 0 {
+		// Each ray carries a single channel, scaled so that the
+		// expected value over the channels is unchanged
+		channel := int(channelSample * 3)
+		if channel > 2 {
+			channel = 2
+		}
+		magnification := 1 + camera.ChromaticAberration*float32(1-channel)
+		p = p.Mul(1.0 / magnification)
+		weight = mgl32.Vec3{}
+		weight[channel] = 3
+	}
+
+	px, py = camera.lensToPixel(p)
+	return px, py, weight
+}
+
+// Natural cos^4 falloff for a camera space ray direction
+func vignetting(dir mgl32.Vec3) float32 {
+	cosTheta := -dir.Z()
+	return cosTheta * cosTheta * cosTheta * cosTheta
+}
+
+// Returns an ST-map of the lens distortion for the image of one eye.
+// Each pixel of the undistorted image holds the normalized position
+// (origin at bottom left) to sample from the distorted render.
+// Camera must be initialized
+func (camera *Camera) STMap() *image.NRGBA64 {
+	width, height := camera.eyeWidth, camera.eyeHeight
+	stmap := image.NewNRGBA64(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := camera.Distortion.Distort(camera.pixelToLens(float32(x)+0.5, float32(y)+0.5))
+			px, py := camera.lensToPixel(p)
+
+			s := math.Min(math.Max(float64(px/float32(width)), 0), 1)
+			t := math.Min(math.Max(1-float64(py/float32(height)), 0), 1)
+
+			stmap.SetNRGBA64(x, y, color.NRGBA64{
+				R: uint16(s * 65535),
+				G: uint16(t * 65535),
+				B: 0,
+				A: 65535,
+			})
+		}
+	}
+
+	return stmap
+}
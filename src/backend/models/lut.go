@@ -0,0 +1,153 @@
+package models
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// 3D lookup table read from a .cube file
+type LUT3D struct {
+	Title     string
+	Size      int
+	DomainMin mgl32.Vec3
+	DomainMax mgl32.Vec3
+
+	// Red changes fastest, then green, then blue
+	Table []mgl32.Vec3
+}
+
+func ParseCubeLUT(raw string) (*LUT3D, error) {
+	lut := &LUT3D{
+		DomainMin: mgl32.Vec3{0, 0, 0},
+		DomainMax: mgl32.Vec3{1, 1, 1},
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "TITLE":
+			lut.Title = strings.Trim(strings.TrimPrefix(line, "TITLE"), " \"")
+		case "LUT_3D_SIZE":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("invalid LUT_3D_SIZE: %s", line)
+			}
+			size, err := strconv.Atoi(fields[1])
+			if err != nil || size < 2 {
+				return nil, fmt.Errorf("invalid LUT_3D_SIZE: %s", line)
+			}
+			lut.Size = size
+			lut.Table = make([]mgl32.Vec3, 0, size*size*size)
+		case "DOMAIN_MIN", "DOMAIN_MAX":
+			v, err := parseCubeTriplet(fields[1:])
+			if err != nil {
+				return nil, err
+			}
+			if fields[0] == "DOMAIN_MIN" {
+				lut.DomainMin = v
+			} else {
+				lut.DomainMax = v
+			}
+		case "LUT_3D_INPUT_RANGE":
+			// Same domain on every axis
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("invalid LUT_3D_INPUT_RANGE: %s", line)
+			}
+			var inputRange [2]float32
+			for i, field := range fields[1:] {
+				f, err := strconv.ParseFloat(field, 32)
+				if err != nil {
+					return nil, fmt.Errorf("invalid LUT_3D_INPUT_RANGE: %s", line)
+				}
+				inputRange[i] = float32(f)
+			}
+			lut.DomainMin = mgl32.Vec3{inputRange[0], inputRange[0], inputRange[0]}
+			lut.DomainMax = mgl32.Vec3{inputRange[1], inputRange[1], inputRange[1]}
+		case "LUT_1D_SIZE":
+			return nil, fmt.Errorf("1D LUTs are not supported")
+		default:
+			if lut.Size == 0 {
+				return nil, fmt.Errorf("LUT data before LUT_3D_SIZE")
+			}
+			v, err := parseCubeTriplet(fields)
+			if err != nil {
+				return nil, err
+			}
+			lut.Table = append(lut.Table, v)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if lut.Size == 0 || len(lut.Table) != lut.Size*lut.Size*lut.Size {
+		return nil, fmt.Errorf("LUT has %d entries, expected %d", len(lut.Table), lut.Size*lut.Size*lut.Size)
+	}
+
+	// Colors are scaled by the domain size when applied
+	for i := 0; i < 3; i++ {
+		if lut.DomainMin[i] >= lut.DomainMax[i] {
+			return nil, fmt.Errorf("LUT domain min %v is not below max %v", lut.DomainMin, lut.DomainMax)
+		}
+	}
+
+	return lut, nil
+}
+
+func parseCubeTriplet(fields []string) (mgl32.Vec3, error) {
+	if len(fields) != 3 {
+		return mgl32.Vec3{}, fmt.Errorf("expected 3 values, got %v", fields)
+	}
+	var v mgl32.Vec3
+	for i, field := range fields {
+		f, err := strconv.ParseFloat(field, 32)
+		if err != nil {
+			return mgl32.Vec3{}, err
+		}
+		v[i] = float32(f)
+	}
+	return v, nil
+}
+
+func (lut *LUT3D) at(r int, g int, b int) mgl32.Vec3 {
+	return lut.Table[r+lut.Size*(g+lut.Size*b)]
+}
+
+// Applies the LUT with trilinear interpolation
+func (lut *LUT3D) Apply(c mgl32.Vec3) mgl32.Vec3 {
+	var index [3]int
+	var fraction [3]float32
+	for i := 0; i < 3; i++ {
+		x := (c[i] - lut.DomainMin[i]) / (lut.DomainMax[i] - lut.DomainMin[i])
+		x = mgl32.Clamp(x, 0, 1) * float32(lut.Size-1)
+		index[i] = int(x)
+		if index[i] >= lut.Size-1 {
+			index[i] = lut.Size - 2
+		}
+		fraction[i] = x - float32(index[i])
+	}
+
+	r, g, b := index[0], index[1], index[2]
+	fr, fg, fb := fraction[0], fraction[1], fraction[2]
+
+	lerp := func(a mgl32.Vec3, b mgl32.Vec3, t float32) mgl32.Vec3 {
+		return a.Add(b.Sub(a).Mul(t))
+	}
+
+	c00 := lerp(lut.at(r, g, b), lut.at(r+1, g, b), fr)
+	c10 := lerp(lut.at(r, g+1, b), lut.at(r+1, g+1, b), fr)
+	c01 := lerp(lut.at(r, g, b+1), lut.at(r+1, g, b+1), fr)
+	c11 := lerp(lut.at(r, g+1, b+1), lut.at(r+1, g+1, b+1), fr)
+
+	return lerp(lerp(c00, c10, fg), lerp(c01, c11, fg), fb)
+}
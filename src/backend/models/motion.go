@@ -0,0 +1,110 @@
+package models
+
+import (
+	"math"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Transform that moves linearly from Transform to EndTransform
+// over the frame interval [0, 1]. Rotation is interpolated with slerp
+type MotionTransform struct {
+	Transform    mgl32.Mat4
+	EndTransform mgl32.Mat4
+
+	moving bool
+
+	startTranslation mgl32.Vec3
+	endTranslation   mgl32.Vec3
+	startRotation    mgl32.Quat
+	endRotation      mgl32.Quat
+	startScale       mgl32.Vec3
+	endScale         mgl32.Vec3
+}
+
+// Motion of an OBJ group, declared in the scene
+type ObjectMotion struct {
+	Group string
+	MotionTransform
+}
+
+func NewMotionTransform(start mgl32.Mat4, end mgl32.Mat4) *MotionTransform {
+	motion := &MotionTransform{
+		Transform:    start,
+		EndTransform: end,
+	}
+	motion.Initialize()
+	return motion
+}
+
+// Decomposes the start and end transforms for interpolation. An end
+// transform left empty is treated as equal to the start transform
+func (motion *MotionTransform) Initialize() {
+	if math.Abs(float64(motion.Transform.Trace())) < 0.001 {
+		motion.Transform = mgl32.Ident4()
+	}
+	if math.Abs(float64(motion.EndTransform.Trace())) < 0.001 {
+		motion.EndTransform = motion.Transform
+	}
+
+	motion.startTranslation, motion.startRotation, motion.startScale = decomposeTransform(motion.Transform)
+	motion.endTranslation, motion.endRotation, motion.endScale = decomposeTransform(motion.EndTransform)
+
+	// Interpolate along the shortest arc
+	if motion.startRotation.Dot(motion.endRotation) < 0 {
+		motion.endRotation = motion.endRotation.Scale(-1)
+	}
+
+	motion.moving = !motion.Transform.ApproxEqual(motion.EndTransform)
+}
+
+func (motion *MotionTransform) IsMoving() bool {
+	return motion.moving
+}
+
+// Returns the transform at the given time of the frame interval
+func (motion *MotionTransform) At(time float32) mgl32.Mat4 {
+	if !motion.moving {
+		return motion.Transform
+	}
+
+	translation, rotation, scale := motion.interpolate(time)
+
+	return mgl32.Translate3D(translation.X(), translation.Y(), translation.Z()).
+		Mul4(rotation.Mat4()).
+		Mul4(mgl32.Scale3D(scale.X(), scale.Y(), scale.Z()))
+}
+
+// Returns the inverse of the transform at the given time of the frame interval
+func (motion *MotionTransform) InverseAt(time float32) mgl32.Mat4 {
+	translation, rotation, scale := motion.interpolate(time)
+
+	return mgl32.Scale3D(1.0/scale.X(), 1.0/scale.Y(), 1.0/scale.Z()).
+		Mul4(rotation.Conjugate().Mat4()).
+		Mul4(mgl32.Translate3D(-translation.X(), -translation.Y(), -translation.Z()))
+}
+
+func (motion *MotionTransform) interpolate(time float32) (mgl32.Vec3, mgl32.Quat, mgl32.Vec3) {
+	translation := motion.startTranslation.Add(motion.endTranslation.Sub(motion.startTranslation).Mul(time))
+	rotation := mgl32.QuatSlerp(motion.startRotation, motion.endRotation, time)
+	scale := motion.startScale.Add(motion.endScale.Sub(motion.startScale).Mul(time))
+	return translation, rotation, scale
+}
+
+// Splits an affine transform into translation, rotation and scale
+func decomposeTransform(transform mgl32.Mat4) (mgl32.Vec3, mgl32.Quat, mgl32.Vec3) {
+	translation := transform.Col(3).Vec3()
+
+	x := transform.Col(0).Vec3()
+	y := transform.Col(1).Vec3()
+	z := transform.Col(2).Vec3()
+	scale := mgl32.Vec3{x.Len(), y.Len(), z.Len()}
+
+	rotation := mgl32.Mat3FromCols(
+		x.Mul(1.0/scale.X()),
+		y.Mul(1.0/scale.Y()),
+		z.Mul(1.0/scale.Z()),
+	).Mat4()
+
+	return translation, mgl32.Mat4ToQuat(rotation).Normalize(), scale
+}
@@ -0,0 +1,112 @@
+package models
+
+import (
+	"math"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+	"github.com/udhos/gwob"
+)
+
+func TestMotionTransformInterpolation(t *testing.T) {
+	start := mgl32.Ident4()
+	end := mgl32.Translate3D(2, 0, 0).Mul4(mgl32.HomogRotate3DY(mgl32.DegToRad(90)))
+	motion := NewMotionTransform(start, end)
+
+	if !motion.IsMoving() {
+		t.Fatalf("Motion transform should be moving")
+	}
+
+	middle := motion.At(0.5)
+	if !middle.Col(3).Vec3().ApproxEqualThreshold(mgl32.Vec3{1, 0, 0}, 0.0001) {
+		t.Errorf("Translation not interpolated, got %v", middle.Col(3).Vec3())
+	}
+
+	expected := mgl32.HomogRotate3DY(mgl32.DegToRad(45))
+	if !matricesClose(middle, expected, true) {
+		t.Errorf("Rotation not slerped, got %v", middle.Mat3())
+	}
+
+	if !matricesClose(motion.At(0.3).Mul4(motion.InverseAt(0.3)), mgl32.Ident4(), false) {
+		t.Errorf("Inverse transform does not match")
+	}
+}
+
+// Compares two matrices element-wise, optionally ignoring translation
+func matricesClose(a mgl32.Mat4, b mgl32.Mat4, rotationOnly bool) bool {
+	if rotationOnly {
+		return matricesClose(a.Mat3().Mat4(), b.Mat3().Mat4(), false)
+	}
+	for i := range a {
+		if math.Abs(float64(a[i]-b[i])) > 0.0001 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMovingTriangleIntersection(t *testing.T) {
+	triangle := NewTriangle(mgl32.Vec3{-1, -1, 0}, mgl32.Vec3{1, -1, 0}, mgl32.Vec3{0, 1, 0}, &gwob.Material{}, 0)
+	triangle.SetMotion(NewMotionTransform(mgl32.Ident4(), mgl32.Translate3D(10, 0, 0)))
+
+	// Bounds cover the whole motion
+	if triangle.Min().X() > -1 || triangle.Max().X() < 11 {
+		t.Errorf("Motion bounds not expanded, got %v %v", triangle.Min(), triangle.Max())
+	}
+
+	ray := NewRay(mgl32.Vec3{10, 0, 5}, mgl32.Vec3{0, 0, -1}, 0, 0, 0)
+
+	ray.Time = 0
+	if hit, _, _ := triangle.RayIntersect(ray); hit > 0 {
+		t.Errorf("Ray should miss the triangle at the start of the frame")
+	}
+
+	ray.Time = 1
+	if hit, _, _ := triangle.RayIntersect(ray); hit != 5 {
+		t.Errorf("Ray should hit the triangle at the end of the frame, got t %v", hit)
+	}
+}
+
+// Moving triangles are culled by their facing like static ones, also
+// when the transform scales them
+func TestMovingTriangleCulling(t *testing.T) {
+	vertices := [3]mgl32.Vec3{{-1, -1, 0}, {1, -1, 0}, {0, 1, 0}}
+	static := NewTriangle(vertices[0], vertices[1], vertices[2], &gwob.Material{}, 0)
+	moving := NewTriangle(vertices[0].Mul(0.01), vertices[1].Mul(0.01), vertices[2].Mul(0.01), &gwob.Material{}, 0)
+	moving.SetMotion(NewMotionTransform(mgl32.Scale3D(100, 100, 100), mgl32.HomogRotate3DY(0.5).Mul4(mgl32.Scale3D(100, 100, 100))))
+
+	for _, origin := range []mgl32.Vec3{{0, 0, 5}, {0, 0, -5}} {
+		ray := NewRay(origin, origin.Mul(-1).Normalize(), 0, 0, 0)
+		staticHit, _, _ := static.RayIntersect(ray)
+		movingHit, _, _ := moving.RayIntersect(ray)
+		if (staticHit > 0) != (movingHit > 0) {
+			t.Errorf("Ray from %v hit the static triangle at %v, the moving one at %v", origin, staticHit, movingHit)
+		}
+	}
+}
+
+// A moving light is placed where it is during the shutter interval
+func TestMovingLight(t *testing.T) {
+	light := &gwob.Material{Name: "Light"}
+	triangles := []*Triangle{
+		NewTriangle(mgl32.Vec3{-1, 4, -1}, mgl32.Vec3{1, 4, 1}, mgl32.Vec3{1, 4, -1}, light, 0),
+		NewTriangle(mgl32.Vec3{-1, 4, -1}, mgl32.Vec3{-1, 4, 1}, mgl32.Vec3{1, 4, 1}, light, 1),
+	}
+	motion := NewMotionTransform(mgl32.Translate3D(10, 0, 0), mgl32.Translate3D(20, 0, 0))
+	for _, triangle := range triangles {
+		triangle.SetMotion(motion)
+	}
+
+	context := &RenderContext{Triangles: triangles}
+	transform, _, _, found := context.lightGeometry(0)
+	if !found || transform.Col(3).Vec3().Sub(mgl32.Vec3{10, 4, 0}).Len() > 0.001 {
+		t.Fatalf("Light at the start of the frame is at %v", transform.Col(3))
+	}
+
+	context.Light = NewAreaLight(transform, mgl32.Vec2{1, 1}, mgl32.Vec3{}, mgl32.Vec3{0, -1, 0})
+	pass := &RenderPass{ShutterOpen: 0.5, ShutterClose: 1}
+	pass.Initialize(context)
+	if position := context.Light.Transform.Col(3).Vec3(); position.Sub(mgl32.Vec3{17.5, 4, 0}).Len() > 0.001 {
+		t.Errorf("Light during the shutter interval is at %v", position)
+	}
+}
@@ -11,9 +11,17 @@ type Ray struct {
 	Direction mgl32.Vec3
 	Bounce    uint8
 
+	// Time of the frame interval [0, 1] the ray is traced at
+	Time float32
+
+	// Per channel weight of the traced color, used by camera effects
+	Weight mgl32.Vec3
+
 	// Image pixel the ray contributes to
 	X int
 	Y int
+	// Position of a camera ray within the pixel
+	PixelSample mgl32.Vec2
 
 	// Helpers
 	InvDirection mgl32.Vec3
@@ -30,6 +38,7 @@ func NewRay(origin mgl32.Vec3, dir mgl32.Vec3, bounce uint8, x int, y int) *Ray
 		Origin:       origin,
 		Direction:    dir,
 		Bounce:       bounce,
+		Weight:       mgl32.Vec3{1, 1, 1},
 		X:            x,
 		Y:            y,
 		InvDirection: invDir,
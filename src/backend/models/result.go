@@ -1,14 +1,60 @@
 package models
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"image"
+	"io"
+	"math"
+
+	"github.com/go-gl/mathgl/mgl32"
 )
 
+// Version of the binary result header
+const ResultVersion = 1
+
 type RenderResult struct {
-	ExitCode  int         `json:"exitCode"`
+	ExitCode int `json:"exitCode"`
+	// Error code of a failed render
+	Code      string      `json:"code"`
 	Message   string      `json:"message"`
 	ImageData *image.RGBA `json:"imageData"`
+
+	// Termination criterion that stopped the render and the average
+	// number of samples taken per pixel
+	StopReason      string  `json:"stopReason"`
+	SamplesPerPixel float32 `json:"samplesPerPixel"`
+
+	// Linear film colors of the image, for float32 binary results
+	Colors []mgl32.Vec3 `json:"-"`
+}
+
+// Pixel data format of binary results
+type PixelFormat string
+
+const (
+	// Developed 8-bit RGBA image
+	RGBA8 PixelFormat = "rgba8"
+	// Linear film colors as RGBA float32, little endian
+	Float32 PixelFormat = "float32"
+)
+
+// JSON header of a binary result. The region is the part of the render
+// pass covered by the pixel data, empty when nothing changed
+type ResultHeader struct {
+	Version         int         `json:"version"`
+	ExitCode        int         `json:"exitCode"`
+	Code            string      `json:"code"`
+	Message         string      `json:"message"`
+	StopReason      string      `json:"stopReason"`
+	SamplesPerPixel float32     `json:"samplesPerPixel"`
+	Format          PixelFormat `json:"format"`
+	X               int         `json:"x"`
+	Y               int         `json:"y"`
+	Width           int         `json:"width"`
+	Height          int         `json:"height"`
 }
 
 func (res *RenderResult) Output() string {
@@ -19,3 +65,131 @@ func (res *RenderResult) Output() string {
 
 	return string(data)
 }
+
+// Writes the result as a little endian uint32 header length, the JSON
+// header and the pixels of the region row by row
+func (res *RenderResult) WriteBinary(w io.Writer, format PixelFormat, region image.Rectangle) error {
+	if format == "" {
+		format = RGBA8
+	}
+	if res.ImageData == nil {
+		region = image.Rectangle{}
+	} else {
+		region = region.Intersect(res.ImageData.Bounds())
+	}
+	if format == Float32 && !region.Empty() && len(res.Colors) != res.ImageData.Bounds().Dx()*res.ImageData.Bounds().Dy() {
+		return fmt.Errorf("result has no float colors")
+	}
+
+	header, err := json.Marshal(&ResultHeader{
+		Version:         ResultVersion,
+		ExitCode:        res.ExitCode,
+		Code:            res.Code,
+		Message:         res.Message,
+		StopReason:      res.StopReason,
+		SamplesPerPixel: res.SamplesPerPixel,
+		Format:          format,
+		X:               region.Min.X,
+		Y:               region.Min.Y,
+		Width:           region.Dx(),
+		Height:          region.Dy(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(header))); err != nil {
+		return err
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		var row []byte
+		switch format {
+		case RGBA8:
+			start := res.ImageData.PixOffset(region.Min.X, y)
+			row = res.ImageData.Pix[start : start+4*region.Dx()]
+		case Float32:
+			row = make([]byte, 16*region.Dx())
+			width := res.ImageData.Bounds().Dx()
+			for x := region.Min.X; x < region.Max.X; x++ {
+				c := res.Colors[x+y*width]
+				pixel := row[16*(x-region.Min.X):]
+				binary.LittleEndian.PutUint32(pixel[0:], math.Float32bits(c.X()))
+				binary.LittleEndian.PutUint32(pixel[4:], math.Float32bits(c.Y()))
+				binary.LittleEndian.PutUint32(pixel[8:], math.Float32bits(c.Z()))
+				binary.LittleEndian.PutUint32(pixel[12:], math.Float32bits(1))
+			}
+		default:
+			return fmt.Errorf("unknown pixel format %s", format)
+		}
+		if _, err := w.Write(row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (res *RenderResult) Binary(format PixelFormat, region image.Rectangle) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := res.WriteBinary(&buffer, format, region); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Reads the header and the pixel data of a binary result
+func ReadBinaryResult(r io.Reader) (*ResultHeader, []byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return nil, nil, err
+	}
+
+	raw := make([]byte, length)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, nil, err
+	}
+	header := &ResultHeader{}
+	if err := json.Unmarshal(raw, header); err != nil {
+		return nil, nil, err
+	}
+
+	pixelSize := 4
+	if header.Format == Float32 {
+		pixelSize = 16
+	}
+	pixels := make([]byte, pixelSize*header.Width*header.Height)
+	if _, err := io.ReadFull(r, pixels); err != nil {
+		return nil, nil, err
+	}
+
+	return header, pixels, nil
+}
+
+// Returns the bounding box of the pixels that differ between the images
+func ChangedRegion(previous *image.RGBA, current *image.RGBA) image.Rectangle {
+	bounds := current.Bounds()
+	if previous == nil || previous.Bounds() != bounds {
+		return bounds
+	}
+
+	changed := image.Rectangle{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		start := current.PixOffset(bounds.Min.X, y)
+		end := start + 4*bounds.Dx()
+		if bytes.Equal(previous.Pix[start:end], current.Pix[start:end]) {
+			continue
+		}
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := current.PixOffset(x, y)
+			if !bytes.Equal(previous.Pix[i:i+4], current.Pix[i:i+4]) {
+				changed = changed.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+
+	return changed
+}
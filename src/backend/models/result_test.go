@@ -0,0 +1,68 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func TestBinaryResultRoundTrip(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	img.SetRGBA(2, 1, color.RGBA{10, 20, 30, 255})
+	colors := make([]mgl32.Vec3, 12)
+	colors[2+1*4] = mgl32.Vec3{0.5, 2, 4}
+
+	result := &RenderResult{ImageData: img, Colors: colors, StopReason: "maxSamples", SamplesPerPixel: 3}
+
+	var buffer bytes.Buffer
+	if err := result.WriteBinary(&buffer, RGBA8, image.Rect(2, 1, 4, 3)); err != nil {
+		t.Fatal(err)
+	}
+	header, pixels, err := ReadBinaryResult(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.X != 2 || header.Y != 1 || header.Width != 2 || header.Height != 2 || header.StopReason != "maxSamples" {
+		t.Errorf("Unexpected header %+v", header)
+	}
+	if !bytes.Equal(pixels[0:4], []byte{10, 20, 30, 255}) || len(pixels) != 16 {
+		t.Errorf("Region pixels should start at the region corner, got %v", pixels)
+	}
+
+	buffer.Reset()
+	if err := result.WriteBinary(&buffer, Float32, img.Bounds()); err != nil {
+		t.Fatal(err)
+	}
+	header, pixels, err = ReadBinaryResult(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := 16 * (2 + 1*4)
+	if header.Format != Float32 || math.Float32frombits(binary.LittleEndian.Uint32(pixels[offset+4:])) != 2 {
+		t.Errorf("Float pixels should hold the linear colors, header %+v", header)
+	}
+}
+
+func TestChangedRegion(t *testing.T) {
+	previous := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	current := image.NewRGBA(image.Rect(0, 0, 8, 8))
+
+	if region := ChangedRegion(previous, current); !region.Empty() {
+		t.Errorf("Equal images should have no changed region, got %v", region)
+	}
+
+	current.SetRGBA(2, 5, color.RGBA{1, 0, 0, 0})
+	current.SetRGBA(6, 3, color.RGBA{1, 0, 0, 0})
+	if region := ChangedRegion(previous, current); region != image.Rect(2, 3, 7, 6) {
+		t.Errorf("Changed region should bound the changed pixels, got %v", region)
+	}
+
+	if region := ChangedRegion(nil, current); region != current.Bounds() {
+		t.Errorf("Without a previous image the whole image changed, got %v", region)
+	}
+}
@@ -3,6 +3,18 @@ package models
 type Scene struct {
 	Materials []Material
 	Spheres   []Sphere
+	Motions   []ObjectMotion
+	Instances []ObjectInstance
+}
+
+// Returns the motion declared for the given OBJ group, if any
+func (scene *Scene) GroupMotion(group string) *MotionTransform {
+	for i := range scene.Motions {
+		if scene.Motions[i].Group == group {
+			return &scene.Motions[i].MotionTransform
+		}
+	}
+	return nil
 }
 
 func (scene *Scene) LinkMaterials() {
@@ -13,4 +13,46 @@ type RenderSettings struct {
 	ForceDebugLight     bool
 	DebugLightAtCamera  bool
 	DebugLightTransform mgl32.Mat4
+
+	// Display transform. Exposure compensation is in stops and
+	// the white point is used by the extended Reinhard operator
+	Exposure       float32
+	ToneMapper     ToneMapper
+	WhitePoint     float32
+	OutputEncoding OutputEncoding
+	ApplyLUT       bool
+
+	// Pixel reconstruction filter, radius in pixels
+	Filter       FilterType
+	FilterRadius float32
+
+	// Edge-avoiding a-trous wavelet denoiser guided by the first
+	// hit features. Zero values use the defaults of the denoiser
+	Denoise            bool
+	DenoiseIterations  int
+	DenoiseColorSigma  float32
+	DenoiseNormalSigma float32
+	DenoiseDepthSigma  float32
+
+	// Adaptive sampling takes more samples in pixels whose relative error
+	// exceeds the threshold, up to Camera.RaysPerPixel samples per pixel
+	AdaptiveSampling   bool
+	AdaptiveThreshold  float32
+	AdaptiveMinSamples int
+
+	// Termination criteria, the first one reached stops the render.
+	// Time budget is in seconds and the target noise is the estimated
+	// relative mean squared error. Zero values are disabled
+	TimeBudget    float32
+	RayBudget     uint64
+	TargetNoise   float32
+	TargetSamples int
+
+	// Pixel format of binary results and whether incremental
+	// results only contain the region changed since the last one
+	ResultFormat       PixelFormat
+	ChangedRegionsOnly bool
+
+	// Sample rounds between checkpoints of incremental renders, zero disables
+	CheckpointInterval int
 }
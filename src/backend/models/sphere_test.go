@@ -132,8 +132,8 @@ func BenchmarkRaySphere(b *testing.B) {
 		Radius: 0.5,
 	}
 	// Create a random ray
-	origin := utility.RandomInUnitSphere().Normalize()
-	direction := utility.RandomInUnitSphere().Normalize()
+	origin := utility.RandomInUnitSphere(nil).Normalize()
+	direction := utility.RandomInUnitSphere(nil).Normalize()
 	ray := NewRay(origin, direction, 0, 0, 0)
 	b.ResetTimer()
 
@@ -2,9 +2,10 @@ package models
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"image"
 
-	"image/color"
 	"image/draw"
 	_ "image/png"
 
@@ -21,31 +22,49 @@ type Texture struct {
 	Height  int
 }
 
-func NewTexture(name string, buffer *[]byte) *Texture {
+// Largest decoded texture, 256 MB of RGBA pixels
+const MaxTexturePixels = 8192 * 8192
+
+var (
+	ErrMissingTexture  = errors.New("missing texture data")
+	ErrTextureTooLarge = errors.New("texture exceeds the size limit")
+)
+
+func NewTexture(name string, buffer *[]byte) (*Texture, error) {
 	t := Texture{
 		Name: name,
 	}
 
-	reader := bytes.NewReader(*buffer)
+	if buffer == nil {
+		return nil, fmt.Errorf("texture %s: %w", name, ErrMissingTexture)
+	}
+	// The size in the header is checked before the pixels are allocated
+	config, _, err := image.DecodeConfig(bytes.NewReader(*buffer))
+	if err != nil {
+		return nil, fmt.Errorf("texture %s: %w", name, err)
+	}
+	if config.Width*config.Height > MaxTexturePixels {
+		return nil, fmt.Errorf("texture %s of %dx%d pixels: %w", name, config.Width, config.Height, ErrTextureTooLarge)
+	}
 
-	img, _, err := image.Decode(reader)
+	img, _, err := image.Decode(bytes.NewReader(*buffer))
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("texture %s: %w", name, err)
 	}
 
 	t.Width = img.Bounds().Dx()
 	t.Height = img.Bounds().Dy()
-	switch img.ColorModel() {
-	case color.RGBAModel:
-		t.Texture = img.(*image.RGBA)
-	case color.NRGBAModel:
-		rawImage := img.(*image.NRGBA)
+	switch rawImage := img.(type) {
+	case *image.RGBA:
+		t.Texture = rawImage
+	default:
+		// Other color models are converted
 		bounds := rawImage.Bounds()
 		t.Texture = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
 		draw.Draw(t.Texture, t.Texture.Bounds(), rawImage, bounds.Min, draw.Src)
 	}
 
-	return &t
+	return &t, nil
 }
 
 func (t *Texture) SampleUV(uv mgl32.Vec2) mgl32.Vec3 {
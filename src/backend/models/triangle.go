@@ -28,17 +28,35 @@ type Triangle struct {
 	Edge2 mgl32.Vec3
 
 	IsLight bool
+
+	// Moving triangles have their vertices in object space. Bounds
+	// are expanded to cover the whole motion
+	Motion    *MotionTransform
+	motionMin mgl32.Vec3
+	motionMax mgl32.Vec3
 }
 
+// Number of time steps used to approximate the bounds of a moving triangle
+const motionBoundsSteps = 8
+
 func (t *Triangle) Center() mgl32.Vec3 {
+	if t.Motion != nil {
+		return t.motionMin.Add(t.motionMax).Mul(0.5)
+	}
 	return t.Vertices[0].Add(t.Vertices[1]).Add(t.Vertices[2]).Mul(1.0 / 3.0)
 }
 
 func (t *Triangle) Min() mgl32.Vec3 {
+	if t.Motion != nil {
+		return t.motionMin
+	}
 	return utility.Vec3Min(utility.Vec3Min(t.Vertices[0], t.Vertices[1]), t.Vertices[2])
 }
 
 func (t *Triangle) Max() mgl32.Vec3 {
+	if t.Motion != nil {
+		return t.motionMax
+	}
 	return utility.Vec3Max(utility.Vec3Max(t.Vertices[0], t.Vertices[1]), t.Vertices[2])
 }
 
@@ -64,6 +82,65 @@ func NewTriangle(v0 mgl32.Vec3, v1 mgl32.Vec3, v2 mgl32.Vec3, material *gwob.Mat
 	return tri
 }
 
+// Makes the triangle move with the given transform. Moving triangles
+// are intersected in object space at the time of the ray
+func (t *Triangle) SetMotion(motion *MotionTransform) {
+	if motion == nil || !motion.IsMoving() {
+		// Static transform can be baked into the vertices
+		if motion != nil {
+			transform := motion.At(0)
+			*t = *NewTriangle(
+				mgl32.TransformCoordinate(t.Vertices[0], transform),
+				mgl32.TransformCoordinate(t.Vertices[1], transform),
+				mgl32.TransformCoordinate(t.Vertices[2], transform),
+				t.Material,
+				t.Index,
+			)
+		}
+		return
+	}
+
+	t.Motion = motion
+	t.motionMin = mgl32.Vec3{math.MaxFloat32, math.MaxFloat32, math.MaxFloat32}
+	t.motionMax = mgl32.Vec3{-math.MaxFloat32, -math.MaxFloat32, -math.MaxFloat32}
+	for i := 0; i <= motionBoundsSteps; i++ {
+		transform := motion.At(float32(i) / motionBoundsSteps)
+		for _, vertex := range t.Vertices {
+			world := mgl32.TransformCoordinate(vertex, transform)
+			t.motionMin = utility.Vec3Min(t.motionMin, world)
+			t.motionMax = utility.Vec3Max(t.motionMax, world)
+		}
+	}
+
+	// Rotation moves the vertices along arcs between the steps
+	padding := t.motionMax.Sub(t.motionMin).Len() * 0.01
+	t.motionMin = t.motionMin.Sub(mgl32.Vec3{padding, padding, padding})
+	t.motionMax = t.motionMax.Add(mgl32.Vec3{padding, padding, padding})
+}
+
+// Returns the world space normal at the given time
+func (t *Triangle) NormalAt(time float32) mgl32.Vec3 {
+	if t.Motion == nil {
+		return t.Normal
+	}
+	return t.Motion.InverseAt(time).Transpose().Mat3().Mul3x1(t.Normal).Normalize()
+}
+
+// Returns a static copy of a moving triangle with its vertices in world
+// space at the given time
+func (t *Triangle) worldAt(time float32) *Triangle {
+	transform := t.Motion.At(time)
+	world := NewTriangle(
+		mgl32.TransformCoordinate(t.Vertices[0], transform),
+		mgl32.TransformCoordinate(t.Vertices[1], transform),
+		mgl32.TransformCoordinate(t.Vertices[2], transform),
+		t.Material,
+		t.Index,
+	)
+	world.TextureCoords = t.TextureCoords
+	return world
+}
+
 func TriangleSorter(axis mgl32.Vec3, triangles []*Triangle, startIndex int, endIndex int) {
 	sort.Slice(triangles[startIndex:endIndex+1], func(i, j int) bool {
 		a := axis.Dot(triangles[startIndex+i].Center())
@@ -76,11 +153,32 @@ func TriangleSorter(axis mgl32.Vec3, triangles []*Triangle, startIndex int, endI
 }
 
 func (triangle *Triangle) RayIntersect(ray *Ray) (float32, float32, float32) {
+	if triangle.Motion != nil {
+		// The ray parameter t is preserved by the affine transform
+		// as long as the direction is not normalized
+		inverse := triangle.Motion.InverseAt(ray.Time)
+		localRay := &Ray{
+			Origin:    mgl32.TransformCoordinate(ray.Origin, inverse),
+			Direction: mgl32.TransformNormal(ray.Direction, inverse),
+		}
+
+		// Culled by the facing like static triangles are in the BVH
+		// leaves. The scale of the transform changes the determinant,
+		// so it only guards the division
+		if triangle.Normal.Dot(localRay.Direction) > 0 {
+			return -1, 0, 0
+		}
+		return triangle.rayIntersect(localRay, 1e-20)
+	}
+	return triangle.rayIntersect(ray, 0.0001)
+}
+
+func (triangle *Triangle) rayIntersect(ray *Ray, minDet float32) (float32, float32, float32) {
 	// From https://www.scratchapixel.com/lessons/3d-basic-rendering/ray-tracing-rendering-a-triangle/moller-trumbore-ray-triangle-intersection
 	v0v2 := triangle.Edge2.Mul(-1)
 	pvec := ray.Direction.Cross(v0v2)
 	det := triangle.Edge0.Dot(pvec)
-	if det < 0.0001 {
+	if det < minDet {
 		return -1, 0, 0
 	}
 
@@ -142,7 +240,11 @@ func GetTriangleBounds(triangles []*Triangle) (mgl32.Vec3, mgl32.Vec3) {
 	var maxx, maxy, maxz float32 = -math.MaxFloat32, -math.MaxFloat32, -math.MaxFloat32
 
 	for _, triangle := range triangles {
-		for _, vertex := range triangle.Vertices {
+		vertices := triangle.Vertices[:]
+		if triangle.Motion != nil {
+			vertices = []mgl32.Vec3{triangle.motionMin, triangle.motionMax}
+		}
+		for _, vertex := range vertices {
 			if vertex.X() < minx {
 				minx = vertex.X()
 			}
@@ -11,8 +11,8 @@ import (
 func BenchmarkRayTriangle(b *testing.B) {
 	triangle := NewTriangle(mgl32.Vec3{0, 0, 0}, mgl32.Vec3{1, 0, 0}, mgl32.Vec3{0, 1, 0}, &gwob.Material{}, 0)
 	// Create a random ray
-	origin := utility.RandomInUnitSphere().Normalize()
-	direction := utility.RandomInUnitSphere().Normalize()
+	origin := utility.RandomInUnitSphere(nil).Normalize()
+	direction := utility.RandomInUnitSphere(nil).Normalize()
 	ray := NewRay(origin, direction, 0, 0, 0)
 	b.ResetTimer()
 
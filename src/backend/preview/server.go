@@ -0,0 +1,334 @@
+package preview
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"raytracer/models"
+	"raytracer/process"
+	"sync"
+	"time"
+)
+
+const jpegQuality = 85
+
+// Progress of the current accumulation
+type Status struct {
+	Width  int
+	Height int
+
+	// Increased whenever a camera or settings change restarts accumulation
+	Generation int
+
+	Rounds          int
+	SamplesPerPixel float32
+	Rays            uint64
+	RaysPerSecond   float64
+	StopReason      string
+}
+
+// Developed image of a sample round, encoded on demand
+type frame struct {
+	image *image.RGBA
+
+	pngOnce  sync.Once
+	png      []byte
+	jpegOnce sync.Once
+	jpeg     []byte
+}
+
+func (f *frame) PNG() []byte {
+	f.pngOnce.Do(func() {
+		var buffer bytes.Buffer
+		png.Encode(&buffer, f.image)
+		f.png = buffer.Bytes()
+	})
+	return f.png
+}
+
+func (f *frame) JPEG() []byte {
+	f.jpegOnce.Do(func() {
+		var buffer bytes.Buffer
+		jpeg.Encode(&buffer, f.image, &jpeg.Options{Quality: jpegQuality})
+		f.jpeg = buffer.Bytes()
+	})
+	return f.jpeg
+}
+
+// Renders a frame progressively and streams the accumulating image over
+// HTTP. Only the render loop touches the render context, changes made
+// through the endpoints are applied by the loop between sample rounds
+type Server struct {
+	mu sync.Mutex
+
+	context *models.RenderContext
+	pass    models.RenderPass
+	status  Status
+
+	// Pass change waiting for the render loop
+	pending *models.RenderPass
+	wake    chan struct{}
+
+	frame *frame
+	// Closed and replaced whenever a new frame is published
+	updated chan struct{}
+}
+
+// Creates a server rendering the whole frame of the pass
+// in an initialized render context
+func NewServer(context *models.RenderContext, pass models.RenderPass) *Server {
+	pass.XOffset, pass.YOffset = 0, 0
+	pass.Width, pass.Height = pass.TotalWidth, pass.TotalHeight
+
+	return &Server{
+		context: context,
+		pass:    pass,
+		pending: &pass,
+		wake:    make(chan struct{}, 1),
+		updated: make(chan struct{}),
+	}
+}
+
+// Runs the accumulation loop until the context is cancelled. Waits for
+// changes once the render stops at its sample count or another criterion
+func (server *Server) Run(ctx context.Context) error {
+	var render *process.IncrementalRender
+	var started time.Time
+	var startRays uint64
+
+	// Steps stop early when the pass changes or the server shuts down
+	server.context.Cancelled = func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return server.pending != nil || ctx.Err() != nil
+	}
+	defer func() { server.context.Cancelled = nil }()
+
+	for {
+		server.mu.Lock()
+		pending := server.pending
+		server.pending = nil
+		generation := server.status.Generation
+		server.mu.Unlock()
+
+		if pending != nil {
+			pass := *pending
+			pass.Initialize(server.context)
+			pass.Camera.Initialize(pass.TotalWidth, pass.TotalHeight)
+			process.SeedSamples(server.context, &pass)
+			render = process.NewIncrementalRender(server.context, &pass)
+			started = time.Now()
+			startRays = server.context.Rays
+		}
+
+		if render.StopReason != process.NotStopped {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-server.wake:
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		render.Step(server.context)
+
+		img := image.NewRGBA(image.Rect(0, 0, render.Pass.Width, render.Pass.Height))
+		process.Develop(server.context, render.Pass, process.Resolve(render.Pass, render.Film), img)
+
+		rays := server.context.Rays - startRays
+		status := Status{
+			Width:           render.Pass.Width,
+			Height:          render.Pass.Height,
+			Generation:      generation,
+			Rounds:          render.Rounds,
+			SamplesPerPixel: render.Film.SamplesPerPixel(),
+			Rays:            rays,
+			RaysPerSecond:   float64(rays) / time.Since(started).Seconds(),
+			StopReason:      string(render.StopReason),
+		}
+
+		server.mu.Lock()
+		// Frames of a pass changed while stepping are dropped
+		if server.pending == nil {
+			server.status = status
+			server.frame = &frame{image: img}
+			close(server.updated)
+			server.updated = make(chan struct{})
+		}
+		server.mu.Unlock()
+	}
+}
+
+// Queues a change of the pass, restarting accumulation
+func (server *Server) restart(change func(pass *models.RenderPass) error) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	pass := server.pass
+	if err := change(&pass); err != nil {
+		return err
+	}
+
+	server.pass = pass
+	server.pending = &pass
+	server.status = Status{Width: pass.Width, Height: pass.Height, Generation: server.status.Generation + 1}
+
+	select {
+	case server.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (server *Server) Status() Status {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.status
+}
+
+// Returns the latest frame and a channel closed when the next one is published
+func (server *Server) latest() (*frame, <-chan struct{}) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.frame, server.updated
+}
+
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, indexPage)
+	case r.URL.Path == "/stream.mjpeg" && r.Method == http.MethodGet:
+		server.serveMJPEG(w, r)
+	case r.URL.Path == "/events" && r.Method == http.MethodGet:
+		server.serveEvents(w, r)
+	case r.URL.Path == "/frame.png" && r.Method == http.MethodGet:
+		server.serveFrame(w, r)
+	case r.URL.Path == "/status" && r.Method == http.MethodGet:
+		writeJSON(w, server.Status())
+	case r.URL.Path == "/camera" && r.Method == http.MethodPost:
+		// Fields left out of the JSON keep their values
+		server.serveChange(w, r, func(pass *models.RenderPass) error {
+			return json.NewDecoder(r.Body).Decode(&pass.Camera)
+		})
+	case r.URL.Path == "/settings" && r.Method == http.MethodPost:
+		server.serveChange(w, r, func(pass *models.RenderPass) error {
+			return json.NewDecoder(r.Body).Decode(&pass.Settings)
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (server *Server) serveChange(w http.ResponseWriter, r *http.Request, change func(pass *models.RenderPass) error) {
+	if err := server.restart(change); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, server.Status())
+}
+
+func (server *Server) serveFrame(w http.ResponseWriter, r *http.Request) {
+	f, _ := server.latest()
+	if f == nil {
+		http.Error(w, "no frame rendered yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(f.PNG())
+}
+
+// Streams every new frame as a part of a multipart JPEG response.
+// Slow clients skip the frames published while they were sending
+func (server *Server) serveMJPEG(w http.ResponseWriter, r *http.Request) {
+	const boundary = "frame"
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+boundary)
+
+	server.stream(w, r, func(f *frame) error {
+		data := f.JPEG()
+		_, err := fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", boundary, len(data))
+		if err == nil {
+			_, err = w.Write(append(data, "\r\n"...))
+		}
+		return err
+	})
+}
+
+// Streams every new frame as a PNG data URL in a server-sent event,
+// followed by a status event
+func (server *Server) serveEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	server.stream(w, r, func(f *frame) error {
+		_, err := fmt.Fprintf(w, "event: frame\ndata: data:image/png;base64,%s\n\n", base64.StdEncoding.EncodeToString(f.PNG()))
+		if err != nil {
+			return err
+		}
+		status, err := json.Marshal(server.Status())
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "event: status\ndata: %s\n\n", status)
+		return err
+	})
+}
+
+func (server *Server) stream(w http.ResponseWriter, r *http.Request, write func(f *frame) error) {
+	flusher, _ := w.(http.Flusher)
+
+	for {
+		f, updated := server.latest()
+		if f != nil {
+			if err := write(f); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-updated:
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+const indexPage = `<!DOCTYPE html>
+<html>
+<head><title>Raytracer preview</title></head>
+<body style="background: #222; color: #ddd; font-family: sans-serif">
+<img id="frame" src="/stream.mjpeg">
+<pre id="status"></pre>
+<script>
+setInterval(async () => {
+  const status = await (await fetch("/status")).json();
+  document.getElementById("status").textContent =
+    status.SamplesPerPixel.toFixed(1) + " spp, " +
+    (status.RaysPerSecond / 1e6).toFixed(2) + " Mrays/s " + status.StopReason;
+}, 1000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,154 @@
+package preview
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"raytracer/distributed"
+	"raytracer/models"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+const testObj = `v -5 -1 -5
+v 5 -1 -5
+v 5 -1 5
+v -5 -1 5
+g Floor
+usemtl White
+f 1 2 3
+f 1 3 4
+`
+
+const testMtl = `newmtl White
+Kd 0.8 0.8 0.8
+`
+
+func testServer(t *testing.T) (*Server, *httptest.Server, context.CancelFunc) {
+	scene, err := distributed.LoadScene(&distributed.SceneData{Obj: testObj, Mtl: testMtl}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pass := models.RenderPass{
+		TotalWidth:  16,
+		TotalHeight: 8,
+		Camera: models.Camera{
+			Transform:               mgl32.Translate3D(0, 0, 5),
+			ProjectionPlaneDistance: 1,
+			FieldOfView:             60,
+			RaysPerPixel:            1000000,
+		},
+		Settings: models.RenderSettings{BounceLimit: 1, LightSampleRays: 1, LightIntensity: 10},
+	}
+
+	server := NewServer(scene, pass)
+	ctx, cancel := context.WithCancel(context.Background())
+	go server.Run(ctx)
+
+	return server, httptest.NewServer(server), cancel
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestServerRestartsOnCameraChange(t *testing.T) {
+	server, httpServer, cancel := testServer(t)
+	defer httpServer.Close()
+	defer cancel()
+
+	waitFor(t, func() bool { return server.Status().Rounds >= 2 })
+	if server.Status().RaysPerSecond <= 0 {
+		t.Error("Status should report the ray rate")
+	}
+
+	response, err := http.Post(httpServer.URL+"/camera", "application/json", strings.NewReader(`{"FieldOfView": 90}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	status := server.Status()
+	if status.Generation != 1 || status.Rounds >= 2 {
+		t.Errorf("Camera change should restart accumulation, got %+v", status)
+	}
+	waitFor(t, func() bool { return server.Status().Rounds >= 1 })
+
+	server.mu.Lock()
+	camera := server.pass.Camera
+	server.mu.Unlock()
+	if camera.FieldOfView != 90 || camera.ProjectionPlaneDistance != 1 {
+		t.Errorf("Camera change should only replace the given fields, got %+v", camera)
+	}
+}
+
+func TestServerStreamsPNGEvents(t *testing.T) {
+	_, httpServer, cancel := testServer(t)
+	defer httpServer.Close()
+	defer cancel()
+
+	response, err := http.Get(httpServer.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	reader := bufio.NewReader(response.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		const prefix = "data: data:image/png;base64,"
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(line, prefix)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(strings.NewReader(string(raw)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Dx() != 16 || img.Bounds().Dy() != 8 {
+			t.Errorf("Frame should be 16x8, got %v", img.Bounds())
+		}
+		return
+	}
+}
+
+func TestServerStreamsMJPEG(t *testing.T) {
+	_, httpServer, cancel := testServer(t)
+	defer httpServer.Close()
+	defer cancel()
+
+	response, err := http.Get(httpServer.URL + "/stream.mjpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "multipart/x-mixed-replace") {
+		t.Errorf("Unexpected content type %s", response.Header.Get("Content-Type"))
+	}
+
+	reader := bufio.NewReader(response.Body)
+	line, err := reader.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "--frame" {
+		t.Errorf("Stream should start with a frame boundary, got %q %v", line, err)
+	}
+}
@@ -0,0 +1,179 @@
+package process
+
+import (
+	"image"
+	"math"
+	"raytracer/models"
+	"raytracer/utility"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Denoiser defaults for settings left empty
+const (
+	defaultDenoiseIterations  = 5
+	defaultDenoiseColorSigma  = 4.0
+	defaultDenoiseNormalSigma = 128.0
+	defaultDenoiseDepthSigma  = 1.0
+)
+
+const (
+	// Smallest albedo divided out of the colors
+	minDemodulationAlbedo = 0.01
+	denoiseEpsilon        = 1e-4
+)
+
+// B3 spline kernel of the a-trous wavelet transform
+var atrousKernel = [5]float32{1.0 / 16.0, 1.0 / 4.0, 3.0 / 8.0, 1.0 / 4.0, 1.0 / 16.0}
+
+// Denoises the resolved film colors with an edge-avoiding a-trous wavelet
+// filter. Texture detail is preserved by filtering the colors divided by the
+// first hit albedo, and the edge-stopping functions are guided by the first
+// hit normal and depth and by the per-pixel variance of the samples.
+// The filter does not reach over the borders of the film, tiles are grown
+// by its reach with GrowForDenoise
+func Denoise(film *models.Film, colors []mgl32.Vec3, settings *models.RenderSettings) []mgl32.Vec3 {
+	iterations := settings.DenoiseIterations
+	if iterations <= 0 {
+		iterations = defaultDenoiseIterations
+	}
+	colorSigma := settings.DenoiseColorSigma
+	if colorSigma <= 0 {
+		colorSigma = defaultDenoiseColorSigma
+	}
+	normalSigma := float64(settings.DenoiseNormalSigma)
+	if normalSigma <= 0 {
+		normalSigma = defaultDenoiseNormalSigma
+	}
+	depthSigma := settings.DenoiseDepthSigma
+	if depthSigma <= 0 {
+		depthSigma = defaultDenoiseDepthSigma
+	}
+
+	pixelCount := film.Width * film.Height
+	albedo := make([]mgl32.Vec3, pixelCount)
+	normal := make([]mgl32.Vec3, pixelCount)
+	depth := make([]float32, pixelCount)
+	irradiance := make([]mgl32.Vec3, pixelCount)
+	variance := make([]float32, pixelCount)
+
+	for i := 0; i < pixelCount; i++ {
+		a, n, d := film.Features(i)
+		a = mgl32.Vec3{
+			mgl32.Clamp(a.X(), minDemodulationAlbedo, math.MaxFloat32),
+			mgl32.Clamp(a.Y(), minDemodulationAlbedo, math.MaxFloat32),
+			mgl32.Clamp(a.Z(), minDemodulationAlbedo, math.MaxFloat32),
+		}
+		albedo[i] = a
+		normal[i] = n
+		depth[i] = d
+		irradiance[i] = mgl32.Vec3{colors[i].X() / a.X(), colors[i].Y() / a.Y(), colors[i].Z() / a.Z()}
+
+		// Variance of the pixel mean, in demodulated units
+		if film.Samples[i] > 0 {
+			l := models.Luminance(a)
+			variance[i] = film.Variance(i) / float32(film.Samples[i]) / (l * l)
+		}
+	}
+
+	filtered := make([]mgl32.Vec3, pixelCount)
+	filteredVariance := make([]float32, pixelCount)
+
+	for iteration := 0; iteration < iterations; iteration++ {
+		step := 1 << iteration
+
+		for y := 0; y < film.Height; y++ {
+			for x := 0; x < film.Width; x++ {
+				p := x + y*film.Width
+				lp := models.Luminance(irradiance[p])
+				sigma := colorSigma*float32(math.Sqrt(float64(variance[p]))) + denoiseEpsilon
+
+				var sum mgl32.Vec3
+				var weightSum, varianceSum float32
+
+				for ky := -2; ky <= 2; ky++ {
+					qy := y + ky*step
+					if qy < 0 || qy >= film.Height {
+						continue
+					}
+					for kx := -2; kx <= 2; kx++ {
+						qx := x + kx*step
+						if qx < 0 || qx >= film.Width {
+							continue
+						}
+						q := qx + qy*film.Width
+
+						colorWeight := math.Exp(-float64(abs32(lp-models.Luminance(irradiance[q])) / sigma))
+						normalWeight := math.Pow(math.Max(float64(normal[p].Dot(normal[q])), 0), normalSigma)
+						depthScale := depthSigma*float32(step)*0.05*depth[p] + denoiseEpsilon
+						depthWeight := math.Exp(-float64(abs32(depth[p]-depth[q]) / depthScale))
+
+						w := atrousKernel[kx+2] * atrousKernel[ky+2] * float32(colorWeight*normalWeight*depthWeight)
+
+						sum = sum.Add(irradiance[q].Mul(w))
+						weightSum += w
+						varianceSum += w * w * variance[q]
+					}
+				}
+
+				// Pixels without features, e.g. the background, are kept as is
+				if weightSum < denoiseEpsilon {
+					filtered[p] = irradiance[p]
+					filteredVariance[p] = variance[p]
+					continue
+				}
+
+				filtered[p] = sum.Mul(1.0 / weightSum)
+				filteredVariance[p] = varianceSum / (weightSum * weightSum)
+			}
+		}
+
+		irradiance, filtered = filtered, irradiance
+		variance, filteredVariance = filteredVariance, variance
+	}
+
+	output := make([]mgl32.Vec3, pixelCount)
+	for i := range output {
+		output[i] = mgl32.Vec3{
+			irradiance[i].X() * albedo[i].X(),
+			irradiance[i].Y() * albedo[i].Y(),
+			irradiance[i].Z() * albedo[i].Z(),
+		}
+	}
+
+	return output
+}
+
+// Grows a tile pass by the reach of the denoiser within the frame and
+// outputs the tile only, so that the tile is denoised like the whole frame
+func GrowForDenoise(pass *models.RenderPass) {
+	if !pass.Settings.Denoise || !IsTile(pass) || !pass.Output.Empty() {
+		return
+	}
+
+	iterations := pass.Settings.DenoiseIterations
+	if iterations <= 0 {
+		iterations = defaultDenoiseIterations
+	}
+	// Each iteration reaches two steps further
+	reach := 0
+	for i := 0; i < iterations && reach < pass.TotalWidth+pass.TotalHeight; i++ {
+		reach += 2 << i
+	}
+
+	x0 := utility.MaxInt(pass.XOffset-reach, 0)
+	y0 := utility.MaxInt(pass.YOffset-reach, 0)
+	x1 := utility.MinInt(pass.XOffset+pass.Width+reach, pass.TotalWidth)
+	y1 := utility.MinInt(pass.YOffset+pass.Height+reach, pass.TotalHeight)
+
+	pass.Output = image.Rect(pass.XOffset-x0, pass.YOffset-y0, pass.XOffset-x0+pass.Width, pass.YOffset-y0+pass.Height)
+	pass.XOffset, pass.YOffset = x0, y0
+	pass.Width, pass.Height = x1-x0, y1-y0
+}
+
+func abs32(x float32) float32 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,104 @@
+package process
+
+import (
+	"math/rand"
+	"raytracer/models"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Builds a film with a noisy flat surface on the left half and a
+// differently oriented surface on the right half
+func noisyFilm(width int, height int) *models.Film {
+	film := models.NewFilm(width, height, models.NewFilter(models.BoxFilter, 0))
+	rng := rand.New(rand.NewSource(1))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			normal := mgl32.Vec3{0, 0, 1}
+			base := float32(0.2)
+			if x >= width/2 {
+				normal = mgl32.Vec3{1, 0, 0}
+				base = 0.8
+			}
+			aov := models.AOVSample{Albedo: mgl32.Vec3{1, 1, 1}, Normal: normal, Depth: 5}
+			for s := 0; s < 4; s++ {
+				v := base + (rng.Float32()-0.5)*0.2
+				c := mgl32.Vec3{v, v, v}
+				film.AddSample(float32(x)+0.5, float32(y)+0.5, c)
+				film.AddPixelSample(x, y, c, &aov)
+			}
+		}
+	}
+
+	return film
+}
+
+func TestDenoiseReducesNoiseAndKeepsEdges(t *testing.T) {
+	film := noisyFilm(32, 16)
+	colors := film.Resolve()
+	denoised := Denoise(film, colors, &models.RenderSettings{})
+
+	errorOf := func(c []mgl32.Vec3) float32 {
+		var sum float32
+		for y := 0; y < film.Height; y++ {
+			for x := 0; x < film.Width; x++ {
+				expected := float32(0.2)
+				if x >= film.Width/2 {
+					expected = 0.8
+				}
+				d := c[x+y*film.Width].X() - expected
+				sum += d * d
+			}
+		}
+		return sum
+	}
+
+	if errorOf(denoised) > errorOf(colors)*0.5 {
+		t.Errorf("Denoiser did not reduce noise, error %v before %v", errorOf(denoised), errorOf(colors))
+	}
+
+	// Pixels next to the normal discontinuity are not blurred together
+	edge := denoised[film.Width/2-1+8*film.Width].X()
+	if edge > 0.35 {
+		t.Errorf("Denoiser blurred over the edge, got %v", edge)
+	}
+}
+
+func TestDenoisedTileMatchesFrame(t *testing.T) {
+	frame := noisyFilm(160, 24)
+	settings := models.RenderSettings{Denoise: true}
+	framePass := &models.RenderPass{TotalWidth: 160, TotalHeight: 24, Width: 160, Height: 24, Settings: settings}
+	expected := Resolve(framePass, frame)
+
+	// Tile next to the surface edge, grown into the neighbouring tiles
+	pass := &models.RenderPass{TotalWidth: 160, TotalHeight: 24, XOffset: 72, YOffset: 8, Width: 16, Height: 8, Settings: settings}
+	GrowForDenoise(pass)
+	if pass.XOffset != 10 || pass.Width != 140 || pass.YOffset != 0 || pass.Height != 24 {
+		t.Fatalf("Tile grew to %dx%d+%d+%d", pass.Width, pass.Height, pass.XOffset, pass.YOffset)
+	}
+
+	film := models.NewFilm(pass.Width, pass.Height, frame.Filter)
+	for y := 0; y < pass.Height; y++ {
+		for x := 0; x < pass.Width; x++ {
+			from := pass.XOffset + x + (pass.YOffset+y)*frame.Width
+			to := x + y*film.Width
+			film.Colors[to], film.Weights[to] = frame.Colors[from], frame.Weights[from]
+			film.Samples[to], film.Mean[to], film.M2[to] = frame.Samples[from], frame.Mean[from], frame.M2[from]
+			film.Albedo[to], film.Normal[to], film.Depth[to] = frame.Albedo[from], frame.Normal[from], frame.Depth[from]
+		}
+	}
+
+	colors := Resolve(pass, film)
+	if len(colors) != 16*8 {
+		t.Fatalf("Resolved %d colors for the tile", len(colors))
+	}
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			if c, e := colors[x+y*16], expected[72+x+(8+y)*160]; c.Sub(e).Len() > 1e-5 {
+				t.Fatalf("Tile pixel %d,%d is %v, expected %v", x, y, c, e)
+			}
+		}
+	}
+}
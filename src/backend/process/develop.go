@@ -0,0 +1,52 @@
+package process
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"raytracer/models"
+	"raytracer/utility"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Develops a film file with the settings stored in it
+func DevelopFilmFile(file *models.FilmFile) *image.RGBA {
+	pass := &file.Pass
+	pass.Camera.Initialize(pass.TotalWidth, pass.TotalHeight)
+	width, height := pass.OutputSize()
+	output := image.NewRGBA(image.Rect(0, 0, width, height))
+	Develop(&models.RenderContext{LUT: file.LUT}, pass, Resolve(pass, file.Film), output)
+	return output
+}
+
+// Develops the resolved film colors of a render pass into the output image.
+// Applies the camera sensor response, exposure compensation, tone mapping,
+// output encoding and the optional LUT of the context, in that order
+func Develop(context *models.RenderContext, pass *models.RenderPass, colors []mgl32.Vec3, output *image.RGBA) {
+	sensor := pass.Camera.SensorTransform(frameEV100(pass, colors))
+	if pass.Settings.Exposure != 0 {
+		sensor = sensor.Mul(float32(math.Exp2(float64(pass.Settings.Exposure))))
+	}
+
+	width, height := pass.OutputSize()
+	for j := 0; j < height; j++ {
+		for i := 0; i < width; i++ {
+			c := sensor.Mul3x1(colors[i+j*width])
+			c = models.ToneMap(c, pass.Settings.ToneMapper, pass.Settings.WhitePoint)
+			c = models.EncodeOutput(c, &pass.Settings)
+
+			// LUTs are authored for display encoded values
+			if context.LUT != nil && pass.Settings.ApplyLUT {
+				c = utility.ClampColor(context.LUT.Apply(c))
+			}
+
+			output.SetRGBA(i, j, color.RGBA{
+				R: uint8(255 * c.X()),
+				G: uint8(255 * c.Y()),
+				B: uint8(255 * c.Z()),
+				A: 255,
+			})
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package process
+
+import (
+	"math/rand"
+	"raytracer/models"
+	"raytracer/utility"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Pixels traced along the longer side of the frame when metering,
+// and the fixed seed that makes every tile meter the same value
+const (
+	meteringResolution = 64
+	meteringSeed       = 1
+)
+
+// Returns the auto exposure of the frame of the pass. Passes that were not
+// metered over the whole frame cover it and meter their own colors
+func frameEV100(pass *models.RenderPass, colors []mgl32.Vec3) float32 {
+	if pass.MeteredEV100 != nil {
+		return *pass.MeteredEV100
+	}
+	return models.MeterEV100(colors)
+}
+
+// Returns true if the pass renders a part of the frame only
+func IsTile(pass *models.RenderPass) bool {
+	return pass.XOffset != 0 || pass.YOffset != 0 || pass.Width < pass.TotalWidth || pass.Height < pass.TotalHeight
+}
+
+// Meters the auto exposure of the whole frame of an initialized pass from a
+// coarse image of one sample per pixel. The samples do not depend on the
+// region or seed of the pass, so that all tiles of a frame get the same value
+func MeterFrame(context *models.RenderContext, pass *models.RenderPass) float32 {
+	width, height := meteringResolution, meteringResolution
+	if pass.TotalWidth > pass.TotalHeight {
+		height = utility.MaxInt(1, meteringResolution*pass.TotalHeight/pass.TotalWidth)
+	} else if pass.TotalHeight > pass.TotalWidth {
+		width = utility.MaxInt(1, meteringResolution*pass.TotalWidth/pass.TotalHeight)
+	}
+	width = utility.MinInt(width, pass.TotalWidth)
+	height = utility.MinInt(height, pass.TotalHeight)
+
+	// Metering takes its own samples of the frame, seeded alike in every tile
+	metering := *pass
+	metering.Camera.Initialize(pass.TotalWidth, pass.TotalHeight)
+	metering.Camera.SetSampleSeed(meteringSeed)
+	light := context.Light
+	if light != nil {
+		context.Light = models.NewAreaLight(light.Transform, light.Size, light.Emission, light.Normal)
+		context.Light.SetSampleSeed(meteringSeed)
+		defer func() { context.Light = light }()
+	}
+	metering.SetRandom(rand.New(rand.NewSource(meteringSeed)))
+
+	colors := make([]mgl32.Vec3, 0, width*height)
+	for j := 0; j < height; j++ {
+		for i := 0; i < width; i++ {
+			// Center pixel of the block of frame pixels
+			x := (2*i + 1) * pass.TotalWidth / (2 * width)
+			y := (2*j + 1) * pass.TotalHeight / (2 * height)
+
+			ray := metering.Camera.GetCameraRay(0, 0, x, y)
+			aov := models.AOVSample{}
+			color := utility.MultiplyColor(Trace(context, &metering, ray, &aov), ray.Weight)
+			colors = append(colors, color)
+		}
+	}
+
+	return models.MeterEV100(colors)
+}
@@ -0,0 +1,95 @@
+package process
+
+import (
+	"raytracer/models"
+	"raytracer/utility"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// Traces one camera sample through a pixel of the pass region and
+// splats it to the film. Pixel coordinates are relative to the region
+func SamplePixel(context *models.RenderContext, pass *models.RenderPass, film *models.Film, x int, y int) {
+	ray := pass.Camera.GetCameraRay(pass.XOffset, pass.YOffset, x, y)
+
+	aov := models.AOVSample{}
+	rayColor := Trace(context, pass, ray, &aov)
+	rayColor = utility.MultiplyColor(rayColor, ray.Weight)
+
+	film.AddSample(float32(x)+ray.PixelSample.X(), float32(y)+ray.PixelSample.Y(), rayColor)
+	film.AddPixelSample(x, y, rayColor, &aov)
+}
+
+// Adaptive sampling defaults for settings left empty
+const (
+	defaultAdaptiveThreshold  = 0.05
+	defaultAdaptiveMinSamples = 8
+)
+
+// Returns the number of samples taken in every pixel before
+// adaptive sampling decides where to sample more
+func InitialSamples(pass *models.RenderPass) int {
+	if !pass.Settings.AdaptiveSampling {
+		// Termination criteria are checked between rounds of single samples
+		if HasTerminationCriteria(&pass.Settings) {
+			return utility.MinInt(1, pass.Camera.RaysPerPixel)
+		}
+		return pass.Camera.RaysPerPixel
+	}
+	minSamples := pass.Settings.AdaptiveMinSamples
+	if minSamples <= 0 {
+		minSamples = defaultAdaptiveMinSamples
+	}
+	return utility.MinInt(minSamples, pass.Camera.RaysPerPixel)
+}
+
+// Returns true if the pixel has not converged with adaptive sampling.
+// Pixels in the film margin decide by their own samples, so that the
+// tiles sharing a pixel sample it alike
+func NeedsSample(pass *models.RenderPass, film *models.Film, x int, y int) bool {
+	if !pass.Settings.AdaptiveSampling {
+		return true
+	}
+
+	samples, relativeError := film.PixelError(x, y)
+	if samples < InitialSamples(pass) {
+		return true
+	}
+
+	threshold := pass.Settings.AdaptiveThreshold
+	if threshold <= 0 {
+		threshold = defaultAdaptiveThreshold
+	}
+	return relativeError > threshold
+}
+
+// Returns the filtered colors of the film, denoised if enabled,
+// within the output region of the pass
+func Resolve(pass *models.RenderPass, film *models.Film) []mgl32.Vec3 {
+	colors := film.Resolve()
+	if pass.Settings.Denoise {
+		colors = Denoise(film, colors, &pass.Settings)
+	}
+	if pass.Output.Empty() {
+		return colors
+	}
+
+	output := make([]mgl32.Vec3, 0, pass.Output.Dx()*pass.Output.Dy())
+	for y := pass.Output.Min.Y; y < pass.Output.Max.Y; y++ {
+		output = append(output, colors[pass.Output.Min.X+y*film.Width:pass.Output.Max.X+y*film.Width]...)
+	}
+	return output
+}
+
+// Returns the region relative pixel range [x0, x1) x [y0, y1) that is sampled
+// for the film of the pass. Includes the filter margin within the image
+func SampledPixels(pass *models.RenderPass, film *models.Film) (int, int, int, int) {
+	margin := film.Margin()
+
+	x0 := utility.MaxInt(-margin, -pass.XOffset)
+	y0 := utility.MaxInt(-margin, -pass.YOffset)
+	x1 := utility.MinInt(pass.Width+margin, pass.TotalWidth-pass.XOffset)
+	y1 := utility.MinInt(pass.Height+margin, pass.TotalHeight-pass.YOffset)
+
+	return x0, y0, x1, y1
+}
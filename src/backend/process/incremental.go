@@ -0,0 +1,136 @@
+package process
+
+import (
+	"math/rand"
+	"raytracer/models"
+)
+
+// State of a progressive render that adds one sample round per step
+type IncrementalRender struct {
+	Pass       *models.RenderPass
+	Film       *models.Film
+	Rounds     int
+	StopReason StopReason
+
+	termination *Termination
+}
+
+// Scrambles the camera and light samples by the seed of an initialized
+// pass. Renders of other seeds take other samples, the same seed takes
+// the same samples again
+func SeedSamples(context *models.RenderContext, pass *models.RenderPass) {
+	pass.Camera.SetSampleSeed(pass.RNGSeed)
+	if context.Light != nil {
+		context.Light.SetSampleSeed(pass.RNGSeed)
+	}
+}
+
+// Starts an incremental render of an initialized render pass
+func NewIncrementalRender(context *models.RenderContext, pass *models.RenderPass) *IncrementalRender {
+	filter := models.NewFilter(pass.Settings.Filter, pass.Settings.FilterRadius)
+	return &IncrementalRender{
+		Pass:        pass,
+		Film:        models.NewFilm(pass.Width, pass.Height, filter),
+		termination: NewTermination(context, pass),
+	}
+}
+
+// Adds at most one sample to every pixel unless the render has stopped
+func (render *IncrementalRender) Step(context *models.RenderContext) StopReason {
+	if render.StopReason != NotStopped {
+		return render.StopReason
+	}
+
+	reason := render.termination.Check(context, render.Film)
+	if reason == NotStopped && render.Rounds >= render.Pass.Camera.RaysPerPixel {
+		// Resumed from a checkpoint of a finished render
+		render.StopReason = StopMaxSamples
+		return render.StopReason
+	}
+	if reason == NotStopped && context.IsCancelled() {
+		reason = StopCancelled
+	}
+
+	if reason == NotStopped {
+		var sampled int
+		sampled, reason = SampleRound(context, render.Pass, render.Film, render.termination)
+		render.Rounds += 1
+
+		switch {
+		case reason != NotStopped:
+			// Samples of the partial round stay in the film
+		case sampled == 0:
+			reason = StopConverged
+		case render.Rounds >= render.Pass.Camera.RaysPerPixel:
+			reason = StopMaxSamples
+		}
+	}
+
+	render.StopReason = reason
+	return reason
+}
+
+// Progress as the fraction of the maximum number of sample rounds
+func (render *IncrementalRender) Progress() float32 {
+	if render.StopReason != NotStopped {
+		return 1.0
+	}
+	return float32(render.Rounds) / float32(render.Pass.Camera.RaysPerPixel)
+}
+
+func (render *IncrementalRender) Checkpoint(context *models.RenderContext) *models.Checkpoint {
+	checkpoint := &models.Checkpoint{
+		ContentHash:       context.ContentHash(),
+		Pass:              *render.Pass,
+		Film:              render.Film,
+		Rounds:            render.Rounds,
+		CameraSampleIndex: render.Pass.Camera.SampleIndex(),
+	}
+	if context.Light != nil {
+		checkpoint.LightSampleIndex = context.Light.SampleIndex()
+	}
+	return checkpoint
+}
+
+// Returns the film for merging with other renders of the same frame
+func (render *IncrementalRender) FilmFile(context *models.RenderContext) *models.FilmFile {
+	return &models.FilmFile{
+		ContentHash: context.ContentHash(),
+		Pass:        *render.Pass,
+		LUT:         context.LUT,
+		Film:        render.Film,
+	}
+}
+
+// Continues an incremental render from a checkpoint. Refuses checkpoints
+// of a different scene. Termination budgets count from the resume
+func ResumeIncrementalRender(context *models.RenderContext, checkpoint *models.Checkpoint) (*IncrementalRender, error) {
+	if err := checkpoint.Validate(context); err != nil {
+		return nil, err
+	}
+
+	pass := checkpoint.Pass
+	pass.Initialize(context)
+	pass.Camera.Initialize(pass.TotalWidth, pass.TotalHeight)
+
+	// The sample indices continue the sequences the checkpoint was
+	// taken from, which are scrambled by the seed only
+	SeedSamples(context, &pass)
+	pass.Camera.SetSampleIndex(checkpoint.CameraSampleIndex)
+	if context.Light != nil {
+		context.Light.SetSampleIndex(checkpoint.LightSampleIndex)
+	}
+
+	// The random state can't be stored, continue with a sequence
+	// distinct from the rounds already taken
+	rand.Seed(pass.RNGSeed + int64(checkpoint.Rounds))
+
+	render := &IncrementalRender{
+		Pass:   &pass,
+		Film:   checkpoint.Film,
+		Rounds: checkpoint.Rounds,
+	}
+	render.termination = NewTermination(context, render.Pass)
+
+	return render, nil
+}
@@ -0,0 +1,160 @@
+package process
+
+import (
+	"raytracer/models"
+	"time"
+)
+
+// Reason a render stopped sampling
+type StopReason string
+
+const (
+	NotStopped        StopReason = ""
+	StopMaxSamples    StopReason = "maxSamples"
+	StopConverged     StopReason = "converged"
+	StopTargetSamples StopReason = "targetSamples"
+	StopTargetNoise   StopReason = "targetNoise"
+	StopTimeBudget    StopReason = "timeBudget"
+	StopRayBudget     StopReason = "rayBudget"
+	StopCancelled     StopReason = "cancelled"
+)
+
+// Termination criteria of a render, checked between sample rounds.
+// The time and ray budgets are also polled between scanlines
+type Termination struct {
+	settings  *models.RenderSettings
+	started   time.Time
+	startRays uint64
+}
+
+func NewTermination(context *models.RenderContext, pass *models.RenderPass) *Termination {
+	return &Termination{
+		settings:  &pass.Settings,
+		started:   time.Now(),
+		startRays: context.Rays,
+	}
+}
+
+// Returns true if any criterion other than the sample count is set
+func HasTerminationCriteria(settings *models.RenderSettings) bool {
+	return settings.TimeBudget > 0 || settings.RayBudget > 0 || settings.TargetNoise > 0 || settings.TargetSamples > 0
+}
+
+// Returns the first criterion that fired or NotStopped
+func (termination *Termination) Check(context *models.RenderContext, film *models.Film) StopReason {
+	settings := termination.settings
+
+	if settings.TargetSamples > 0 && film.SamplesPerPixel() >= float32(settings.TargetSamples) {
+		return StopTargetSamples
+	}
+	if settings.TargetNoise > 0 && film.RelativeMSE() <= settings.TargetNoise {
+		return StopTargetNoise
+	}
+	return termination.CheckBudget(context)
+}
+
+// Returns the time or ray budget that ran out or NotStopped
+func (termination *Termination) CheckBudget(context *models.RenderContext) StopReason {
+	settings := termination.settings
+
+	if settings.TimeBudget > 0 && time.Since(termination.started).Seconds() >= float64(settings.TimeBudget) {
+		return StopTimeBudget
+	}
+	if settings.RayBudget > 0 && context.Rays-termination.startRays >= settings.RayBudget {
+		return StopRayBudget
+	}
+
+	return NotStopped
+}
+
+// Returns the reason to stop sampling between scanlines or NotStopped
+func (termination *Termination) checkScanline(context *models.RenderContext) StopReason {
+	if context.IsCancelled() {
+		return StopCancelled
+	}
+	return termination.CheckBudget(context)
+}
+
+// Renders the film of the pass. Every pixel first gets the initial samples,
+// followed by rounds of one sample per unconverged pixel until the pixels
+// have Camera.RaysPerPixel samples, adaptive sampling converges or a
+// termination criterion fires. Progress is reported as the fraction of the
+// maximum number of camera rays. Cancellation and the budgets are checked
+// between scanlines and leave the samples taken so far in the film
+func RenderFilm(context *models.RenderContext, pass *models.RenderPass, film *models.Film, progress func(float32)) StopReason {
+	x0, y0, x1, y1 := SampledPixels(pass, film)
+	sampledWidth := x1 - x0
+	pixelCount := sampledWidth * (y1 - y0)
+	rayCount := pixelCount * pass.Camera.RaysPerPixel
+
+	updateInterval := int(float32(rayCount) / 10.0)
+	updateIndex := 0
+	termination := NewTermination(context, pass)
+
+	// Trace
+	ri := 0
+	initialSamples := InitialSamples(pass)
+	for i := 0; i < pixelCount; i++ {
+		x := x0 + i%sampledWidth
+		y := y0 + i/sampledWidth
+		if x == x0 {
+			if reason := termination.checkScanline(context); reason != NotStopped {
+				return reason
+			}
+		}
+		for j := 0; j < initialSamples; j++ {
+			if ri > updateIndex+updateInterval {
+				updateIndex = ri
+				progress(float32(updateIndex) / float32(rayCount))
+			}
+			ri += 1
+
+			SamplePixel(context, pass, film, x, y)
+		}
+	}
+
+	for round := initialSamples; round < pass.Camera.RaysPerPixel; round++ {
+		if reason := termination.Check(context, film); reason != NotStopped {
+			return reason
+		}
+
+		sampled, reason := SampleRound(context, pass, film, termination)
+		if reason != NotStopped {
+			return reason
+		}
+		if sampled == 0 {
+			return StopConverged
+		}
+
+		ri += sampled
+		if ri > updateIndex+updateInterval {
+			updateIndex = ri
+			progress(float32(updateIndex) / float32(rayCount))
+		}
+	}
+
+	return StopMaxSamples
+}
+
+// Adds one sample to every pixel of the pass that needs one.
+// Returns the number of samples taken. A round that is cancelled or
+// runs out of budget stops at that scanline and returns the reason
+func SampleRound(context *models.RenderContext, pass *models.RenderPass, film *models.Film, termination *Termination) (int, StopReason) {
+	x0, y0, x1, y1 := SampledPixels(pass, film)
+
+	sampled := 0
+	for y := y0; y < y1; y++ {
+		if reason := termination.checkScanline(context); reason != NotStopped {
+			return sampled, reason
+		}
+		for x := x0; x < x1; x++ {
+			if !NeedsSample(pass, film, x, y) {
+				continue
+			}
+			SamplePixel(context, pass, film, x, y)
+			sampled += 1
+		}
+	}
+
+	return sampled, NotStopped
+}
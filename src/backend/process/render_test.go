@@ -0,0 +1,86 @@
+package process
+
+import (
+	"raytracer/models"
+	"testing"
+	"time"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+func TestTerminationCriteria(t *testing.T) {
+	context := &models.RenderContext{}
+	film := models.NewFilm(2, 2, models.NewFilter(models.BoxFilter, 0))
+	for i := 0; i < 4; i++ {
+		film.AddPixelSample(i%2, i/2, mgl32.Vec3{1, 1, 1}, nil)
+		film.AddPixelSample(i%2, i/2, mgl32.Vec3{1, 1, 1}, nil)
+	}
+
+	pass := &models.RenderPass{Settings: models.RenderSettings{TargetSamples: 3}}
+	if reason := NewTermination(context, pass).Check(context, film); reason != NotStopped {
+		t.Errorf("Render should not stop before the target samples, got %v", reason)
+	}
+
+	pass.Settings.TargetSamples = 2
+	if reason := NewTermination(context, pass).Check(context, film); reason != StopTargetSamples {
+		t.Errorf("Render should stop at the target samples, got %v", reason)
+	}
+
+	// Constant pixels have no noise
+	pass.Settings = models.RenderSettings{TargetNoise: 0.001}
+	if reason := NewTermination(context, pass).Check(context, film); reason != StopTargetNoise {
+		t.Errorf("Render should stop at the target noise, got %v", reason)
+	}
+
+	pass.Settings = models.RenderSettings{TimeBudget: 0.001}
+	termination := NewTermination(context, pass)
+	time.Sleep(2 * time.Millisecond)
+	if reason := termination.Check(context, film); reason != StopTimeBudget {
+		t.Errorf("Render should stop at the time budget, got %v", reason)
+	}
+
+	pass.Settings = models.RenderSettings{RayBudget: 100}
+	termination = NewTermination(context, pass)
+	context.Rays += 100
+	if reason := termination.Check(context, film); reason != StopRayBudget {
+		t.Errorf("Render should stop at the ray budget, got %v", reason)
+	}
+}
+
+func TestCancelledRender(t *testing.T) {
+	context := &models.RenderContext{Cancelled: func() bool { return true }}
+	pass := &models.RenderPass{
+		TotalWidth: 2, TotalHeight: 2, Width: 2, Height: 2,
+		Camera: models.Camera{RaysPerPixel: 4},
+	}
+
+	film := models.NewFilm(2, 2, models.NewFilter(models.BoxFilter, 0))
+	if reason := RenderFilm(context, pass, film, func(float32) {}); reason != StopCancelled {
+		t.Errorf("Cancelled render should stop, got %v", reason)
+	}
+	if film.SamplesPerPixel() != 0 {
+		t.Errorf("Cancelled render should not sample, got %v samples per pixel", film.SamplesPerPixel())
+	}
+
+	render := NewIncrementalRender(context, pass)
+	if reason := render.Step(context); reason != StopCancelled || render.Rounds != 0 {
+		t.Errorf("Cancelled step should stop without a round, got %v after %d rounds", reason, render.Rounds)
+	}
+}
+
+func TestBudgetStopsInitialSamples(t *testing.T) {
+	context := &models.RenderContext{}
+	pass := &models.RenderPass{
+		TotalWidth: 2, TotalHeight: 2, Width: 2, Height: 2,
+		Camera:   models.Camera{RaysPerPixel: 4},
+		Settings: models.RenderSettings{AdaptiveSampling: true, TimeBudget: 1e-9},
+	}
+
+	film := models.NewFilm(2, 2, models.NewFilter(models.BoxFilter, 0))
+	if reason := RenderFilm(context, pass, film, func(float32) {}); reason != StopTimeBudget {
+		t.Errorf("Render should stop at the time budget, got %v", reason)
+	}
+	if film.SamplesPerPixel() != 0 {
+		t.Errorf("Spent budget should stop the initial samples, got %v samples per pixel", film.SamplesPerPixel())
+	}
+}
@@ -6,18 +6,24 @@ import (
 	"raytracer/utility"
 
 	"github.com/go-gl/mathgl/mgl32"
+	"github.com/udhos/gwob"
 )
 
 type RaycastResult struct {
 	Triangle *models.Triangle
+	// Instance of the hit mesh triangle, nil for the scene triangles
+	Instance *models.Instance
+	Material *gwob.Material
 	T        float32
 	U        float32
 	V        float32
 	Point    mgl32.Vec3
+	Normal   mgl32.Vec3
 }
 
-// Path traces a given pixel ray
-func Trace(context *models.RenderContext, pass *models.RenderPass, ray *models.Ray) mgl32.Vec3 {
+// Path traces a given pixel ray. First hit features are written
+// to the AOV sample if one is given
+func Trace(context *models.RenderContext, pass *models.RenderPass, ray *models.Ray, aov *models.AOVSample) mgl32.Vec3 {
 	// If out of scene, return background color
 	// "Ambient color"
 	r := float32(0.0)
@@ -45,6 +51,12 @@ func Trace(context *models.RenderContext, pass *models.RenderPass, ray *models.R
 		shading := mgl32.Vec3{0, 0, 0}
 		diffuse, normal, _ := getMaterialParameters(context, result)
 
+		if aov != nil && indirectCounter == 0 {
+			aov.Albedo = diffuse
+			aov.Normal = normal
+			aov.Depth = result.T
+		}
+
 		for i := 0; i < pass.Settings.LightSampleRays; i++ {
 			lightSample, pdf := context.Light.Sample()
 
@@ -54,16 +66,10 @@ func Trace(context *models.RenderContext, pass *models.RenderPass, ray *models.R
 			lightIncident := shadowRayN.Dot(context.Light.Normal)
 			if lightIncident < 0 {
 				sRay := models.NewRay(result.Point, shadowRayN, ray.Bounce, ray.X, ray.Y)
-				shadowResult := rayCast(context, sRay, lightDistance)
-
-				// Shadowresult is always defined, since initialTMin is given
-				// Triangle of the result may not be defined
-
-				// If the raycast didn't hit anything or didn't hit anything closer to the light
-				lightHit := shadowResult.T >= lightDistance || (shadowResult.Triangle != nil && shadowResult.Triangle.IsLight)
-				if lightHit {
+				sRay.Time = ray.Time
+				if !occluded(context, sRay, lightDistance) {
 					theta_l := float32(math.Max(float64(-lightIncident), 0.0))
-					theta := float32(math.Max(float64(shadowRayN.Dot(result.Triangle.Normal)), 0.0))
+					theta := float32(math.Max(float64(shadowRayN.Dot(result.Normal)), 0.0))
 					radius2 := shadowRay.LenSqr()
 
 					color := utility.MultiplyColor(diffuse, context.Light.Emission).Mul(theta_l * theta / (radius2 * pdf * math.Pi))
@@ -84,9 +90,10 @@ func Trace(context *models.RenderContext, pass *models.RenderPass, ray *models.R
 		}
 
 		// Sample from hemisphere
-		sample := utility.RandomInHemisphere(result.Triangle.Normal).Normalize()
+		sample := utility.RandomInHemisphere(pass.Random(), result.Normal).Normalize()
 
 		bounceRay := models.NewRay(result.Point, sample, ray.Bounce+1, ray.X, ray.Y)
+		bounceRay.Time = ray.Time
 
 		// New bounce
 		result = rayCast(context, bounceRay, math.MaxFloat32)
@@ -126,6 +133,7 @@ func rayCast(context *models.RenderContext, ray *models.Ray, initialTmin float32
 	var umin float32 = 0.0
 	var vmin float32 = 0.0
 	var tri *models.Triangle // Triangle index
+	var instance *models.Instance
 
 	/*
 		for _, sphere := range context.Scene.Spheres {
@@ -136,31 +144,47 @@ func rayCast(context *models.RenderContext, ray *models.Ray, initialTmin float32
 		}
 	*/
 
-	context.BVH.Root.WalkNode(context.Triangles, ray, &tmin, &umin, &vmin, &tri)
+	context.BVH.IntersectInstance(context.Triangles, ray, &tmin, &umin, &vmin, &tri, &instance)
 
 	if tmin < math.MaxFloat32 {
-		return &RaycastResult{
+		result := &RaycastResult{
 			Triangle: tri,
+			Instance: instance,
 			T:        tmin,
 			U:        umin,
 			V:        vmin,
 			Point:    ray.Origin.Add(ray.Direction.Mul(tmin)),
 		}
+		if tri != nil && instance != nil {
+			result.Normal = instance.NormalAt(tri, ray.Time)
+			result.Material = instance.MaterialOf(tri)
+		} else if tri != nil {
+			result.Normal = tri.NormalAt(ray.Time)
+			result.Material = tri.Material
+		}
+		return result
 	}
 
 	return nil
 }
 
+// Any-hit query for shadow rays, true if anything but an
+// emitter blocks the ray before tmax
+func occluded(context *models.RenderContext, ray *models.Ray, tmax float32) bool {
+	context.Rays += 1
+	return context.BVH.Occluded(context.Triangles, ray, tmax, true)
+}
+
 func getMaterialParameters(context *models.RenderContext, result *RaycastResult) (diffuse mgl32.Vec3, normal mgl32.Vec3, specular mgl32.Vec3) {
-	r := result.Triangle.Material.Kd[0]
-	g := result.Triangle.Material.Kd[1]
-	b := result.Triangle.Material.Kd[2]
+	r := result.Material.Kd[0]
+	g := result.Material.Kd[1]
+	b := result.Material.Kd[2]
 	diffuse = mgl32.Vec3{r, g, b}
-	normal = result.Triangle.Normal
+	normal = result.Normal
 
 	// Sample texture
-	if result.Triangle.Material.MapKd != "" {
-		texture, found := context.TextureLookup[result.Triangle.Material.MapKd]
+	if result.Material.MapKd != "" {
+		texture, found := context.TextureLookup[result.Material.MapKd]
 		if found {
 			// Convert barycentric coords to uv
 			uv := result.Triangle.TextureCoords[0].
@@ -0,0 +1,130 @@
+// Versioned request and response protocol of the exported worker
+// functions. Requests wrap the payload in an envelope with the protocol
+// version, responses carry the result or a typed error
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"raytracer/models"
+)
+
+// Protocol version, increased on incompatible changes of the payloads
+const Version = 1
+
+type ErrorCode string
+
+const (
+	ErrBadRequest         ErrorCode = "badRequest"
+	ErrUnsupportedVersion ErrorCode = "unsupportedVersion"
+	ErrNotInitialized     ErrorCode = "notInitialized"
+	ErrBadScene           ErrorCode = "badScene"
+	ErrMissingTexture     ErrorCode = "missingTexture"
+	ErrBVHMismatch        ErrorCode = "bvhMismatch"
+	ErrSceneMismatch      ErrorCode = "sceneMismatch"
+	ErrOutOfMemory        ErrorCode = "outOfMemory"
+	ErrCancelled          ErrorCode = "cancelled"
+	ErrInternal           ErrorCode = "internal"
+)
+
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (err *Error) Error() string {
+	return string(err.Code) + ": " + err.Message
+}
+
+func Errorf(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Returns the protocol error of an error returned by the renderer
+func Classify(err error) *Error {
+	if err == nil {
+		return nil
+	}
+
+	var protocolError *Error
+	switch {
+	case errors.As(err, &protocolError):
+		return protocolError
+	case errors.Is(err, models.ErrMissingTexture):
+		return &Error{Code: ErrMissingTexture, Message: err.Error()}
+	case errors.Is(err, models.ErrBVHMismatch):
+		return &Error{Code: ErrBVHMismatch, Message: err.Error()}
+	case errors.Is(err, models.ErrCheckpointMismatch):
+		return &Error{Code: ErrSceneMismatch, Message: err.Error()}
+	case errors.Is(err, models.ErrTextureTooLarge):
+		return &Error{Code: ErrOutOfMemory, Message: err.Error()}
+	}
+	return &Error{Code: ErrInternal, Message: err.Error()}
+}
+
+type Request struct {
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type Response struct {
+	Version int             `json:"version"`
+	OK      bool            `json:"ok"`
+	Error   *Error          `json:"error,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+}
+
+// Decodes the payload of a request. Unknown fields in the envelope or
+// the payload are refused so that mistyped parameters don't go unnoticed
+func DecodeRequest(raw string, payload interface{}) *Error {
+	request := Request{}
+	if err := decodeStrict([]byte(raw), &request); err != nil {
+		return Errorf(ErrBadRequest, "invalid request: %v", err)
+	}
+	if request.Version != Version {
+		return Errorf(ErrUnsupportedVersion, "protocol version %d, expected %d", request.Version, Version)
+	}
+	if len(request.Payload) == 0 {
+		return Errorf(ErrBadRequest, "request has no payload")
+	}
+	if err := decodeStrict(request.Payload, payload); err != nil {
+		return Errorf(ErrBadRequest, "invalid payload: %v", err)
+	}
+	return nil
+}
+
+func decodeStrict(raw []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("trailing data")
+	}
+	return nil
+}
+
+// Encodes the response of a result or an error
+func EncodeResponse(result interface{}, err error) string {
+	response := Response{Version: Version, OK: err == nil, Error: Classify(err)}
+	if err == nil && result != nil {
+		raw, marshalError := json.Marshal(result)
+		if marshalError != nil {
+			response = Response{Version: Version, Error: Errorf(ErrInternal, "encoding result: %v", marshalError)}
+		} else {
+			response.Result = raw
+		}
+	}
+
+	raw, _ := json.Marshal(&response)
+	return string(raw)
+}
+
+// Converts a recovered panic to an error. Sizes are checked before
+// allocating, so panics are bugs of the renderer
+func recovered(r interface{}) *Error {
+	return Errorf(ErrInternal, "panic: %v", r)
+}
@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"image"
+	"raytracer/models"
+)
+
+// Largest sampled region of a render pass. The film takes about
+// 100 bytes per pixel, larger passes would exhaust the wasm memory
+const MaxPassPixels = 8 * 1024 * 1024
+
+// Largest image size of a frame
+const maxFrameSize = 1 << 16
+
+func ValidateContext(context *models.RenderContext) *Error {
+	if context.ObjBuffer == "" || context.MtlBuffer == "" {
+		return Errorf(ErrBadScene, "scene has no OBJ or MTL data")
+	}
+	if context.BVHMaxLeafSize < 0 || context.BVHMaxDepth < 0 || context.BVHBins < 0 || context.BVHThreads < 0 ||
+		(context.BVHSplitAlpha != nil && *context.BVHSplitAlpha < 0) || context.BVHRebuildThreshold < 0 {
+		return Errorf(ErrBadScene, "negative BVH limits")
+	}
+	if w := context.BVHWidth; w != 0 && w != 2 && w != 4 && w != models.MaxBVHWidth {
+		return Errorf(ErrBadScene, "BVH width %d is not 2, 4 or 8", w)
+	}
+	if context.BVHBuilder < models.BinnedBVHBuilder || context.BVHBuilder > models.SpatialBVHBuilder {
+		return Errorf(ErrBadScene, "unknown BVH builder %d", context.BVHBuilder)
+	}
+	names := make(map[string]bool)
+	for _, texture := range context.RawTextures {
+		if texture.Name == "" {
+			return Errorf(ErrBadScene, "texture without a name")
+		}
+		if names[texture.Name] {
+			return Errorf(ErrBadScene, "duplicate texture %s", texture.Name)
+		}
+		names[texture.Name] = true
+	}
+	return nil
+}
+
+func ValidatePass(pass *models.RenderPass) *Error {
+	if pass.TotalWidth <= 0 || pass.TotalHeight <= 0 || pass.TotalWidth > maxFrameSize || pass.TotalHeight > maxFrameSize {
+		return Errorf(ErrBadRequest, "invalid frame size %dx%d", pass.TotalWidth, pass.TotalHeight)
+	}
+	if pass.Width <= 0 || pass.Height <= 0 || pass.XOffset < 0 || pass.YOffset < 0 ||
+		pass.XOffset+pass.Width > pass.TotalWidth || pass.YOffset+pass.Height > pass.TotalHeight {
+		return Errorf(ErrBadRequest, "region %dx%d+%d+%d is outside the %dx%d frame",
+			pass.Width, pass.Height, pass.XOffset, pass.YOffset, pass.TotalWidth, pass.TotalHeight)
+	}
+	if pass.Width*pass.Height > MaxPassPixels {
+		return Errorf(ErrOutOfMemory, "region of %d pixels exceeds the limit of %d", pass.Width*pass.Height, MaxPassPixels)
+	}
+	if !pass.Output.Empty() && !pass.Output.In(image.Rect(0, 0, pass.Width, pass.Height)) {
+		return Errorf(ErrBadRequest, "output %v is outside the %dx%d region", pass.Output, pass.Width, pass.Height)
+	}
+	if pass.ShutterOpen < 0 || pass.ShutterClose > 1 {
+		return Errorf(ErrBadRequest, "shutter interval outside the frame")
+	}
+
+	camera := &pass.Camera
+	if camera.RaysPerPixel < 1 {
+		return Errorf(ErrBadRequest, "at least one ray per pixel is required")
+	}
+	if camera.Projection < models.Perspective || camera.Projection > models.Ortographic {
+		return Errorf(ErrBadRequest, "unknown projection %d", camera.Projection)
+	}
+	if camera.Stereo < models.Mono || camera.Stereo > models.OmniDirectionalStereo {
+		return Errorf(ErrBadRequest, "unknown stereo mode %d", camera.Stereo)
+	}
+	if camera.StereoLayout < models.SideBySide || camera.StereoLayout > models.SingleEye {
+		return Errorf(ErrBadRequest, "unknown stereo layout %d", camera.StereoLayout)
+	}
+	if camera.Eye < models.LeftEye || camera.Eye > models.RightEye {
+		return Errorf(ErrBadRequest, "unknown eye %d", camera.Eye)
+	}
+	if camera.Projection == models.Perspective && (camera.FieldOfView <= 0 || camera.FieldOfView >= 180) {
+		return Errorf(ErrBadRequest, "field of view %v outside (0, 180)", camera.FieldOfView)
+	}
+
+	settings := &pass.Settings
+	if settings.LightSampleRays < 0 {
+		return Errorf(ErrBadRequest, "negative light sample rays")
+	}
+	if settings.ToneMapper < models.ClampToneMapper || settings.ToneMapper > models.AgXToneMapper {
+		return Errorf(ErrBadRequest, "unknown tone mapper %d", settings.ToneMapper)
+	}
+	if settings.OutputEncoding < models.GammaEncoding || settings.OutputEncoding > models.DisplayP3Encoding {
+		return Errorf(ErrBadRequest, "unknown output encoding %d", settings.OutputEncoding)
+	}
+	if settings.Filter < models.BoxFilter || settings.Filter > models.BlackmanHarrisFilter || settings.FilterRadius < 0 {
+		return Errorf(ErrBadRequest, "invalid filter %d with radius %v", settings.Filter, settings.FilterRadius)
+	}
+	if settings.ResultFormat != "" && settings.ResultFormat != models.RGBA8 && settings.ResultFormat != models.Float32 {
+		return Errorf(ErrBadRequest, "unknown result format %s", settings.ResultFormat)
+	}
+	if settings.DenoiseIterations < 0 || settings.AdaptiveMinSamples < 0 || settings.TargetSamples < 0 ||
+		settings.TimeBudget < 0 || settings.TargetNoise < 0 || settings.CheckpointInterval < 0 {
+		return Errorf(ErrBadRequest, "negative render setting")
+	}
+
+	return nil
+}
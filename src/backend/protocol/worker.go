@@ -0,0 +1,509 @@
+package protocol
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math/rand"
+	"raytracer/models"
+	"raytracer/process"
+	"raytracer/utility"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+// State kept by a WebWorker between calls. Every method recovers from
+// panics and reports them as errors, so a failed call never takes down
+// the wasm instance
+type Worker struct {
+	context         *models.RenderContext
+	activeRenderKey int
+
+	// Returns the newest render key of the frontend, polled between
+	// scanlines so that renders of older keys are preempted. Optional
+	ActiveRenderKey func() int
+	// Renders with keys below are cancelled
+	cancelKey int
+
+	incremental       *process.IncrementalRender
+	incrementalResult models.RenderResult
+	// Image of the previous incremental result, for sending changed regions only
+	incrementalPrevious *image.RGBA
+}
+
+func NewWorker() *Worker {
+	return &Worker{activeRenderKey: -1}
+}
+
+// Returns a JSON response from a panic of a call
+func recoverResponse(response *string) {
+	if r := recover(); r != nil {
+		*response = EncodeResponse(nil, recovered(r))
+	}
+}
+
+// Returns a binary result from a panic of a call
+func recoverResult(result *[]byte) {
+	if r := recover(); r != nil {
+		*result = ErrorResult(recovered(r))
+	}
+}
+
+// Returns a binary result without pixel data for the error
+func ErrorResult(err error) []byte {
+	protocolError := Classify(err)
+	result := models.RenderResult{
+		ExitCode: -1,
+		Code:     string(protocolError.Code),
+		Message:  protocolError.Message,
+	}
+	// Preempted renders are stopped, not failed
+	if protocolError.Code == ErrCancelled {
+		result.ExitCode = 0
+		result.StopReason = string(process.StopCancelled)
+	}
+	raw, _ := result.Binary(models.RGBA8, image.Rectangle{})
+	return raw
+}
+
+// Cancels the current and queued renders with keys below the given key
+func (worker *Worker) Cancel(renderKey int) {
+	if renderKey > worker.cancelKey {
+		worker.cancelKey = renderKey
+	}
+}
+
+func (worker *Worker) isCancelled(renderKey int) bool {
+	if renderKey < worker.cancelKey {
+		return true
+	}
+	return worker.ActiveRenderKey != nil && renderKey < worker.ActiveRenderKey()
+}
+
+func (worker *Worker) initialized() *Error {
+	if worker.context == nil {
+		return Errorf(ErrNotInitialized, "worker has no scene")
+	}
+	return nil
+}
+
+func (worker *Worker) bvhLoaded() *Error {
+	if err := worker.initialized(); err != nil {
+		return err
+	}
+	if worker.context.BVH == nil {
+		return Errorf(ErrNotInitialized, "worker has no BVH")
+	}
+	return nil
+}
+
+// Initializes the render context of the scene from the request payload
+// and the texture data in the order of RenderContext.RawTextures
+func (worker *Worker) Initialize(raw string, rawTextureData []*[]byte) (response string) {
+	defer recoverResponse(&response)
+
+	context := &models.RenderContext{}
+	if err := DecodeRequest(raw, context); err != nil {
+		return EncodeResponse(nil, err)
+	}
+	if err := ValidateContext(context); err != nil {
+		return EncodeResponse(nil, err)
+	}
+	if len(rawTextureData) < len(context.RawTextures) {
+		return EncodeResponse(nil, Errorf(ErrMissingTexture, "%d textures declared, %d given", len(context.RawTextures), len(rawTextureData)))
+	}
+
+	utility.ProgressUpdate(0.0, "RenderContext.Initialize", -1, 0)
+	if err := context.Initialize(rawTextureData); err != nil {
+		protocolError := Classify(err)
+		if protocolError.Code == ErrInternal {
+			protocolError.Code = ErrBadScene
+		}
+		return EncodeResponse(nil, protocolError)
+	}
+	if len(context.Triangles) == 0 && len(context.Instances) == 0 {
+		return EncodeResponse(nil, Errorf(ErrBadScene, "scene has no triangles"))
+	}
+	utility.ProgressUpdate(1.0, "RenderContext.Initialize", -1, 0)
+
+	worker.context = context
+	worker.incremental = nil
+	return EncodeResponse(nil, nil)
+}
+
+// Builds the BVH of the scene. The output is the binary BVH file for LoadBVH
+func (worker *Worker) BuildBVH() (output []byte, response string) {
+	defer recoverResponse(&response)
+
+	if err := worker.initialized(); err != nil {
+		return nil, EncodeResponse(nil, err)
+	}
+
+	utility.ProgressUpdate(0.0, "RenderContext.BuildBVH", -1, 0)
+	bvh := worker.context.BuildBVH()
+	utility.ProgressUpdate(1.0, "RenderContext.BuildBVH", -1, 0)
+
+	var buffer bytes.Buffer
+	if err := models.WriteBVHFile(&buffer, bvh); err != nil {
+		return nil, EncodeResponse(nil, err)
+	}
+	return buffer.Bytes(), ""
+}
+
+// Loads a BVH file built by BuildBVH for the same scene and build settings
+func (worker *Worker) LoadBVH(raw []byte) (response string) {
+	defer recoverResponse(&response)
+
+	if err := worker.initialized(); err != nil {
+		return EncodeResponse(nil, err)
+	}
+
+	bvh, err := models.ReadBVHFile(bytes.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		return EncodeResponse(nil, Errorf(ErrBVHMismatch, "invalid BVH file: %v", err))
+	}
+
+	utility.ProgressUpdate(0.0, "RenderContext.LoadBVH", -1, 0)
+	if err := worker.context.LoadBVH(bvh); err != nil {
+		return EncodeResponse(nil, err)
+	}
+	utility.ProgressUpdate(1.0, "RenderContext.LoadBVH", -1, 0)
+
+	return EncodeResponse(nil, nil)
+}
+
+// Moves an OBJ group, to the given vertices in the order of the group
+// or by a transform of its current vertices
+type GroupUpdate struct {
+	Name      string
+	Vertices  []mgl32.Vec3
+	Transform *mgl32.Mat4
+}
+
+// Moves an instance to a new object to world transform
+type InstanceUpdate struct {
+	Index     int
+	Transform mgl32.Mat4
+}
+
+type SceneUpdate struct {
+	Groups    []GroupUpdate
+	Instances []InstanceUpdate
+}
+
+type SceneUpdateResult struct {
+	// The refit grew the BVH cost too far and the BVH was rebuilt
+	Rebuilt bool
+}
+
+// Moves groups and instances of the scene and refits the BVH. The
+// incremental render is dropped, its samples are of the old scene
+func (worker *Worker) UpdateScene(raw string) (response string) {
+	defer recoverResponse(&response)
+
+	if err := worker.bvhLoaded(); err != nil {
+		return EncodeResponse(nil, err)
+	}
+	update := &SceneUpdate{}
+	if err := DecodeRequest(raw, update); err != nil {
+		return EncodeResponse(nil, err)
+	}
+
+	// The updates before a failed one are kept, the BVH is refit to them
+	err := applySceneUpdate(worker.context, update)
+	result := SceneUpdateResult{Rebuilt: worker.context.RefitBVH()}
+	worker.incremental = nil
+	if err != nil {
+		return EncodeResponse(nil, err)
+	}
+	return EncodeResponse(&result, nil)
+}
+
+func applySceneUpdate(context *models.RenderContext, update *SceneUpdate) *Error {
+	for _, group := range update.Groups {
+		vertices := group.Vertices
+		if group.Transform != nil {
+			current, err := context.GroupVertices(group.Name)
+			if err != nil {
+				return Errorf(ErrBadRequest, "%v", err)
+			}
+			vertices = make([]mgl32.Vec3, len(current))
+			for i, vertex := range current {
+				vertices[i] = mgl32.TransformCoordinate(vertex, *group.Transform)
+			}
+		}
+		if err := context.UpdateGroup(group.Name, vertices); err != nil {
+			return Errorf(ErrBadRequest, "%v", err)
+		}
+	}
+	for _, instance := range update.Instances {
+		if err := context.UpdateInstance(instance.Index, instance.Transform); err != nil {
+			return Errorf(ErrBadRequest, "instance %d: %v", instance.Index, err)
+		}
+	}
+	return nil
+}
+
+// Decodes, validates and initializes the render pass of a request
+func (worker *Worker) readRenderPass(raw string) (*models.RenderPass, *Error) {
+	if err := worker.bvhLoaded(); err != nil {
+		return nil, err
+	}
+
+	pass := &models.RenderPass{}
+	if err := DecodeRequest(raw, pass); err != nil {
+		return nil, err
+	}
+	if err := ValidatePass(pass); err != nil {
+		return nil, err
+	}
+
+	// Renders of a newer key have been requested
+	if worker.isCancelled(pass.RenderKey) {
+		return nil, Errorf(ErrCancelled, "render key %d is preempted", pass.RenderKey)
+	}
+	worker.Cancel(pass.RenderKey)
+	worker.context.Cancelled = func() bool {
+		return worker.isCancelled(pass.RenderKey)
+	}
+
+	rand.Seed(pass.RNGSeed)
+	pass.Initialize(worker.context)
+
+	if worker.activeRenderKey != pass.RenderKey {
+		worker.activeRenderKey = pass.RenderKey
+		worker.context.Rays = 0
+	}
+	pass.Camera.Initialize(pass.TotalWidth, pass.TotalHeight)
+	process.SeedSamples(worker.context, pass)
+
+	// Tiles are developed with the exposure of the whole frame
+	if pass.Camera.AutoExposure && pass.MeteredEV100 == nil && process.IsTile(pass) {
+		ev100 := process.MeterFrame(worker.context, pass)
+		pass.MeteredEV100 = &ev100
+	}
+
+	// Tiles are denoised with the pixels around them
+	process.GrowForDenoise(pass)
+	if pass.Width*pass.Height > MaxPassPixels {
+		return nil, Errorf(ErrOutOfMemory, "denoised region of %d pixels exceeds the limit of %d", pass.Width*pass.Height, MaxPassPixels)
+	}
+
+	return pass, nil
+}
+
+// Renders the region of the request. Returns the binary result
+func (worker *Worker) Render(raw string) (output []byte) {
+	defer recoverResult(&output)
+
+	pass, err := worker.readRenderPass(raw)
+	if err != nil {
+		return ErrorResult(err)
+	}
+	context := worker.context
+
+	if context.Debug {
+		println("Go WebAssembly render call")
+	}
+
+	result := models.RenderResult{}
+
+	// Fill with black
+	width, height := pass.OutputSize()
+	result.ImageData = image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(result.ImageData, result.ImageData.Bounds(), &image.Uniform{color.Black}, image.Point{}, draw.Src)
+
+	film := models.NewFilm(pass.Width, pass.Height, models.NewFilter(pass.Settings.Filter, pass.Settings.FilterRadius))
+
+	utility.ProgressUpdate(0.0, "trace", pass.TaskID, context.Rays)
+
+	stopReason := process.RenderFilm(context, pass, film, func(progress float32) {
+		utility.ProgressUpdate(progress, "trace", pass.TaskID, context.Rays)
+	})
+	result.StopReason = string(stopReason)
+	result.SamplesPerPixel = film.SamplesPerPixel()
+	if stopReason == process.StopCancelled {
+		result.Code = string(ErrCancelled)
+	}
+
+	utility.ProgressUpdate(1.0, "trace", pass.TaskID, context.Rays)
+
+	utility.ProgressUpdate(0.0, "output", pass.TaskID, context.Rays)
+
+	colors := process.Resolve(pass, film)
+	process.Develop(context, pass, colors, result.ImageData)
+	if pass.Settings.ResultFormat == models.Float32 {
+		result.Colors = colors
+	}
+
+	output, encodeError := result.Binary(pass.Settings.ResultFormat, result.ImageData.Bounds())
+	if encodeError != nil {
+		return ErrorResult(encodeError)
+	}
+	utility.ProgressUpdate(1.0, "output", pass.TaskID, context.Rays)
+
+	return output
+}
+
+// Starts an incremental render of the region of the request
+func (worker *Worker) InitializeIncrementalRender(raw string) (response string) {
+	defer recoverResponse(&response)
+
+	pass, err := worker.readRenderPass(raw)
+	if err != nil {
+		return EncodeResponse(nil, err)
+	}
+
+	if worker.context.Debug {
+		println("Go WebAssembly initializeIncrementalRender call")
+	}
+
+	worker.incremental = process.NewIncrementalRender(worker.context, pass)
+	worker.initializeIncrementalResult()
+
+	return EncodeResponse(nil, nil)
+}
+
+func (worker *Worker) initializeIncrementalResult() {
+	pass := worker.incremental.Pass
+	worker.incrementalResult = models.RenderResult{}
+
+	// Fill with black
+	width, height := pass.OutputSize()
+	worker.incrementalResult.ImageData = image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(worker.incrementalResult.ImageData, worker.incrementalResult.ImageData.Bounds(), &image.Uniform{color.Black}, image.Point{}, draw.Src)
+	worker.incrementalPrevious = nil
+}
+
+// Adds a sample round to the incremental render. Returns the binary result
+func (worker *Worker) IncrementalRender() (output []byte) {
+	defer recoverResult(&output)
+
+	if worker.incremental == nil {
+		return ErrorResult(Errorf(ErrNotInitialized, "no incremental render"))
+	}
+	context := worker.context
+	pass := worker.incremental.Pass
+	result := &worker.incrementalResult
+
+	if context.Debug {
+		println("Go WebAssembly incrementalRender call")
+	}
+
+	// Send first 0% progress
+	if worker.incremental.Rounds == 0 {
+		utility.ProgressUpdate(0.0, "trace", pass.TaskID, context.Rays)
+	}
+
+	// Each call adds at most one sample per pixel, until a termination criterion fires
+	stopReason := worker.incremental.Step(context)
+	result.StopReason = string(stopReason)
+	result.SamplesPerPixel = worker.incremental.Film.SamplesPerPixel()
+	if stopReason == process.StopCancelled {
+		result.Code = string(ErrCancelled)
+	}
+
+	utility.ProgressUpdate(worker.incremental.Progress(), "trace", pass.TaskID, context.Rays)
+
+	colors := process.Resolve(pass, worker.incremental.Film)
+	process.Develop(context, pass, colors, result.ImageData)
+	if pass.Settings.ResultFormat == models.Float32 {
+		result.Colors = colors
+	}
+
+	region := result.ImageData.Bounds()
+	if pass.Settings.ChangedRegionsOnly {
+		region = models.ChangedRegion(worker.incrementalPrevious, result.ImageData)
+		if worker.incrementalPrevious == nil {
+			worker.incrementalPrevious = image.NewRGBA(result.ImageData.Bounds())
+		}
+		copy(worker.incrementalPrevious.Pix, result.ImageData.Pix)
+	}
+
+	output, err := result.Binary(pass.Settings.ResultFormat, region)
+	if err != nil {
+		return ErrorResult(err)
+	}
+	return output
+}
+
+// Returns the incremental render state as checkpoint file bytes,
+// or the error response
+func (worker *Worker) CheckpointIncrementalRender() (output []byte, response string) {
+	defer recoverResponse(&response)
+
+	if worker.incremental == nil {
+		return nil, EncodeResponse(nil, Errorf(ErrNotInitialized, "no incremental render"))
+	}
+
+	var buffer bytes.Buffer
+	if err := models.WriteCheckpoint(&buffer, worker.incremental.Checkpoint(worker.context)); err != nil {
+		return nil, EncodeResponse(nil, err)
+	}
+	return buffer.Bytes(), ""
+}
+
+// Continues an incremental render from checkpoint file bytes
+func (worker *Worker) ResumeIncrementalRender(raw []byte) (response string) {
+	defer recoverResponse(&response)
+
+	if err := worker.bvhLoaded(); err != nil {
+		return EncodeResponse(nil, err)
+	}
+
+	checkpoint, err := models.ReadCheckpoint(bytes.NewReader(raw))
+	if err != nil {
+		return EncodeResponse(nil, Errorf(ErrBadRequest, "invalid checkpoint: %v", err))
+	}
+	if err := ValidatePass(&checkpoint.Pass); err != nil {
+		return EncodeResponse(nil, err)
+	}
+
+	render, err := process.ResumeIncrementalRender(worker.context, checkpoint)
+	if err != nil {
+		return EncodeResponse(nil, err)
+	}
+
+	// The checkpoint was taken under an earlier render key,
+	// the resumed render continues under the newest one
+	render.Pass.RenderKey = worker.cancelKey
+	if worker.ActiveRenderKey != nil && worker.ActiveRenderKey() > render.Pass.RenderKey {
+		render.Pass.RenderKey = worker.ActiveRenderKey()
+	}
+
+	worker.incremental = render
+	worker.activeRenderKey = render.Pass.RenderKey
+	worker.context.Cancelled = func() bool {
+		return worker.isCancelled(render.Pass.RenderKey)
+	}
+	worker.initializeIncrementalResult()
+
+	return EncodeResponse(nil, nil)
+}
+
+// Returns the lens distortion ST-map of the camera of the request as
+// 16-bit PNG bytes, or the error response
+func (worker *Worker) STMap(raw string) (output []byte, response string) {
+	defer recoverResponse(&response)
+
+	pass := &models.RenderPass{}
+	if err := DecodeRequest(raw, pass); err != nil {
+		return nil, EncodeResponse(nil, err)
+	}
+	if err := ValidatePass(pass); err != nil {
+		return nil, EncodeResponse(nil, err)
+	}
+	if pass.TotalWidth*pass.TotalHeight > MaxPassPixels {
+		return nil, EncodeResponse(nil, Errorf(ErrOutOfMemory, "frame of %d pixels exceeds the limit of %d", pass.TotalWidth*pass.TotalHeight, MaxPassPixels))
+	}
+
+	pass.Camera.Initialize(pass.TotalWidth, pass.TotalHeight)
+
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, pass.Camera.STMap()); err != nil {
+		return nil, EncodeResponse(nil, err)
+	}
+	return buffer.Bytes(), ""
+}
@@ -0,0 +1,464 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"raytracer/models"
+	"strings"
+	"testing"
+
+	"github.com/go-gl/mathgl/mgl32"
+)
+
+const testObj = `v -5 -1 -5
+v 5 -1 -5
+v 5 -1 5
+v -5 -1 5
+g Floor
+usemtl White
+f 1 2 3
+f 1 3 4
+`
+
+const testMtl = `newmtl White
+Kd 0.8 0.8 0.8
+`
+
+const testPass = `{
+	"TotalWidth": 8, "TotalHeight": 4, "Width": 8, "Height": 4,
+	"Camera": {"Transform": [1,0,0,0, 0,1,0,0, 0,0,1,0, 0,0,5,1], "ProjectionPlaneDistance": 1, "FieldOfView": 60, "RaysPerPixel": 2},
+	"Settings": {"BounceLimit": 1, "LightSampleRays": 1, "LightIntensity": 10}
+}`
+
+func request(payload string) string {
+	return `{"version": 1, "payload": ` + payload + `}`
+}
+
+func contextRequest(obj string, textures ...string) string {
+	context := map[string]interface{}{
+		"UseBVH":         true,
+		"BVHMaxLeafSize": 2,
+		"BVHMaxDepth":    10,
+		"ObjBuffer":      obj,
+		"MtlBuffer":      testMtl,
+	}
+	rawTextures := []map[string]string{}
+	for _, name := range textures {
+		rawTextures = append(rawTextures, map[string]string{"Name": name})
+	}
+	context["RawTextures"] = rawTextures
+
+	raw, _ := json.Marshal(context)
+	return request(string(raw))
+}
+
+func pngBytes() []byte {
+	var buffer bytes.Buffer
+	png.Encode(&buffer, image.NewNRGBA(image.Rect(0, 0, 2, 2)))
+	return buffer.Bytes()
+}
+
+// PNG whose header declares the given size, without the pixel data
+func pngHeader(width, height uint32) []byte {
+	header := pngBytes()[:33]
+	binary.BigEndian.PutUint32(header[16:], width)
+	binary.BigEndian.PutUint32(header[20:], height)
+	binary.BigEndian.PutUint32(header[29:], crc32.ChecksumIEEE(header[12:29]))
+	return header
+}
+
+func expectError(t *testing.T, name string, raw string, code ErrorCode) {
+	t.Helper()
+	response := Response{}
+	if err := json.Unmarshal([]byte(raw), &response); err != nil {
+		t.Fatalf("%s: invalid response %q", name, raw)
+	}
+	if response.Version != Version {
+		t.Errorf("%s: response version %d", name, response.Version)
+	}
+	if code == "" {
+		if !response.OK {
+			t.Errorf("%s: expected success, got %+v", name, response.Error)
+		}
+		return
+	}
+	if response.OK || response.Error == nil || response.Error.Code != code {
+		t.Errorf("%s: expected %s, got %s", name, code, raw)
+	}
+}
+
+func expectResultError(t *testing.T, name string, raw []byte, code ErrorCode) {
+	t.Helper()
+	header, _, err := models.ReadBinaryResult(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("%s: invalid result: %v", name, err)
+	}
+	if code == "" {
+		if header.ExitCode != 0 {
+			t.Errorf("%s: expected success, got %s %s", name, header.Code, header.Message)
+		}
+		return
+	}
+	if header.ExitCode == 0 || header.Code != string(code) {
+		t.Errorf("%s: expected %s, got %+v", name, code, header)
+	}
+}
+
+func loadedWorker(t *testing.T) *Worker {
+	worker := NewWorker()
+	expectError(t, "initialize", worker.Initialize(contextRequest(testObj), nil), "")
+	bvh, response := worker.BuildBVH()
+	if bvh == nil {
+		t.Fatalf("buildBVH failed: %s", response)
+	}
+	expectError(t, "loadBVH", worker.LoadBVH(bvh), "")
+	return worker
+}
+
+// Builds the BVH file of a scene in another worker
+func builtBVH(t *testing.T, context string) []byte {
+	t.Helper()
+	worker := NewWorker()
+	expectError(t, "initialize", worker.Initialize(context, nil), "")
+	bvh, response := worker.BuildBVH()
+	if bvh == nil {
+		t.Fatalf("buildBVH failed: %s", response)
+	}
+	return bvh
+}
+
+func TestRequestErrors(t *testing.T) {
+	worker := NewWorker()
+
+	expectError(t, "malformed JSON", worker.Initialize("{", nil), ErrBadRequest)
+	expectError(t, "unknown envelope field", worker.Initialize(`{"version": 1, "payload": {}, "extra": 1}`, nil), ErrBadRequest)
+	expectError(t, "unknown payload field", worker.Initialize(request(`{"ObjBufer": ""}`), nil), ErrBadRequest)
+	expectError(t, "unsupported version", worker.Initialize(`{"version": 0, "payload": {}}`, nil), ErrUnsupportedVersion)
+	expectError(t, "missing payload", worker.Initialize(`{"version": 1}`, nil), ErrBadRequest)
+}
+
+func TestSceneErrors(t *testing.T) {
+	worker := NewWorker()
+
+	expectError(t, "no geometry", worker.Initialize(request(`{}`), nil), ErrBadScene)
+	expectError(t, "no triangles", worker.Initialize(contextRequest("v 0 0 0\n"), nil), ErrBadScene)
+	expectError(t, "missing texture", worker.Initialize(contextRequest(testObj, "a.png"), nil), ErrMissingTexture)
+
+	broken := []byte("not an image")
+	expectError(t, "undecodable texture", worker.Initialize(contextRequest(testObj, "a.png"), []*[]byte{&broken}), ErrBadScene)
+
+	huge := pngHeader(60000, 60000)
+	expectError(t, "huge texture", worker.Initialize(contextRequest(testObj, "a.png"), []*[]byte{&huge}), ErrOutOfMemory)
+
+	valid := pngBytes()
+	expectError(t, "texture", worker.Initialize(contextRequest(testObj, "a.png"), []*[]byte{&valid}), "")
+}
+
+func TestNotInitializedErrors(t *testing.T) {
+	worker := NewWorker()
+
+	_, response := worker.BuildBVH()
+	expectError(t, "build BVH", response, ErrNotInitialized)
+	expectError(t, "load BVH", worker.LoadBVH(nil), ErrNotInitialized)
+	expectResultError(t, "render", worker.Render(request(testPass)), ErrNotInitialized)
+	expectError(t, "incremental render", worker.InitializeIncrementalRender(request(testPass)), ErrNotInitialized)
+	expectResultError(t, "incremental round", worker.IncrementalRender(), ErrNotInitialized)
+	_, response = worker.CheckpointIncrementalRender()
+	expectError(t, "checkpoint", response, ErrNotInitialized)
+	expectError(t, "resume", worker.ResumeIncrementalRender(nil), ErrNotInitialized)
+
+	// Scene without a BVH can't render
+	expectError(t, "initialize", worker.Initialize(contextRequest(testObj), nil), "")
+	expectResultError(t, "render without BVH", worker.Render(request(testPass)), ErrNotInitialized)
+}
+
+func TestBVHMismatch(t *testing.T) {
+	worker := loadedWorker(t)
+
+	expectError(t, "garbage", worker.LoadBVH([]byte("garbage")), ErrBVHMismatch)
+
+	// BVH of a scene with other geometry
+	obj := strings.Replace(testObj, "v 5 -1 5", "v 6 -1 5", 1)
+	expectError(t, "other scene", worker.LoadBVH(builtBVH(t, contextRequest(obj))), ErrBVHMismatch)
+
+	// BVH of the same scene built with other settings
+	settings := strings.Replace(contextRequest(testObj), `"BVHMaxLeafSize":2`, `"BVHMaxLeafSize":4`, 1)
+	expectError(t, "other settings", worker.LoadBVH(builtBVH(t, settings)), ErrBVHMismatch)
+
+	expectError(t, "same scene", worker.LoadBVH(builtBVH(t, contextRequest(testObj))), "")
+}
+
+func TestRenderErrors(t *testing.T) {
+	worker := loadedWorker(t)
+
+	expectResultError(t, "render", worker.Render(request(testPass)), "")
+
+	outside := strings.Replace(testPass, `"Width": 8`, `"Width": 9`, 1)
+	expectResultError(t, "region outside frame", worker.Render(request(outside)), ErrBadRequest)
+
+	noRays := strings.Replace(testPass, `"RaysPerPixel": 2`, `"RaysPerPixel": 0`, 1)
+	expectResultError(t, "no rays", worker.Render(request(noRays)), ErrBadRequest)
+
+	noFieldOfView := strings.Replace(testPass, `"FieldOfView": 60`, `"FieldOfView": 0`, 1)
+	expectResultError(t, "zero field of view", worker.Render(request(noFieldOfView)), ErrBadRequest)
+
+	toneMapper := strings.Replace(testPass, `"BounceLimit": 1`, `"BounceLimit": 1, "ToneMapper": 42`, 1)
+	expectResultError(t, "unknown tone mapper", worker.Render(request(toneMapper)), ErrBadRequest)
+
+	huge := strings.NewReplacer(`"TotalWidth": 8, "TotalHeight": 4, "Width": 8, "Height": 4`,
+		`"TotalWidth": 60000, "TotalHeight": 60000, "Width": 60000, "Height": 60000`).Replace(testPass)
+	expectResultError(t, "huge region", worker.Render(request(huge)), ErrOutOfMemory)
+
+	expectResultError(t, "malformed pass", worker.Render("["), ErrBadRequest)
+
+	// Denoised tiles render the frame around them but return the tile only
+	denoised := strings.NewReplacer(`"Width": 8`, `"Width": 3, "XOffset": 2`, `"BounceLimit": 1`, `"BounceLimit": 1, "Denoise": true`).Replace(testPass)
+	raw := worker.Render(request(denoised))
+	expectResultError(t, "denoised tile", raw, "")
+	if _, pixels, err := models.ReadBinaryResult(bytes.NewReader(raw)); err != nil || len(pixels) != 4*3*4 {
+		t.Errorf("Denoised tile has %d bytes of pixels: %v", len(pixels), err)
+	}
+}
+
+func TestCheckpointErrors(t *testing.T) {
+	worker := loadedWorker(t)
+
+	expectError(t, "incremental render", worker.InitializeIncrementalRender(request(testPass)), "")
+	expectResultError(t, "incremental round", worker.IncrementalRender(), "")
+	checkpoint, response := worker.CheckpointIncrementalRender()
+	if checkpoint == nil {
+		t.Fatalf("Checkpoint failed: %s", response)
+	}
+
+	expectError(t, "resume", worker.ResumeIncrementalRender(checkpoint), "")
+	expectError(t, "invalid checkpoint", worker.ResumeIncrementalRender([]byte("garbage")), ErrBadRequest)
+
+	// Checkpoint of another scene
+	other := NewWorker()
+	obj := strings.Replace(testObj, "v 5 -1 5", "v 6 -1 5", 1)
+	expectError(t, "initialize", other.Initialize(contextRequest(obj), nil), "")
+	bvh, _ := other.BuildBVH()
+	other.LoadBVH(bvh)
+	expectError(t, "other scene", other.ResumeIncrementalRender(checkpoint), ErrSceneMismatch)
+}
+
+func TestResumeTakesNextSample(t *testing.T) {
+	worker := loadedWorker(t)
+	expectError(t, "incremental render", worker.InitializeIncrementalRender(request(testPass)), "")
+	expectResultError(t, "incremental round", worker.IncrementalRender(), "")
+	checkpoint, response := worker.CheckpointIncrementalRender()
+	if checkpoint == nil {
+		t.Fatalf("Checkpoint failed: %s", response)
+	}
+
+	// Other cameras initialized in between use up random numbers
+	// of the sample scrambling
+	other := &models.Camera{ProjectionPlaneDistance: 1, FieldOfView: 60}
+	other.Initialize(8, 4)
+
+	resumed := loadedWorker(t)
+	expectError(t, "resume", resumed.ResumeIncrementalRender(checkpoint), "")
+
+	expected := worker.incremental.Pass.Camera.GetCameraRay(0, 0, 3, 2)
+	ray := resumed.incremental.Pass.Camera.GetCameraRay(0, 0, 3, 2)
+	if ray.PixelSample != expected.PixelSample || ray.Time != expected.Time {
+		t.Errorf("Resumed render took sample %v, expected %v", ray.PixelSample, expected.PixelSample)
+	}
+}
+
+func TestPanicsAreRecovered(t *testing.T) {
+	response := func() (response string) {
+		defer recoverResponse(&response)
+		panic("broken")
+	}()
+	expectError(t, "recovered response", response, ErrInternal)
+
+	result := func() (result []byte) {
+		defer recoverResult(&result)
+		var pass *models.RenderPass
+		return []byte{byte(pass.Width)}
+	}()
+	expectResultError(t, "recovered result", result, ErrInternal)
+}
+
+func TestSTMapErrors(t *testing.T) {
+	worker := NewWorker()
+
+	output, response := worker.STMap(request(testPass))
+	if output == nil {
+		t.Fatalf("ST-map failed: %s", response)
+	}
+	_, response = worker.STMap(request(`{"TotalWidth": -1}`))
+	expectError(t, "invalid pass", response, ErrBadRequest)
+
+	huge := strings.NewReplacer(`"TotalWidth": 8, "TotalHeight": 4`, `"TotalWidth": 60000, "TotalHeight": 60000`).Replace(testPass)
+	_, response = worker.STMap(request(huge))
+	expectError(t, "huge frame", response, ErrOutOfMemory)
+}
+
+func TestRenderPreemption(t *testing.T) {
+	worker := loadedWorker(t)
+	keyed := func(key string) string {
+		return request(strings.Replace(testPass, `"TotalWidth": 8`, `"RenderKey": `+key+`, "TotalWidth": 8`, 1))
+	}
+	expectCancelled := func(name string, raw []byte) {
+		t.Helper()
+		header, _, err := models.ReadBinaryResult(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("%s: invalid result: %v", name, err)
+		}
+		if header.ExitCode != 0 || header.Code != string(ErrCancelled) || header.StopReason != "cancelled" {
+			t.Errorf("%s: expected a cancelled result, got %+v", name, header)
+		}
+	}
+
+	worker.Cancel(5)
+	expectCancelled("older key", worker.Render(keyed("4")))
+	expectError(t, "older incremental key", worker.InitializeIncrementalRender(keyed("4")), ErrCancelled)
+	expectResultError(t, "current key", worker.Render(keyed("5")), "")
+
+	// A newer key becomes active while rendering
+	polls := 0
+	worker.ActiveRenderKey = func() int {
+		polls++
+		if polls > 2 {
+			return 7
+		}
+		return 6
+	}
+	expectCancelled("preempted render", worker.Render(keyed("6")))
+
+	polls = 0
+	expectError(t, "incremental", worker.InitializeIncrementalRender(keyed("6")), "")
+	expectCancelled("preempted incremental render", worker.IncrementalRender())
+}
+
+// Without a shared render key the frontend can only send cancel messages,
+// which the worker receives between the rounds of an incremental render
+func TestRenderPreemptionWithoutSharedKey(t *testing.T) {
+	worker := loadedWorker(t)
+	worker.ActiveRenderKey = func() int { return -1 }
+	keyed := func(key string) string {
+		return request(strings.Replace(testPass, `"TotalWidth": 8`, `"RenderKey": `+key+`, "TotalWidth": 8`, 1))
+	}
+
+	expectError(t, "incremental", worker.InitializeIncrementalRender(keyed("1")), "")
+	header, _, err := models.ReadBinaryResult(bytes.NewReader(worker.IncrementalRender()))
+	if err != nil || header.ExitCode != 0 || header.StopReason == "cancelled" {
+		t.Fatalf("First round should render, got %+v: %v", header, err)
+	}
+
+	worker.Cancel(2)
+	header, _, err = models.ReadBinaryResult(bytes.NewReader(worker.IncrementalRender()))
+	if err != nil || header.Code != string(ErrCancelled) || header.StopReason != "cancelled" {
+		t.Errorf("Round after a cancel message should stop, got %+v: %v", header, err)
+	}
+
+	// Renders queued before the cancel message are skipped
+	header, _, err = models.ReadBinaryResult(bytes.NewReader(worker.Render(keyed("1"))))
+	if err != nil || header.Code != string(ErrCancelled) {
+		t.Errorf("Queued render of the older key should be cancelled, got %+v: %v", header, err)
+	}
+	expectResultError(t, "newer key", worker.Render(keyed("2")), "")
+}
+
+const testChair = `v 0 0 0
+v 1 0 0
+v 0 1 0
+g Chair
+usemtl White
+f 1 2 3
+`
+
+// Scene of the chair instances and, if floor is set, the floor triangles
+func instanceRequest(floor bool, instances string) string {
+	obj := testChair
+	if floor {
+		obj = testObj + strings.NewReplacer("v 0", "v 2", "f 1 2 3", "f 5 6 7").Replace(testChair)
+	}
+	return strings.Replace(contextRequest(obj), `"BVHMaxDepth":10`, `"BVHMaxDepth":10,"Scene":{"Instances":`+instances+`}`, 1)
+}
+
+func TestUpdateScene(t *testing.T) {
+	expectError(t, "not initialized", NewWorker().UpdateScene(request(`{}`)), ErrNotInitialized)
+
+	worker := loadedWorker(t)
+	expectError(t, "incremental", worker.InitializeIncrementalRender(request(testPass)), "")
+	expectError(t, "move group", worker.UpdateScene(request(`{"Groups": [{"Name": "Floor", "Transform": [1,0,0,0, 0,1,0,0, 0,0,1,0, 0,-1,0,1]}]}`)), "")
+	if vertices, _ := worker.context.GroupVertices("Floor"); vertices[0] != (mgl32.Vec3{-5, -2, -5}) {
+		t.Errorf("Moved floor starts at %v", vertices[0])
+	}
+	if err := worker.context.BVH.Validate(len(worker.context.Triangles)); err != nil {
+		t.Error(err)
+	}
+	expectResultError(t, "incremental after update", worker.IncrementalRender(), ErrNotInitialized)
+	expectResultError(t, "render after update", worker.Render(request(testPass)), "")
+
+	expectError(t, "unknown group", worker.UpdateScene(request(`{"Groups": [{"Name": "Wall", "Vertices": []}]}`)), ErrBadRequest)
+	expectError(t, "vertex count", worker.UpdateScene(request(`{"Groups": [{"Name": "Floor", "Vertices": [[0,0,0]]}]}`)), ErrBadRequest)
+	expectError(t, "unknown instance", worker.UpdateScene(request(`{"Instances": [{"Index": 0}]}`)), ErrBadRequest)
+}
+
+func TestInstancedScene(t *testing.T) {
+	instances := `[
+		{"Group": "Chair"},
+		{"Group": "Chair", "Transform": [0,0,-1,0, 0,1,0,0, 1,0,0,0, 3,0,0,1]},
+		{"Group": "Chair", "Transform": [1,0,0,0, 0,1,0,0, 0,0,1,0, -3,0,0,1], "Material": "White"}
+	]`
+
+	for _, floor := range []bool{false, true} {
+		worker := NewWorker()
+		expectError(t, "initialize", worker.Initialize(instanceRequest(floor, instances), nil), "")
+		bvh, response := worker.BuildBVH()
+		if bvh == nil {
+			t.Fatalf("buildBVH failed: %s", response)
+		}
+		expectError(t, "load BVH", worker.LoadBVH(bvh), "")
+		expectResultError(t, "render", worker.Render(request(testPass)), "")
+
+		expectError(t, "other instances", worker.LoadBVH(builtBVH(t, instanceRequest(floor, `[{"Group": "Chair"}]`))), ErrBVHMismatch)
+	}
+
+	worker := NewWorker()
+	expectError(t, "unknown group", worker.Initialize(instanceRequest(true, `[{"Group": "Table"}]`), nil), ErrBadScene)
+	expectError(t, "unknown material", worker.Initialize(instanceRequest(true, `[{"Group": "Chair", "Material": "Red"}]`), nil), ErrBadScene)
+	expectError(t, "singular transform", worker.Initialize(instanceRequest(true, `[{"Group": "Chair", "Transform": [1,0,0,0, 0,0,0,0, 0,0,1,0, 0,0,0,1]}]`), nil), ErrBadScene)
+}
+
+func TestTilesShareAutoExposure(t *testing.T) {
+	worker := loadedWorker(t)
+	tile := func(x int, seed int) string {
+		return request(strings.NewReplacer(
+			`"Width": 8`, fmt.Sprintf(`"Width": 4, "XOffset": %d, "RNGSeed": %d`, x, seed),
+			`"RaysPerPixel": 2`, `"RaysPerPixel": 2, "AutoExposure": true`,
+			`"LightIntensity": 10`, `"LightIntensity": 10, "DebugLightAtCamera": true, "DebugLightSize": 1`,
+			// Below the floor, which faces down
+			"0,0,5,1", "0,-3,5,1",
+		).Replace(testPass))
+	}
+
+	left, err := worker.readRenderPass(tile(0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	right, err := worker.readRenderPass(tile(4, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left.MeteredEV100 == nil || right.MeteredEV100 == nil || *left.MeteredEV100 != *right.MeteredEV100 {
+		t.Errorf("Tiles were metered differently: %v, %v", left.MeteredEV100, right.MeteredEV100)
+	}
+
+	frame, err := worker.readRenderPass(request(strings.Replace(testPass, `"RaysPerPixel": 2`, `"RaysPerPixel": 2, "AutoExposure": true`, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.MeteredEV100 != nil {
+		t.Errorf("Whole frame should meter its own colors")
+	}
+}
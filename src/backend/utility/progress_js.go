@@ -0,0 +1,15 @@
+//go:build js && wasm
+// +build js,wasm
+
+package utility
+
+import "syscall/js"
+
+// Progress is reported to the webworker, which forwards it to the main thread
+func reportProgress(raw string) {
+	progressUpdate := js.Global().Get("progressUpdate")
+	if progressUpdate.Type() != js.TypeFunction {
+		return
+	}
+	progressUpdate.Invoke(raw)
+}
@@ -0,0 +1,13 @@
+//go:build !js || !wasm
+// +build !js !wasm
+
+package utility
+
+// Receives the JSON encoded progress updates of the native renderer
+var ProgressHandler func(raw string)
+
+func reportProgress(raw string) {
+	if ProgressHandler != nil {
+		ProgressHandler(raw)
+	}
+}
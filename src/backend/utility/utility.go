@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"math"
 	"math/rand"
-	"syscall/js"
 
 	"github.com/go-gl/mathgl/mgl32"
 	"github.com/udhos/gwob"
@@ -28,7 +27,7 @@ func ProgressUpdate(progress float32, event string, taskId int, rays uint64) {
 		panic(err)
 	}
 
-	js.Global().Call("progressUpdate", string(raw))
+	reportProgress(string(raw))
 }
 
 func ClampColor(c mgl32.Vec3) mgl32.Vec3 {
@@ -47,8 +46,10 @@ func MultiplyColor(c1 mgl32.Vec3, c2 mgl32.Vec3) mgl32.Vec3 {
 	}
 }
 
-func RandomInHemisphere(normal mgl32.Vec3) mgl32.Vec3 {
-	inUnitSphere := RandomInUnitSphere()
+// The random functions draw from the given source,
+// or from the global one if it is nil
+func RandomInHemisphere(rng *rand.Rand, normal mgl32.Vec3) mgl32.Vec3 {
+	inUnitSphere := RandomInUnitSphere(rng)
 	if inUnitSphere.Dot(normal) > 0.0 {
 		return inUnitSphere
 	}
@@ -56,12 +57,16 @@ func RandomInHemisphere(normal mgl32.Vec3) mgl32.Vec3 {
 	return inUnitSphere.Mul(-1)
 }
 
-func RandomInUnitSphere() mgl32.Vec3 {
+func RandomInUnitSphere(rng *rand.Rand) mgl32.Vec3 {
+	random := rand.Float32
+	if rng != nil {
+		random = rng.Float32
+	}
 	for {
 		p := mgl32.Vec3{
-			rand.Float32()*2 - 1,
-			rand.Float32()*2 - 1,
-			rand.Float32()*2 - 1,
+			random()*2 - 1,
+			random()*2 - 1,
+			random()*2 - 1,
 		}
 		if p.LenSqr() < 1 {
 			return p
@@ -111,3 +116,17 @@ func VertexCoordinates(o *gwob.Obj, stride int) (float32, float32, float32, erro
 
 	return o.Coord[f], o.Coord[f+1], o.Coord[f+2], nil
 }
+
+func MinInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func MaxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
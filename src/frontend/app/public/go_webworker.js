@@ -11,14 +11,50 @@ function progressUpdate(params) {
   });
 }
 
+// Wraps a JSON payload in a request of the worker protocol
+// eslint-disable-next-line no-unused-vars
+function request(payload) {
+  return '{"version":' + self.protocolVersion + ',"payload":' + payload + "}";
+}
+
+// Splits a binary render result into the JSON header and the pixel data.
+// Pixels are 8-bit RGBA or float32 RGBA depending on the header format
+// eslint-disable-next-line no-unused-vars
+function parseResult(bytes) {
+  let headerLength = new DataView(
+    bytes.buffer,
+    bytes.byteOffset,
+    4
+  ).getUint32(0, true);
+  let header = JSON.parse(
+    new TextDecoder().decode(bytes.subarray(4, 4 + headerLength))
+  );
+  header.pixels = bytes.buffer.slice(
+    bytes.byteOffset + 4 + headerLength,
+    bytes.byteOffset + bytes.byteLength
+  );
+  return header;
+}
+
 {
   let go = null;
   let workerId = null;
   let renderFunc = null;
   let incrementalRenderFunc = null;
   let initializeIncrementalRenderFunc = null;
+  let checkpointIncrementalRenderFunc = null;
+  let resumeIncrementalRenderFunc = null;
   let buildBVHFunc = null;
   let loadBVHFunc = null;
+  let updateSceneFunc = null;
+  let renderKeys = null;
+  let incrementalTask = 0;
+
+  // Polled by the renderer, renders of older keys stop early
+  self.activeRenderKey = () => (renderKeys ? Atomics.load(renderKeys, 0) : -1);
+
+  // Lets queued messages run between the rounds of an incremental render
+  let yieldToMessages = () => new Promise((resolve) => setTimeout(resolve, 0));
 
   onmessage = async (e) => {
     // Sending logging events to main thread
@@ -30,8 +66,38 @@ function progressUpdate(params) {
       });
     };
 
+    // Parses a JSON response, errors are reported to the main thread.
+    // Cancelled requests are expected when a newer render starts
+    let checkResponse = (raw) => {
+      let response = JSON.parse(raw);
+      if (!response.ok && response.error.code !== "cancelled") {
+        postMessage({
+          workerError: true,
+          workerId: workerId,
+          error: response.error,
+        });
+      }
+      return response;
+    };
+
+    // Parses a binary render result, errors are reported to the main thread
+    let checkResult = (bytes) => {
+      let output = parseResult(bytes);
+      if (output.exitCode !== 0) {
+        postMessage({
+          workerError: true,
+          workerId: workerId,
+          error: { code: output.code, message: output.message },
+        });
+      }
+      return output;
+    };
+
     if (e.data.type === "initialize") {
       workerId = e.data.workerId;
+      if (e.data.renderKeys) {
+        renderKeys = new Int32Array(e.data.renderKeys);
+      }
       log(workerId, "Initializing worker", workerId);
       let compileStartTime = Date.now();
       log(workerId, "Initializing golang wasm");
@@ -57,7 +123,9 @@ function progressUpdate(params) {
       );
 
       // Initialize rendering context
-      self.initialize(e.data.initializeParams, ...textureData);
+      checkResponse(
+        self.initialize(request(e.data.initializeParams), ...textureData)
+      );
 
       log(
         workerId,
@@ -68,8 +136,11 @@ function progressUpdate(params) {
       renderFunc = self.render;
       incrementalRenderFunc = self.incrementalRender;
       initializeIncrementalRenderFunc = self.initializeIncrementalRender;
+      checkpointIncrementalRenderFunc = self.checkpointIncrementalRender;
+      resumeIncrementalRenderFunc = self.resumeIncrementalRender;
       buildBVHFunc = self.buildBVH;
       loadBVHFunc = self.loadBVH;
+      updateSceneFunc = self.updateScene;
 
       // Worker manager is allowed to send render messages to this worker
       postMessage({
@@ -79,7 +150,12 @@ function progressUpdate(params) {
       log(workerId, "Building BVH");
       let buildBVHStartTime = Date.now();
 
-      let outputRaw = buildBVHFunc();
+      // BVH file bytes, or a JSON response if the build failed
+      let output = buildBVHFunc();
+      if (typeof output === "string") {
+        checkResponse(output);
+        output = null;
+      }
 
       log(workerId, "Building BVH complete!");
       log(workerId, "Took", Date.now() - buildBVHStartTime, "ms");
@@ -87,13 +163,19 @@ function progressUpdate(params) {
       postMessage({
         buildBVHDone: true,
         workerId: workerId,
-        output: JSON.parse(outputRaw),
+        output: output,
       });
     } else if (e.data.type === "loadBVH") {
       log(workerId, "Loading BVH");
       let loadBVHStartTime = Date.now();
 
-      loadBVHFunc(e.data.bvhData);
+      // Stored BVH files of another scene or build settings are rebuilt,
+      // the mismatch is not reported as an error
+      let raw = loadBVHFunc(e.data.bvhData);
+      let response = JSON.parse(raw);
+      if (!response.ok && response.error.code !== "bvhMismatch") {
+        checkResponse(raw);
+      }
 
       log(workerId, "Loading BVH complete!");
       log(workerId, "Took", Date.now() - loadBVHStartTime, "ms");
@@ -101,39 +183,114 @@ function progressUpdate(params) {
       postMessage({
         loadBVHDone: true,
         workerId: workerId,
+        ok: response.ok,
+      });
+    } else if (e.data.type === "updateScene") {
+      log(workerId, "Updating scene");
+
+      // A running incremental render has samples of the old scene
+      incrementalTask++;
+      let response = checkResponse(
+        updateSceneFunc(request(e.data.updateParams))
+      );
+      if (response.ok && response.result.Rebuilt) {
+        log(workerId, "Rebuilt the BVH after the update");
+      }
+
+      postMessage({
+        updateSceneDone: true,
+        workerId: workerId,
+        ok: response.ok,
       });
     } else if (e.data.type === "render") {
       log(workerId, "Rendering task", e.data.taskId);
       let renderStartTime = Date.now();
 
       // Main render call
-      let outputRaw = renderFunc(e.data.renderParams);
+      let output = checkResult(renderFunc(request(e.data.renderParams)));
 
       log(workerId, "Rendering complete!");
       log(workerId, "Took", Date.now() - renderStartTime, "ms");
 
-      postMessage({
-        renderDone: true,
-        workerId: workerId,
-        output: JSON.parse(outputRaw),
-        params: e.data.renderParams, // return original params for parsing the final image
-      });
+      postMessage(
+        {
+          renderDone: true,
+          workerId: workerId,
+          output: output,
+          params: e.data.renderParams, // return original params for parsing the final image
+        },
+        [output.pixels]
+      );
     } else if (e.data.type === "incrementalRender") {
       log(workerId, "Incremental rendering task", e.data.taskId);
       let renderStartTime = Date.now();
+      let task = ++incrementalTask;
 
-      initializeIncrementalRenderFunc(e.data.renderParams);
+      // Resume from a stored checkpoint if it matches the scene
+      let resumed =
+        e.data.checkpoint &&
+        JSON.parse(resumeIncrementalRenderFunc(e.data.checkpoint)).ok;
+      if (resumed) {
+        log(workerId, "Resumed from checkpoint");
+      } else {
+        let response = checkResponse(
+          initializeIncrementalRenderFunc(request(e.data.renderParams))
+        );
+        if (!response.ok) {
+          postMessage({
+            incrementalRenderDone: true,
+            workerId: workerId,
+          });
+          return;
+        }
+      }
 
       for (let i = 0; i < e.data.raysPerPixel; i++) {
+        // A newer incremental render has taken over the renderer
+        if (task !== incrementalTask) {
+          return;
+        }
+
         // Main render call
-        let outputRaw = incrementalRenderFunc(e.data.renderParams);
+        let output = checkResult(incrementalRenderFunc());
+        let stopped = output.stopReason === "cancelled";
 
-        postMessage({
-          incrementalRenderPartial: true,
-          workerId: workerId,
-          output: JSON.parse(outputRaw),
-          params: e.data.renderParams, // return original params for parsing the final image
-        });
+        postMessage(
+          {
+            incrementalRenderPartial: true,
+            workerId: workerId,
+            output: output,
+            params: e.data.renderParams, // return original params for parsing the final image
+          },
+          [output.pixels]
+        );
+
+        if (stopped) {
+          log(workerId, "Rendering cancelled");
+          break;
+        }
+
+        if (
+          e.data.checkpointInterval > 0 &&
+          (i + 1) % e.data.checkpointInterval === 0
+        ) {
+          let checkpoint = checkpointIncrementalRenderFunc();
+          if (typeof checkpoint === "string") {
+            checkResponse(checkpoint);
+          } else {
+            postMessage(
+              {
+                incrementalCheckpoint: true,
+                workerId: workerId,
+                checkpointKey: e.data.checkpointKey,
+                data: checkpoint,
+              },
+              [checkpoint.buffer]
+            );
+          }
+        }
+
+        await yieldToMessages();
       }
 
       postMessage({
@@ -143,6 +300,8 @@ function progressUpdate(params) {
 
       log(workerId, "Rendering complete!");
       log(workerId, "Took", Date.now() - renderStartTime, "ms");
+    } else if (e.data.type === "cancel") {
+      self.cancelRender(e.data.renderKey);
     } else if (e.data.type === "askForWork") {
       // Used for the first task
       postMessage({
@@ -25,6 +25,12 @@ export default class Renderer extends BaseComponent {
     super(props);
     this.rendererFrameRef = React.createRef();
     this.workers = {};
+    // The render key shared with the workers, so that a running render
+    // notices that it has been superseded without waiting for messages
+    this.renderKeys =
+      window.crossOriginIsolated && typeof SharedArrayBuffer !== "undefined"
+        ? new Int32Array(new SharedArrayBuffer(4))
+        : null;
     this.state = {
       running: false,
       initialized: false,
@@ -164,6 +170,18 @@ export default class Renderer extends BaseComponent {
     await this.wasmRender(params);
   };
 
+  // Moves groups or instances in all workers and renders the updated scene
+  onUpdateScene = async (e, update, params) => {
+    if (!this.state.initialized) {
+      return;
+    }
+
+    this.cancelRenders(this.state.renderKey + 1);
+    if (await this.updateScene(Object.values(this.workers), update)) {
+      await this.wasmRender(params);
+    }
+  };
+
   onInitializeContext = async (e, params) => {
     await this.reloadWebAssembly();
     await this.wasmSetup(params);
@@ -196,6 +214,8 @@ export default class Renderer extends BaseComponent {
       UseBVH: params.useBVH,
       BVHMaxLeafSize: params.maxLeafSize,
       BVHMaxDepth: params.maxDepth,
+      // Exact split plane sweep instead of the faster binned builder
+      BVHBuilder: params.highQualityBVH ? 1 : 0,
       Scene: {}, //this.state.sceneData,
       ObjBuffer: this.state.objData,
       MtlBuffer: this.state.mtlData,
@@ -244,7 +264,13 @@ export default class Renderer extends BaseComponent {
       }
     }
 
-    if (!bvhData) {
+    // Stored BVH files are rebuilt if they don't match the scene
+    let loaded = false;
+    if (bvhData) {
+      loaded = await this.loadBVH(workers, bvhData);
+    }
+
+    if (!loaded) {
       // Build BVH
       let bvhWorker = workers[0];
       let buildBVHPromise = new Promise((resolve) => {
@@ -257,45 +283,29 @@ export default class Renderer extends BaseComponent {
         this.buildBVHWorker(bvhWorker);
       });
 
-      bvhData = JSON.stringify(await buildBVHPromise);
-    }
+      bvhData = await buildBVHPromise;
 
-    if (params.saveBVH) {
-      let rawData = {
-        id: bvhKey,
-        data: bvhData,
-      };
+      if (params.saveBVH && bvhData) {
+        let rawData = {
+          id: bvhKey,
+          data: bvhData,
+        };
 
-      try {
-        await saveToIndexedDB("bvhStore", rawData);
-      } catch (error) {
-        console.log("Could not save to indexed DB", error);
+        try {
+          await saveToIndexedDB("bvhStore", rawData);
+        } catch (error) {
+          console.log("Could not save to indexed DB", error);
+        }
       }
-    }
-
-    if (this.state.aborted) {
-      await this.terminateWorkers();
-      return;
-    }
 
-    // Load BVH to all workers
-    let loadBVHPromises = [];
-    for (let worker of workers) {
-      loadBVHPromises.push(
-        new Promise((resolve) => {
-          worker.worker.addEventListener("message", async (event) => {
-            if (event.data.loadBVHDone) {
-              resolve();
-            }
-          });
+      if (this.state.aborted) {
+        await this.terminateWorkers();
+        return;
+      }
 
-          this.loadBVHWorker(worker, bvhData);
-        })
-      );
+      await this.loadBVH(workers, bvhData);
     }
 
-    await Promise.all(loadBVHPromises);
-
     if (this.state.aborted) {
       await this.terminateWorkers();
       return;
@@ -329,6 +339,8 @@ export default class Renderer extends BaseComponent {
       renderKey: this.state.renderKey + 1, // Re-keys the component, forces recreation
     });
 
+    this.cancelRenders(this.state.renderKey);
+
     // Clean any spawn rays, trace or output event data
     for (let workerId in this.state.renderEventData) {
       let workerEventData = this.state.renderEventData[workerId];
@@ -432,8 +444,8 @@ export default class Renderer extends BaseComponent {
             ForceDebugLight: params.forceDebugLight,
             DebugLightAtCamera: params.debugLightAtCamera,
             DebugLightTransform: debugLightTransform,
+            CheckpointInterval: params.checkpointInterval,
           },
-          IncrementalRendering: params.incrementalRendering,
         };
 
         this.renderTasks.push(task);
@@ -459,6 +471,20 @@ export default class Renderer extends BaseComponent {
     }
   };
 
+  // Stops the renders of older render keys running in the workers
+  cancelRenders = (renderKey) => {
+    if (this.renderKeys) {
+      Atomics.store(this.renderKeys, 0, renderKey);
+    }
+    for (let workerId in this.workers) {
+      this.workers[workerId].worker.postMessage({
+        workerId: workerId,
+        type: "cancel",
+        renderKey: renderKey,
+      });
+    }
+  };
+
   setupWorker = async (workerId, initializeParams) => {
     let workerScript = new window.Worker("go_webworker.js");
     let worker = {
@@ -499,6 +525,13 @@ export default class Renderer extends BaseComponent {
   };
 
   workerLogger = async (event) => {
+    if (event.data.workerError) {
+      console.error(
+        "[WebWorker " + event.data.workerId + "] " + event.data.error.code,
+        event.data.error.message
+      );
+      return;
+    }
     if (event.data.logMessage) {
       console.log(
         "%c [WebWorker " +
@@ -548,13 +581,13 @@ export default class Renderer extends BaseComponent {
 
   workerRenderDone = async (event, worker) => {
     if (event.data.renderDone) {
-      // Completion of the WebWorker
-      if (event.data.output) {
-        let params = JSON.parse(event.data.params);
+      // Completion of the WebWorker, results of cancelled renders are dropped
+      let params = event.data.params ? JSON.parse(event.data.params) : null;
+      if (event.data.output && params.RenderKey === this.state.renderKey) {
         let imageData = [...this.state.imageData];
         imageData.push({
           params: params,
-          imageData: event.data.output.imageData,
+          imageData: event.data.output,
         });
         await this.setStateAsync({
           ...this.state,
@@ -587,9 +620,23 @@ export default class Renderer extends BaseComponent {
   };
 
   workerIncrementalRenderDone = async (event, worker) => {
+    if (event.data.incrementalCheckpoint) {
+      try {
+        await saveToIndexedDB("checkpointStore", {
+          id: event.data.checkpointKey,
+          data: event.data.data,
+        });
+      } catch (error) {
+        console.log("Could not save checkpoint to indexed DB", error);
+      }
+    }
+
     if (event.data.incrementalRenderPartial) {
       if (event.data.output) {
         let params = JSON.parse(event.data.params);
+        if (params.RenderKey !== this.state.renderKey) {
+          return;
+        }
         let imageData = [...this.state.imageData];
         // Remove existing image data for the given worker
         let existingIndex = imageData.findIndex(
@@ -600,7 +647,7 @@ export default class Renderer extends BaseComponent {
         }
         imageData.push({
           params: params,
-          imageData: event.data.output.imageData,
+          imageData: event.data.output,
         });
         await this.setStateAsync({
           ...this.state,
@@ -652,11 +699,60 @@ export default class Renderer extends BaseComponent {
         type: "initialize",
         initializeParams: params,
         textureData: textureData,
+        renderKeys: this.renderKeys ? this.renderKeys.buffer : null,
       },
       textureData
     );
   };
 
+  // Loads the BVH file bytes to all workers, true if every worker loaded it
+  loadBVH = async (workers, bvhData) => {
+    let loadBVHPromises = [];
+    for (let worker of workers) {
+      loadBVHPromises.push(
+        new Promise((resolve) => {
+          worker.worker.addEventListener("message", async (event) => {
+            if (event.data.loadBVHDone) {
+              resolve(event.data.ok);
+            }
+          });
+
+          this.loadBVHWorker(worker, bvhData);
+        })
+      );
+    }
+
+    let results = await Promise.all(loadBVHPromises);
+    return results.every((ok) => ok);
+  };
+
+  // Sends the scene update to all workers, true if every worker applied it
+  updateScene = async (workers, update) => {
+    let updateScenePromises = [];
+    for (let worker of workers) {
+      updateScenePromises.push(
+        new Promise((resolve) => {
+          let listener = (event) => {
+            if (event.data.updateSceneDone) {
+              worker.worker.removeEventListener("message", listener);
+              resolve(event.data.ok);
+            }
+          };
+          worker.worker.addEventListener("message", listener);
+
+          worker.worker.postMessage({
+            workerId: worker.workerId,
+            type: "updateScene",
+            updateParams: JSON.stringify(update),
+          });
+        })
+      );
+    }
+
+    let results = await Promise.all(updateScenePromises);
+    return results.every((ok) => ok);
+  };
+
   buildBVHWorker = async (worker) => {
     // Start the worker
     // Each worker has to compile the source because it is not possible to
@@ -685,13 +781,36 @@ export default class Renderer extends BaseComponent {
     });
   };
 
+  // Checkpoints are stored per task region and camera, ignoring
+  // the identifiers that change between renders
+  getCheckpointKey = (task) => {
+    return MD5(
+      JSON.stringify({ ...task, TaskID: 0, RenderKey: 0, RNGSeed: 0 })
+    ).toString();
+  };
+
   incrementalRenderWorker = async (worker, task) => {
+    let checkpointKey = this.getCheckpointKey(task);
+    let checkpoint = undefined;
+    try {
+      let savedCheckpoint = await loadFromIndexedDB(
+        "checkpointStore",
+        checkpointKey
+      );
+      checkpoint = savedCheckpoint.data;
+    } catch (error) {
+      // No checkpoint to resume from
+    }
+
     worker.worker.postMessage({
       workerId: worker.workerId,
       taskId: task.TaskID,
       type: "incrementalRender",
       renderParams: JSON.stringify(task),
       raysPerPixel: task.Camera.RaysPerPixel,
+      checkpoint: checkpoint,
+      checkpointKey: checkpointKey,
+      checkpointInterval: task.Settings.CheckpointInterval,
     });
   };
 
@@ -846,6 +965,7 @@ export default class Renderer extends BaseComponent {
             onAbort={this.onAbort}
             onStartRender={this.onStartRender}
             onInitializeContext={this.onInitializeContext}
+            onUpdateScene={this.onUpdateScene}
             onChanged={this.onParamsChanged}
           ></RendererParams>
         )}
@@ -78,16 +78,26 @@ export default class RendererFrame extends BaseComponent {
 
   updateCanvas = () => {
     for (let result of this.props.imageData) {
-      let width = result.params.Width;
-      let height = result.params.Height;
-      let xoffset = result.params.XOffset;
-      let yoffset = result.params.YOffset;
+      // Results only contain the region of the pass that changed
+      let width = result.imageData.width;
+      let height = result.imageData.height;
+      let xoffset = result.params.XOffset + result.imageData.x;
+      let yoffset = result.params.YOffset + result.imageData.y;
+      if (width === 0 || height === 0) {
+        continue;
+      }
+
+      let data = this.toRGBA8(result.imageData);
+      if (!data) {
+        console.error(
+          "Cannot display render results of format",
+          result.imageData.format
+        );
+        continue;
+      }
 
       let offscreenContext = this.offscreenCanvas.getContext("2d");
 
-      let data = Uint8ClampedArray.from(
-        this.base64ToArrayBuffer(result.imageData.Pix)
-      );
       this.imageData = new ImageData(data, width, height);
 
       offscreenContext.putImageData(this.imageData, xoffset, yoffset);
@@ -104,6 +114,35 @@ export default class RendererFrame extends BaseComponent {
     }
   };
 
+  // Returns the pixels of a result as 8-bit RGBA, or null for an unknown
+  // format. Float32 results hold linear colors, which are sRGB encoded
+  toRGBA8 = (imageData) => {
+    if (imageData.format === "rgba8") {
+      return new Uint8ClampedArray(imageData.pixels);
+    }
+    if (imageData.format !== "float32") {
+      return null;
+    }
+
+    let linear = new Float32Array(imageData.pixels);
+    let data = new Uint8ClampedArray(linear.length);
+    for (let i = 0; i < linear.length; i += 4) {
+      for (let c = 0; c < 3; c++) {
+        data[i + c] = 255 * this.encodeSRGB(linear[i + c]);
+      }
+      data[i + 3] = 255 * linear[i + 3];
+    }
+    return data;
+  };
+
+  encodeSRGB = (value) => {
+    value = Math.min(Math.max(value, 0), 1);
+    if (value <= 0.0031308) {
+      return 12.92 * value;
+    }
+    return 1.055 * Math.pow(value, 1 / 2.4) - 0.055;
+  };
+
   base64ToHex = (str) => {
     const raw = atob(str);
     let result = "";
@@ -114,16 +153,6 @@ export default class RendererFrame extends BaseComponent {
     return result.toUpperCase();
   };
 
-  base64ToArrayBuffer = (base64) => {
-    var binary_string = atob(base64);
-    var len = binary_string.length;
-    var bytes = new Uint8ClampedArray(len);
-    for (var i = 0; i < len; i++) {
-      bytes[i] = binary_string.charCodeAt(i);
-    }
-    return bytes;
-  };
-
   render() {
     return (
       <div>
@@ -2,6 +2,7 @@ import { Row, Button, Container, Form } from "react-bootstrap";
 
 import BaseComponent from "../Common/BaseComponent";
 import React from "react";
+import { translate } from "../../utility/matrix";
 
 export default class RendererParams extends BaseComponent {
   constructor(props) {
@@ -35,6 +36,7 @@ export default class RendererParams extends BaseComponent {
         loadBVH: true,
         maxLeafSize: 6,
         maxDepth: 20,
+        highQualityBVH: false,
         lightIntensity: 100,
         renderAfterInitialization: true,
         incrementalRendering: false,
@@ -50,6 +52,10 @@ export default class RendererParams extends BaseComponent {
         debugLightCR: 255,
         debugLightCG: 255,
         debugLightCB: 255,
+        moveGroup: "",
+        moveX: 0,
+        moveY: 0,
+        moveZ: 0,
         // Note: when adding properties, add them to the preset.json files too
       },
     };
@@ -148,6 +154,19 @@ export default class RendererParams extends BaseComponent {
     await this.onParamsChanged();
   };
 
+  handleTextParamChanged = async (event, param) => {
+    let params = {
+      ...this.state.params,
+    };
+    params[param] = event.target.value;
+    await this.setStateAsync({
+      ...this.state,
+      params: params,
+    });
+
+    await this.onParamsChanged();
+  };
+
   handleProjectionChanged = async (event) => {
     await this.setStateAsync({
       ...this.state,
@@ -168,6 +187,21 @@ export default class RendererParams extends BaseComponent {
     await this.props.onStartRender(e, { ...this.state.params });
   };
 
+  // Translates the group in the initialized scene and renders it again
+  onMoveGroupClicked = async (e) => {
+    let params = this.state.params;
+    let transform = translate(
+      parseFloat(params.moveX) || 0,
+      parseFloat(params.moveY) || 0,
+      parseFloat(params.moveZ) || 0
+    );
+    await this.props.onUpdateScene(
+      e,
+      { Groups: [{ Name: params.moveGroup, Transform: transform }] },
+      { ...params }
+    );
+  };
+
   onInitializeClicked = async (e) => {
     e.preventDefault();
 
@@ -248,6 +282,21 @@ export default class RendererParams extends BaseComponent {
           />
         </Form.Group>
       );
+    } else if (type === "text") {
+      let value = this.state.params[field] || "";
+      return (
+        <Form.Group controlId={controlId} className="right-margin">
+          <Form.Label>{label}</Form.Label>
+          <Form.Control
+            disabled={disabled}
+            htmlSize={size}
+            type="text"
+            label={label}
+            value={value}
+            onChange={(e) => this.handleTextParamChanged(e, field)}
+          />
+        </Form.Group>
+      );
     } else if (type === "bool") {
       let value = this.getBoolParam(field);
       return (
@@ -420,6 +469,15 @@ export default class RendererParams extends BaseComponent {
                 value={this.getIntParam("maxDepth")}
                 onChange={(e) => this.handleIntParamChanged(e, "maxDepth")}
               />
+              <Form.Check
+                id="formCheckboxHighQualityBVH"
+                type="checkbox"
+                label="High quality"
+                checked={this.getBoolParam("highQualityBVH")}
+                onChange={(e) =>
+                  this.handleBoolParamChanged(e, "highQualityBVH")
+                }
+              />
             </Form.Group>
             <Form.Group
               controlId="formCheckboxSaveBVH"
@@ -454,6 +512,23 @@ export default class RendererParams extends BaseComponent {
               "Incremental rendering"
             )}
           </Row>
+          <Row className="param-row bottom-align">
+            {this.renderParam("moveGroup", "text", "Group", 12)}
+            {this.renderParam("moveX", "float", "Move X", 4)}
+            {this.renderParam("moveY", "float", "Move Y", 4)}
+            {this.renderParam("moveZ", "float", "Move Z", 4)}
+            <Form.Group className="right-margin">
+              <Button
+                variant="secondary"
+                onClick={this.onMoveGroupClicked}
+                disabled={
+                  !this.props.initialized || !this.state.params.moveGroup
+                }
+              >
+                Move group
+              </Button>
+            </Form.Group>
+          </Row>
           <Row>
             <Button
               variant="primary"
@@ -0,0 +1,10 @@
+// Serves the development build cross-origin isolated, which browsers
+// require for the SharedArrayBuffer of the render keys. Deployments
+// must send the same headers, see the README
+module.exports = function (app) {
+  app.use((req, res, next) => {
+    res.setHeader("Cross-Origin-Opener-Policy", "same-origin");
+    res.setHeader("Cross-Origin-Embedder-Policy", "require-corp");
+    next();
+  });
+};